@@ -0,0 +1,99 @@
+package webserver
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Clients send only a handful of distinct Accept headers, so this many is plenty to cache them all,
+// while bounding the memory a client sending arbitrary headers can consume.
+const maxCachedAcceptHeaders = 256
+
+type acceptedContentType struct {
+	contentType string
+	mainType    string
+	subType     string
+	weight      float64
+}
+
+// acceptCache holds Accept headers already parsed into their content types, ordered by preference
+type acceptCache struct {
+	mu      sync.RWMutex
+	entries map[string][]acceptedContentType
+}
+
+// Returns the content types of header ordered by preference. The result is shared, so must not be modified.
+func (cache *acceptCache) parse(header string) []acceptedContentType {
+	cache.mu.RLock()
+	accepted, isset := cache.entries[header]
+	cache.mu.RUnlock()
+	if isset {
+		return accepted
+	}
+
+	accepted = parseAcceptHeader(header)
+	cache.mu.Lock()
+	if cache.entries == nil {
+		cache.entries = make(map[string][]acceptedContentType)
+	}
+	if len(cache.entries) < maxCachedAcceptHeaders {
+		cache.entries[header] = accepted
+	}
+	cache.mu.Unlock()
+	return accepted
+}
+
+func parseAcceptHeader(header string) []acceptedContentType {
+	entries := strings.Split(header, ",")
+	accepted := make([]acceptedContentType, 0, len(entries))
+	for _, entry := range entries {
+		contentType, params, _ := strings.Cut(entry, ";")
+		contentType = strings.TrimSpace(contentType)
+		if contentType == "" {
+			continue
+		}
+		acceptedType := acceptedContentType{contentType: contentType, weight: 1.0}
+		acceptedType.mainType, acceptedType.subType, _ = strings.Cut(contentType, "/")
+
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name != "q" {
+				continue
+			}
+			weight, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				log.Println("Error parsing weight value:", err)
+				acceptedType.weight = -1
+			} else {
+				acceptedType.weight = weight
+			}
+		}
+		if acceptedType.weight < 0 {
+			continue
+		}
+		accepted = append(accepted, acceptedType)
+	}
+
+	// Types of equal weight are preferred in the order they're listed. Those with a weight of 0, explicitly marked as
+	// unacceptable, are left at the end.
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].weight > accepted[j].weight
+	})
+	return accepted
+}
+
+// Whether the media type of contentType has been explicitly marked as unacceptable (q=0) in accepted
+func excludedContentType(accepted []acceptedContentType, contentType string) bool {
+	mediaType := mediaTypeOf(contentType)
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	for idx := len(accepted) - 1; idx >= 0 && accepted[idx].weight == 0; idx-- {
+		switch accepted[idx].contentType {
+		case contentType, mediaType, mainType + "/*":
+			return true
+		}
+	}
+	return false
+}
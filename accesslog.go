@@ -0,0 +1,60 @@
+package webserver
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// AccessLogPolicy decides which requests are passed to the server's Logger.LogRequest, to keep busy servers' logs
+// from drowning in health checks and static assets. The zero value logs every request.
+//
+// Error responses (400 and over) are logged regardless of SkipPaths, SkipVerbs and SampleRate; only SkipStatus can
+// exclude them.
+type AccessLogPolicy struct {
+	// Paths of requests not to log, e.g. "/favicon.ico". An entry ending in "/" matches every path beginning with it,
+	// e.g. "/static/".
+	SkipPaths []string
+	// Verbs of requests not to log, e.g. OPTIONS
+	SkipVerbs []Verb
+	// Response codes not to log, e.g. {Min: 300, Max: 399} for redirects and 304s
+	SkipStatus []StatusRange
+	// The fraction of the remaining successful requests to log, chosen at random: 0.1 logs 1 in 10.
+	// Every request is logged when it's 0 (or not below 1).
+	SampleRate float64
+}
+
+// StatusRange is an inclusive range of HTTP status codes
+type StatusRange struct {
+	Min, Max int
+}
+
+// Whether req is to be logged once its response code is set
+func (policy *AccessLogPolicy) logs(req *Request) bool {
+	for _, status := range policy.SkipStatus {
+		if req.ResponseCode >= status.Min && req.ResponseCode <= status.Max {
+			return false
+		}
+	}
+	if req.ResponseCode >= 400 {
+		return true
+	}
+
+	for _, verb := range policy.SkipVerbs {
+		if req.Verb == verb {
+			return false
+		}
+	}
+	for _, path := range policy.SkipPaths {
+		if req.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(req.Path, path)) {
+			return false
+		}
+	}
+	return policy.SampleRate <= 0 || policy.SampleRate >= 1 || rand.Float64() < policy.SampleRate
+}
+
+// Logs req through the server's Logger, unless its AccessLog policy says otherwise
+func (s *Server[S]) logRequest(req *Request) {
+	if s.AccessLog.logs(req) {
+		s.Logger.LogRequest(req)
+	}
+}
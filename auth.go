@@ -0,0 +1,50 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type authIdentityKey struct{}
+
+// AuthIdentity returns the identity authenticated by BasicAuth or BearerAuth for the request
+func AuthIdentity(req *Request) (any, bool) {
+	return req.Get(authIdentityKey{})
+}
+
+// BasicAuth returns a middleware requiring HTTP Basic credentials accepted by check, responding with a 401 otherwise.
+// The authenticated username is available via AuthIdentity.
+func BasicAuth(realm string, check func(username string, password string) bool) Middleware {
+	challenge := fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm)
+	return func(req *Request) *Error {
+		username, password, ok := req.req.BasicAuth()
+		if !ok || !check(username, password) {
+			req.ResponseHeaders.Set("WWW-Authenticate", challenge)
+			return &Error{Code: http.StatusUnauthorized}
+		}
+		req.Set(authIdentityKey{}, username)
+		return nil
+	}
+}
+
+// BearerAuth returns a middleware requiring a bearer token, which validate maps to the identity it belongs to.
+// Requests without a valid token are responded to with a 401. The identity is available via AuthIdentity.
+func BearerAuth(realm string, validate func(token string) (any, bool)) Middleware {
+	challenge := fmt.Sprintf(`Bearer realm=%q`, realm)
+	return func(req *Request) *Error {
+		scheme, token, found := strings.Cut(req.Headers.Get("Authorization"), " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			req.ResponseHeaders.Set("WWW-Authenticate", challenge)
+			return &Error{Code: http.StatusUnauthorized}
+		}
+
+		identity, ok := validate(strings.TrimSpace(token))
+		if !ok || identity == nil {
+			req.ResponseHeaders.Set("WWW-Authenticate", challenge+`, error="invalid_token"`)
+			return &Error{Code: http.StatusUnauthorized}
+		}
+		req.Set(authIdentityKey{}, identity)
+		return nil
+	}
+}
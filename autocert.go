@@ -0,0 +1,21 @@
+package webserver
+
+import (
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AutoCert configures SecureConfig to serve certificates for hosts obtained (and renewed) automatically from
+// Let's Encrypt, cached in cacheDir so they survive restarts. The returned Manager can be further configured,
+// e.g. with an Email for expiry notices.
+//
+// Let's Encrypt validates each host over plain HTTP on port 80, so StartRedirect must also be listening there;
+// it answers the ACME HTTP-01 challenges as well as redirecting other requests to HTTPS.
+func (s *Server[S]) AutoCert(cacheDir string, hosts ...string) *autocert.Manager {
+	s.certManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+	}
+	s.SecureConfig = s.certManager.TLSConfig()
+	return s.certManager
+}
@@ -0,0 +1,279 @@
+package webserver
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheControl holds the directives of a Cache-Control response header.
+// Durations are sent in whole seconds, and omitted when zero.
+type CacheControl struct {
+	Public         bool
+	Private        bool
+	NoCache        bool
+	NoStore        bool
+	MustRevalidate bool
+	Immutable      bool
+	MaxAge         time.Duration
+	SharedMaxAge   time.Duration
+}
+
+func (cc CacheControl) String() string {
+	var directives []string
+	if cc.Public {
+		directives = append(directives, "public")
+	}
+	if cc.Private {
+		directives = append(directives, "private")
+	}
+	if cc.NoCache {
+		directives = append(directives, "no-cache")
+	}
+	if cc.NoStore {
+		directives = append(directives, "no-store")
+	}
+	if cc.MaxAge > 0 {
+		directives = append(directives, "max-age="+strconv.FormatInt(int64(cc.MaxAge/time.Second), 10))
+	}
+	if cc.SharedMaxAge > 0 {
+		directives = append(directives, "s-maxage="+strconv.FormatInt(int64(cc.SharedMaxAge/time.Second), 10))
+	}
+	if cc.MustRevalidate {
+		directives = append(directives, "must-revalidate")
+	}
+	if cc.Immutable {
+		directives = append(directives, "immutable")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// SetCacheControl sets the Cache-Control header of the response to cc
+func (req *Request) SetCacheControl(cc CacheControl) {
+	req.ResponseHeaders.Set("Cache-Control", cc.String())
+}
+
+// ResponseCache holds rendered GET responses in memory, serving repeat requests without calling the handler.
+// Register both its Middleware and PostMiddleware, on the Server or on the routes to be cached.
+//
+// Responses are keyed by their URI and the Accept header their content type was negotiated from, plus the values of
+// any request headers named by their Vary header. Bodies are stored uncompressed, with the client's Accept-Encoding applied as each is served.
+// Only 200 responses are cached, and never those setting cookies or marked no-store or private.
+// Responses to requests with credentials (an Authorization header or a session cookie) are only cached, and such
+// requests only served from the cache, when marked public.
+// Any other request to a path (a POST, PUT, DELETE...) evicts the cached responses for it.
+//
+// A cached response is served by Middleware without running any middleware registered after it, so it must be
+// registered after any middleware authenticating (or otherwise rejecting) requests.
+type ResponseCache struct {
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string][]*cachedResponse
+	lru        *list.List
+	mu         *sync.Mutex
+}
+
+type cachedResponse struct {
+	key        string
+	path       string
+	vary       []string
+	varyValues []string
+	headers    http.Header
+	public     bool
+	body       []byte
+	expires    time.Time
+	elem       *list.Element
+}
+
+// NewResponseCache returns a ResponseCache holding each response for ttl.
+// Once it holds maxEntries responses, the least recently used is evicted to make room; 0 means no limit.
+func NewResponseCache(ttl time.Duration, maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string][]*cachedResponse),
+		lru:        list.New(),
+		mu:         new(sync.Mutex),
+	}
+}
+
+// Returns the key req's response is cached under. It's keyed on the Accept header rather than the negotiated content
+// type, as routes returning an interface negotiate again once the handler has returned its concrete response.
+func responseCacheKey(req *Request) string {
+	return fmt.Sprintf("%s\x00%s", req.req.URL.RequestURI(), strings.Join(req.Headers.Values("Accept"), ","))
+}
+
+// Whether req carries credentials, so its response may be meant for that client alone
+func hasCredentials(req *Request) bool {
+	_, hasSession := req.Cookie("session_token")
+	return req.Headers.Get("Authorization") != "" || hasSession
+}
+
+// Middleware serves GET requests from the cache, and evicts the path of any other request
+func (cache *ResponseCache) Middleware(req *Request) *Error {
+	if req.Verb != GET {
+		if req.Verb != HEAD && req.Verb != OPTIONS {
+			cache.Invalidate(req.Path)
+		}
+		return nil
+	}
+	key := responseCacheKey(req)
+
+	cache.mu.Lock()
+	entry := cache.lookup(key, req.Headers)
+	if entry != nil && !entry.public && hasCredentials(req) {
+		entry = nil
+	} else if entry != nil {
+		cache.lru.MoveToFront(entry.elem)
+	}
+	cache.mu.Unlock()
+	if entry == nil {
+		return nil
+	}
+
+	for name, values := range entry.headers {
+		req.ResponseHeaders[name] = append([]string(nil), values...)
+	}
+	req.cacheHit = true
+	req.written = true
+	if etagMatch(req.Headers.Get("If-None-Match"), entry.headers.Get("ETag")) {
+		req.ResponseCode = http.StatusNotModified
+		req.w.WriteHeader(req.ResponseCode)
+		return nil
+	}
+	req.ResponseCode = http.StatusOK
+	req.responseSize = uint(len(entry.body))
+	if err := writeWithContentEncoding(entry.body, req, req.w, req.ResponseCode); err != nil {
+		req.Log().Error(fmt.Errorf("Error writing cached response: %v", err))
+	}
+	return nil
+}
+
+// PostMiddleware stores cacheable responses once they've been written
+func (cache *ResponseCache) PostMiddleware(req *Request) {
+	if req.Verb != GET || req.cacheHit || req.ResponseCode != http.StatusOK || req.responseBody == nil {
+		return
+	}
+	if req.responseType == nil {
+		// The response wasn't negotiated (e.g. an event stream), so its content type isn't down to the Accept header
+		return
+	}
+	key := responseCacheKey(req)
+	if _, setsCookie := req.ResponseHeaders["Set-Cookie"]; setsCookie {
+		return
+	}
+	cacheControl := strings.ToLower(req.ResponseHeaders.Get("Cache-Control"))
+	if strings.Contains(cacheControl, "no-store") || strings.Contains(cacheControl, "private") {
+		return
+	}
+	public := strings.Contains(cacheControl, "public")
+	if !public && hasCredentials(req) {
+		return
+	}
+
+	var vary []string
+	for _, value := range req.ResponseHeaders.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			} else if name != "" && name != "Accept" && name != "Accept-Encoding" {
+				// The Accept header is already part of the key, and encoding is applied as each
+				// response is served, so neither need vary the entry
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	headers := req.ResponseHeaders.Clone()
+	headers.Del("Content-Encoding")
+	headers.Del("Content-Length")
+	entry := &cachedResponse{
+		key:        key,
+		path:       req.Path,
+		vary:       vary,
+		varyValues: varyValues(vary, req.Headers),
+		headers:    headers,
+		public:     public,
+		body:       bytes.Clone(req.responseBody),
+		expires:    time.Now().Add(cache.ttl),
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for _, variant := range append([]*cachedResponse(nil), cache.entries[key]...) {
+		// Replaces both the variant this response is for, and any which have expired
+		if time.Now().After(variant.expires) || variant.matches(req.Headers) {
+			cache.remove(variant)
+		}
+	}
+	for cache.maxEntries > 0 && cache.lru.Len() >= cache.maxEntries {
+		cache.remove(cache.lru.Back().Value.(*cachedResponse))
+	}
+	entry.elem = cache.lru.PushFront(entry)
+	cache.entries[key] = append(cache.entries[key], entry)
+}
+
+// Invalidate evicts every cached response for path, whatever its query string or content type
+func (cache *ResponseCache) Invalidate(path string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for elem := cache.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*cachedResponse); entry.path == path {
+			cache.remove(entry)
+		}
+		elem = next
+	}
+}
+
+// Returns the unexpired entry for key matching the Vary headers of a request with headers. Must hold cache.mu.
+func (cache *ResponseCache) lookup(key string, headers http.Header) *cachedResponse {
+	now := time.Now()
+	for _, entry := range cache.entries[key] {
+		if now.Before(entry.expires) && entry.matches(headers) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Reports whether a request with headers has the same values for the Vary headers as the one entry was cached for
+func (entry *cachedResponse) matches(headers http.Header) bool {
+	for idx, value := range varyValues(entry.vary, headers) {
+		if value != entry.varyValues[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// Must hold cache.mu
+func (cache *ResponseCache) remove(entry *cachedResponse) {
+	cache.lru.Remove(entry.elem)
+	variants := cache.entries[entry.key]
+	for idx, variant := range variants {
+		if variant == entry {
+			variants = append(variants[:idx], variants[idx+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(cache.entries, entry.key)
+	} else {
+		cache.entries[entry.key] = variants
+	}
+}
+
+func varyValues(vary []string, headers http.Header) []string {
+	values := make([]string, len(vary))
+	for idx, name := range vary {
+		values[idx] = strings.Join(headers.Values(name), ",")
+	}
+	return values
+}
@@ -1,7 +1,9 @@
 package webserver
 
 import (
+	"io"
 	"reflect"
+	"strings"
 )
 
 type Htmler interface {
@@ -14,11 +16,65 @@ type Jsoner interface {
 	AsJson() []byte
 }
 
+// Protobuffer is a response serialized as a protocol buffer message, e.g. with proto.Marshal.
+// It's matched by Accept headers asking for either application/x-protobuf or application/protobuf, and sent as the former.
+type Protobuffer interface {
+	AsProto() []byte
+}
+
+// MsgPacker is a response serialized as MessagePack, a compact binary alternative to JSON.
+// It's matched by Accept headers asking for either application/msgpack or application/x-msgpack, and sent as the former.
+type MsgPacker interface {
+	AsMsgPack() []byte
+}
+
+// NDJsoner is a response streamed as newline delimited JSON (application/x-ndjson): each value received from the
+// channel returned by AsNDJson is sent as a line of JSON as soon as it's ready, until the channel is closed.
+// Producers should stop sending once the request's Context is done, as the client has gone away.
+type NDJsoner interface {
+	AsNDJson() <-chan any
+}
+
 type EventStreamer interface {
-	AsEventStream() string
+	AsEventStream() []byte
 }
 
+// NoContent is the response type of routes which never respond with a body, such as DELETE endpoints.
+// It's sent as a 204 No Content, as is a nil response from a route whose response type is a pointer or interface.
+type NoContent struct{}
+
 var byteSlice = reflect.TypeOf([]byte{})
+var readerInterface = reflect.TypeOf((*io.Reader)(nil)).Elem()
+var errorPointer = reflect.TypeOf((*Error)(nil))
+var noContentType = reflect.TypeOf(NoContent{})
+var ndjsonerInterface = reflect.TypeOf((*NDJsoner)(nil)).Elem()
+
+// Reports whether a handler's response is to be sent as a 204 No Content
+func isNoContent(response any) bool {
+	if _, ok := response.(NoContent); ok {
+		return true
+	}
+	v := reflect.ValueOf(response)
+	return !v.IsValid() || (v.Kind() == reflect.Pointer && v.IsNil())
+}
+
+// Media types of the content types registered by name alone
+var builtinMediaTypes = map[string]string{
+	"html": "text/html",
+	"csv":  "text/csv",
+	"json": "application/json",
+}
+
+// Returns the media type a content type registered with RegisterContentTypeInterface is delivered as.
+// Content types registered by name alone (e.g. "xml") are assumed to be text.
+func mediaTypeOf(contentType string) string {
+	if strings.Contains(contentType, "/") {
+		return contentType
+	} else if mediaType, isset := builtinMediaTypes[contentType]; isset {
+		return mediaType
+	}
+	return "text/" + contentType
+}
 
 func deliverContentAsInterface[T any](content T, interfaceReflection reflect.Type) []byte {
 	value := reflect.ValueOf(content).Convert(interfaceReflection)
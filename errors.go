@@ -1,10 +1,16 @@
 package webserver
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Error Code is an http Status Code >= 400
@@ -13,6 +19,62 @@ import (
 type Error struct {
 	Code  uint
 	Error error
+	// Sent as a Retry-After header telling the client how long to wait before trying again, e.g. with a 429 or 503
+	RetryAfter time.Duration
+}
+
+// ValidationError maps each field of a request body which failed validation to a description of the failure.
+// Returned from a body's Validate method, it results in a 422 whose Error can be rendered with AsJson.
+// Failed `validate` struct tags on a JSON body are also reported as a ValidationError, but with a 400.
+type ValidationError map[string]string
+
+func (err ValidationError) Error() string {
+	fields := make([]string, 0, len(err))
+	for field := range err {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	msgs := make([]string, len(fields))
+	for idx, field := range fields {
+		msgs[idx] = field + ": " + err[field]
+	}
+	return "Validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (err ValidationError) AsJson() []byte {
+	b, _ := json.Marshal(map[string]map[string]string{
+		"errors": err,
+	})
+	return b
+}
+
+// ErrorReporter is notified of panics and 5xx responses, for forwarding on to a crash reporting service.
+// stack is the stack trace of the panicking goroutine, or nil when the error wasn't a panic.
+type ErrorReporter interface {
+	Report(req *Request, err error, stack []byte)
+}
+
+// abortSignal is panicked by Request.Abort, unwinding back to the dispatcher which responds with err
+type abortSignal struct {
+	err Error
+}
+
+// Abort immediately stops processing the request, responding with code through the error handler.
+// It may be called from anything a middleware or handler calls, so long as it's on the request's goroutine.
+func (req *Request) Abort(code uint) {
+	panic(abortSignal{err: Error{Code: code}})
+}
+
+// RetryAfter sets the Retry-After header of the response to d, rounded up to whole seconds.
+// For responses (usually a 429 or 503) telling the client when it may try again.
+func (req *Request) RetryAfter(d time.Duration) {
+	req.ResponseHeaders.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10))
+}
+
+// RetryAt sets the Retry-After header of the response to the HTTP-date t, e.g. the end of a scheduled maintenance window
+func (req *Request) RetryAt(t time.Time) {
+	req.ResponseHeaders.Set("Retry-After", t.UTC().Format(http.TimeFormat))
 }
 
 type errorHandler[S any] struct {
@@ -23,23 +85,35 @@ type errorHandler[S any] struct {
 }
 
 func (handler *errorHandler[S]) Apply(req *Request, err Error, w http.ResponseWriter) {
-	if handler != nil {
+	req.ResponseCode = int(err.Code)
+	req.responseErr = err.Error
+	if err.RetryAfter > 0 {
+		req.RetryAfter(err.RetryAfter)
+	}
+	if handler == nil {
+		// No error handler has been applied, so the status code is all there is to send
+		w.WriteHeader(req.ResponseCode)
+	} else {
 		var (
 			buf []byte
 		)
-		responseInterface := handler.server.determineResponseInterface(req.Headers.Get("Accept"), handler.implements)
+		responseInterface := handler.server.negotiate(req, handler.implements, "")
 		response := handler.fn.Call([]reflect.Value{
 			reflect.ValueOf(req),
 			reflect.ValueOf(err),
 		})[0].Interface()
 
 		if responseInterface != nil {
+			addVary(w.Header(), "Accept")
+			setContentType(w.Header(), handler.server.interfaceContentTypes, responseInterface)
 			buf = deliverContentAsInterface(response, responseInterface)
 		} else if handler.isReader {
-			var e error
 			rdr := response.(io.Reader)
+			pooled := getBuffer()
+			defer putBuffer(pooled)
 
-			buf, e = io.ReadAll(rdr)
+			_, e := pooled.ReadFrom(rdr)
+			buf = pooled.Bytes()
 			if e != nil {
 				// well, this is awkward...
 				w.WriteHeader(http.StatusInternalServerError)
@@ -47,11 +121,11 @@ func (handler *errorHandler[S]) Apply(req *Request, err Error, w http.ResponseWr
 			}
 		}
 		req.responseSize = uint(len(buf))
-		e := writeWithContentEncoding(buf, req.Headers.Get("Accept-Encoding"), w, int(err.Code))
+		e := writeWithContentEncoding(buf, req, w, int(err.Code))
 		if e != nil {
 			handler.server.Logger.LogError(req, fmt.Errorf("Error writing response content: %v", e))
 		}
-		handler.server.Logger.LogRequest(req)
+		handler.server.logRequest(req)
 
 	}
 }
@@ -71,6 +145,7 @@ func ApplyErrorHandler[T any, S any](s *Server[S], fn func(req *Request, code Er
 	// determine what content types T delivers as
 	responseType := reflect.TypeOf(new(T)).Elem()
 	for t, i := range s.contentTypeInterfaces {
-		s.errorHandler.implements[t] = responseType.Implements(i)
+		// Error responses are always delivered whole, never streamed
+		s.errorHandler.implements[t] = responseType.Implements(i) && i != ndjsonerInterface
 	}
 }
@@ -0,0 +1,35 @@
+package webserver
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strings"
+)
+
+// Returns a strong ETag for content
+func contentETag(content []byte) string {
+	return fmt.Sprintf(`"%x"`, md5.Sum(content))
+}
+
+// Returns etag marked as weak, if weak is set
+func weakenETag(etag string, weak bool) string {
+	if weak && !strings.HasPrefix(etag, "W/") {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// Reports whether an If-None-Match header matches etag. Per RFC 9110 the comparison is weak, so W/ prefixes are ignored.
+func etagMatch(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
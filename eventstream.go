@@ -0,0 +1,146 @@
+package webserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An EventStreamer may optionally implement any of the following to populate the id, event and retry fields of the event
+type EventStreamIDer interface {
+	EventID() string
+}
+type EventStreamNamer interface {
+	EventName() string
+}
+type EventStreamRetrier interface {
+	EventRetry() time.Duration
+}
+
+// Event is a ready-made EventStreamer for handlers which don't need their own type.
+// Empty fields are omitted from the stream.
+type Event struct {
+	ID    string
+	Name  string
+	Data  string
+	Retry time.Duration
+}
+
+func (evt Event) AsEventStream() []byte     { return []byte(evt.Data) }
+func (evt Event) EventID() string           { return evt.ID }
+func (evt Event) EventName() string         { return evt.Name }
+func (evt Event) EventRetry() time.Duration { return evt.Retry }
+
+// LastEventID returns the id of the last event received by a reconnecting client, or an empty string for a new stream.
+func (req *Request) LastEventID() string {
+	return req.Headers.Get("Last-Event-ID")
+}
+
+var eventStreamMessagePrefix = []byte("data: ")
+
+func writeEvent(w io.Writer, evt EventStreamer) error {
+	var buf bytes.Buffer
+	if ider, ok := evt.(EventStreamIDer); ok {
+		if id := stripLineBreaks(ider.EventID()); id > "" {
+			buf.WriteString("id: " + id + "\n")
+		}
+	}
+	if namer, ok := evt.(EventStreamNamer); ok {
+		if name := stripLineBreaks(namer.EventName()); name > "" {
+			buf.WriteString("event: " + name + "\n")
+		}
+	}
+	if retrier, ok := evt.(EventStreamRetrier); ok {
+		if retry := retrier.EventRetry(); retry > 0 {
+			buf.WriteString("retry: " + strconv.FormatInt(retry.Milliseconds(), 10) + "\n")
+		}
+	}
+
+	// Each line of the data needs its own data field, or the client will cut the event short.
+	// Clients end lines at a CR too, so those are normalized first.
+	data := bytes.ReplaceAll(evt.AsEventStream(), []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.Write(eventStreamMessagePrefix)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Removes any CR or LF from a single line field, which would otherwise end it early and inject whatever followed as
+// further fields or events
+func stripLineBreaks(field string) string {
+	return lineBreakStripper.Replace(field)
+}
+
+var lineBreakStripper = strings.NewReplacer("\r", "", "\n", "")
+
+var eventStreamHeartbeat = []byte(": keepalive\n\n")
+
+func (s *Server[S]) serveEventStream(req *Request, w http.ResponseWriter, handler EventStreamHandler) {
+	// Events are written straight to w as they happen, never through a compressor which would hold them back
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	if s.EventStreamRetry > 0 {
+		if _, err := fmt.Fprintf(w, "retry: %d\n\n", s.EventStreamRetry.Milliseconds()); err != nil {
+			s.Logger.LogError(req, fmt.Errorf("Error sending event: %v", err))
+			return
+		}
+		w.(http.Flusher).Flush()
+	}
+
+	events := handler(req)
+	defer func() {
+		// Should we stop early, keep the handler from blocking on a send nobody will receive
+		go func() {
+			for range events {
+			}
+		}()
+	}()
+
+	// Idle streams are liable to be cut off by proxies, so comment lines are sent in the absence of events
+	var (
+		ticker    *time.Ticker
+		heartbeat <-chan time.Time
+	)
+	if s.EventStreamHeartbeat > 0 {
+		ticker = time.NewTicker(s.EventStreamHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, evt)
+			if ticker != nil {
+				ticker.Reset(s.EventStreamHeartbeat)
+			}
+		case <-heartbeat:
+			_, err = w.Write(eventStreamHeartbeat)
+		case <-req.Context.Done():
+			return
+		}
+
+		if err != nil {
+			s.Logger.LogError(req, fmt.Errorf("Error sending event: %v", err))
+			return
+		}
+
+		w.(http.Flusher).Flush()
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 	"time"
@@ -74,23 +75,19 @@ func (page *HomePage) AsJson() []byte {
 	return b
 }
 
-func (page *HomePage) Anything() []byte {
-	return []byte(fmt.Sprintf("%v", *page))
-}
-
 // Body which could be used to override Site-Wide PageView count
 type FooBody struct {
 	SiteTotal uint
 }
 
-func (body *FooBody) ParsePlainText(rdr io.Reader) error {
+func (body *FooBody) ParsePlainText(rdr io.Reader) *webserver.Error {
 	data, err := io.ReadAll(rdr)
 	if err != nil {
-		return err
+		return &webserver.Error{Code: http.StatusBadRequest, Error: err}
 	}
 	override, err := strconv.ParseUint(string(data), 10, 64)
 	if err != nil {
-		return err
+		return &webserver.Error{Code: http.StatusBadRequest, Error: err}
 	}
 	body.SiteTotal = uint(override)
 	return nil
@@ -110,9 +107,6 @@ func (pv *PageViews) XML() []byte {
 	return []byte(fmt.Sprintf(`<Views><Total>%d</Total><Session>%d</Session></Views>`, pv.Total, pv.Session))
 }
 
-type Anythinger interface {
-	Anything() []byte
-}
 type XMLer interface {
 	XML() []byte
 }
@@ -127,7 +121,12 @@ func (count Countdown) AsHtml() []byte {
 	return injectContentToMainTemplate("countdown", count)
 }
 
-func (count Countdown) AsEventStream() string {
+func (count Countdown) AsEventStream() []byte {
+	return []byte(fmt.Sprintf("%d", count))
+}
+
+// Using the count as the event ID lets a reconnecting client pick up where it left off
+func (count Countdown) EventID() string {
 	return fmt.Sprintf("%d", count)
 }
 
@@ -141,6 +140,23 @@ type Upload struct {
 	FileSize int64
 }
 
+// UploadBody streams the uploaded file as it arrives, rather than buffering the whole form first
+type UploadBody struct {
+	FileSize int64
+}
+
+func (body *UploadBody) ParseMultipartPart(part *multipart.Part) *webserver.Error {
+	if part.FormName() != "some-file" {
+		return nil
+	}
+	size, err := io.Copy(io.Discard, part)
+	if err != nil {
+		return &webserver.Error{Code: http.StatusBadRequest, Error: err}
+	}
+	body.FileSize += size
+	return nil
+}
+
 func (upload *Upload) AsHtml() []byte {
 	return injectContentToMainTemplate("upload", upload)
 }
@@ -184,8 +200,6 @@ func main() {
 
 	// Tell the webserver how to handle xml content type
 	ws.RegisterContentTypeInterface("xml", (*XMLer)(nil))
-	// Tell the webserver how to handle */* content type
-	ws.RegisterContentTypeInterface("*/*", (*Anythinger)(nil))
 
 	webserver.ApplyErrorHandler(ws, func(req *webserver.Request, code webserver.Error) *ErrorResponse {
 		c := ErrorResponse(code.Code)
@@ -255,6 +269,10 @@ func main() {
 	// Our SSE will stream a countdown from 20 to 0.
 	countdown.EventStream(func(req *webserver.Request) <-chan webserver.EventStreamer {
 		count := Countdown(20)
+		if lastCount, err := strconv.ParseUint(req.LastEventID(), 10, 64); err == nil && lastCount > 0 && lastCount <= 20 {
+			// The client is reconnecting - resume the countdown after the last event it received
+			count = Countdown(lastCount - 1)
+		}
 		ch := make(chan webserver.EventStreamer)
 		go func() {
 			defer close(ch)
@@ -291,18 +309,13 @@ func main() {
 		return messages
 	})
 
-	webserver.ApplyRoute(ws, "/upload", webserver.RequestBody{}, map[webserver.Verb]func(req *webserver.Request) (*Upload, *webserver.Error){
+	webserver.ApplyRoute(ws, "/upload", UploadBody{}, map[webserver.Verb]func(req *webserver.Request) (*Upload, *webserver.Error){
 		webserver.POST: func(req *webserver.Request) (*Upload, *webserver.Error) {
 			// A file was uploaded!
-			requestBody := req.Body.(webserver.RequestBody)
-			uploaded := requestBody.Files["some-file"]
-			size, err := io.Copy(io.Discard, uploaded[0])
-			if err != nil {
-				ws.Logger.LogError(req, err)
-			}
+			requestBody := req.Body.(UploadBody)
 
 			return &Upload{
-				FileSize: size,
+				FileSize: requestBody.FileSize,
 			}, nil
 		},
 		webserver.GET: func(req *webserver.Request) (*Upload, *webserver.Error) {
@@ -0,0 +1,113 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// responseWriter records the status and size of a response written directly, rather than from a handler's return value
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Marks the request as responded to, recording the response written to w
+func (req *Request) responded(w *responseWriter) {
+	req.ResponseCode = w.status
+	req.responseSize = uint(w.size)
+	req.written = true
+}
+
+// ServeFile responds with the file at path, streaming it from disk rather than buffering it.
+// Range and conditional (If-None-Match, If-Modified-Since) requests are honored, with the ETag derived from the
+// file's size and modification time. The session is saved before the file is sent. Once ServeFile succeeds the
+// response has been sent, and whatever the handler returns is discarded.
+func (req *Request) ServeFile(path string) *Error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Error{Code: http.StatusNotFound, Error: err}
+	} else if err != nil {
+		return &Error{Code: http.StatusInternalServerError, Error: err}
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return &Error{Code: http.StatusInternalServerError, Error: err}
+	}
+	if info.IsDir() {
+		return &Error{Code: http.StatusNotFound, Error: fmt.Errorf("%s is a directory", path)}
+	}
+
+	if err := req.saveSessionEarly(); err != nil {
+		return &Error{Code: http.StatusConflict, Error: err}
+	}
+	req.ResponseHeaders.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	w := &responseWriter{ResponseWriter: req.w}
+	http.ServeContent(w, req.req, filepath.Base(path), info.ModTime(), f)
+	req.responded(w)
+	return nil
+}
+
+// Attachment marks the response as a download to be saved as filename, rather than displayed by the browser.
+// Names which aren't plain ASCII are sent RFC 5987 encoded, alongside an ASCII fallback for older clients.
+func (req *Request) Attachment(filename string) {
+	req.ResponseHeaders.Set("Content-Disposition", contentDisposition("attachment", filename))
+}
+
+func contentDisposition(disposition string, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	fallback := strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	header := fmt.Sprintf(`%s; filename="%s"`, disposition, fallback)
+	if fallback != filename {
+		header += "; filename*=UTF-8''" + rfc5987Escape(filename)
+	}
+	return header
+}
+
+// Percent encodes every byte of s which isn't an attr-char, as defined by RFC 5987
+func rfc5987Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -1,15 +1,25 @@
 module github.com/4thPlanet/webserver
 
-go 1.20
+go 1.21
 
 require (
 	github.com/andybalholm/brotli v1.1.0
 	github.com/gobwas/ws v1.3.2
 	github.com/klauspost/compress v1.17.7
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	golang.org/x/crypto v0.25.0
+	golang.org/x/text v0.16.0
 )
 
 require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
 )
@@ -0,0 +1,105 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// HealthCheck reports on a dependency of the server (a database, a downstream API...), returning an error if it's unhealthy
+type HealthCheck func(ctx context.Context) error
+
+// HealthReport is the response of health and readiness routes
+type HealthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (report HealthReport) AsJson() []byte {
+	b, _ := json.Marshal(report)
+	return b
+}
+
+// HealthRoute registers a liveness endpoint at path. It responds 200 when every check passes, and 503 otherwise,
+// with the result of each check in the body.
+func (s *Server[S]) HealthRoute(path string, checks map[string]HealthCheck) *Route[RequestBody, HealthReport] {
+	return s.healthRoute(path, checks, func() bool { return true })
+}
+
+// ReadinessRoute registers a readiness endpoint at path. Like HealthRoute it runs checks, but additionally reports
+// the server as not ready until it is listening, once it begins shutting down, and whenever SetReady(false) is in effect.
+func (s *Server[S]) ReadinessRoute(path string, checks map[string]HealthCheck) *Route[RequestBody, HealthReport] {
+	return s.healthRoute(path, checks, s.Ready)
+}
+
+// SetReady marks the server as (not) ready to receive traffic, e.g. while caches are warmed at startup
+func (s *Server[S]) SetReady(ready bool) {
+	s.notReady.Store(!ready)
+}
+
+// Ready reports whether the server is listening, not shutting down and not marked otherwise by SetReady
+func (s *Server[S]) Ready() bool {
+	s.listenersMu.Lock()
+	listening := len(s.listeners) > 0
+	s.listenersMu.Unlock()
+	return listening && !s.notReady.Load()
+}
+
+func (s *Server[S]) healthRoute(path string, checks map[string]HealthCheck, ready func() bool) *Route[RequestBody, HealthReport] {
+	handler := func(req *Request) (HealthReport, *Error) {
+		report := runHealthChecks(req.Context, checks)
+		if !ready() {
+			report.Status = "not ready"
+		}
+		if report.Status != "ok" {
+			req.ResponseCode = http.StatusServiceUnavailable
+		}
+		req.ResponseHeaders.Set("Cache-Control", "no-store")
+		return report, nil
+	}
+	return ApplyRoute(s, path, RequestBody{}, map[Verb]func(req *Request) (HealthReport, *Error){
+		GET:  handler,
+		HEAD: handler,
+	})
+}
+
+// Runs each check concurrently
+func runHealthChecks(ctx context.Context, checks map[string]HealthCheck) HealthReport {
+	report := HealthReport{Status: "ok"}
+	if len(checks) == 0 {
+		return report
+	}
+
+	report.Checks = make(map[string]string, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheck) {
+			defer wg.Done()
+			err := runHealthCheck(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = "ok"
+			if err != nil {
+				report.Checks[name] = err.Error()
+				report.Status = "unavailable"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+// Runs check, reporting a panic as its failure
+func runHealthCheck(ctx context.Context, check HealthCheck) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return check(ctx)
+}
@@ -0,0 +1,40 @@
+package webserver
+
+import (
+	"context"
+	"time"
+)
+
+// semaphore bounds how many holders may proceed at once
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	return make(semaphore, size)
+}
+
+// Waits up to wait for a free slot (or until ctx is done), returning whether one was acquired
+func (sem semaphore) acquire(ctx context.Context, wait time.Duration) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (sem semaphore) release() {
+	<-sem
+}
@@ -0,0 +1,111 @@
+package webserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Listener is one address the server is accepting connections on.
+// A server may have any number of them (e.g. plain HTTP for internal health checks alongside public HTTPS),
+// all sharing the same routes.
+type Listener struct {
+	Host string
+	Port uint
+
+	server *http.Server
+	done   chan struct{}
+	err    error
+}
+
+// Wait blocks until the listener stops, returning the error it stopped with.
+// Stopping due to Shutdown isn't an error.
+func (l *Listener) Wait() error {
+	<-l.done
+	return l.err
+}
+
+// Listen starts accepting connections on addr, over TLS when secureConfig is non-nil.
+func (s *Server[S]) Listen(addr string, secureConfig *tls.Config) (*Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if secureConfig != nil {
+		l = tls.NewListener(l, secureConfig)
+	}
+	return s.serve(l, s), nil
+}
+
+// Serves handler on l until it fails or the server is shut down
+func (s *Server[S]) serve(l net.Listener, handler http.Handler) *Listener {
+	listener := &Listener{
+		server: &http.Server{
+			Handler: handler,
+		},
+		done: make(chan struct{}),
+	}
+	if s.BaseContext != nil {
+		listener.server.BaseContext = func(net.Listener) context.Context {
+			return s.BaseContext
+		}
+	}
+	listener.server.SetKeepAlivesEnabled(!s.CloseConnections)
+	listener.Host, listener.Port = listenerAddr(l)
+
+	s.listenersMu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.listenersMu.Unlock()
+
+	go func() {
+		defer close(listener.done)
+		defer l.Close()
+		if err := listener.server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			listener.err = err
+		}
+	}()
+	return listener
+}
+
+// Shutdown gracefully stops every listener: each stops accepting new connections, then waits for requests in
+// progress to finish, or for ctx to be done. Websocket and event stream connections aren't waited on, but may be
+// closed by cancelling the server's BaseContext.
+func (s *Server[S]) Shutdown(ctx context.Context) error {
+	s.listenersMu.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.listenersMu.Unlock()
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for idx, listener := range listeners {
+		wg.Add(1)
+		go func(idx int, listener *Listener) {
+			defer wg.Done()
+			errs[idx] = listener.server.Shutdown(ctx)
+		}(idx, listener)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Returns the host and port l is listening on
+func listenerAddr(l net.Listener) (string, uint) {
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		return addr.IP.String(), uint(addr.Port)
+	}
+
+	host, portStr, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return l.Addr().String(), 0
+	}
+	port, err := net.LookupPort(l.Addr().Network(), portStr)
+	if err != nil {
+		return host, 0
+	}
+	return host, uint(port)
+}
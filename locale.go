@@ -0,0 +1,46 @@
+package webserver
+
+import (
+	"fmt"
+
+	"golang.org/x/text/language"
+)
+
+// locales are the languages a server's content is available in
+type locales struct {
+	names   []string
+	matcher language.Matcher
+}
+
+// Locales sets the locales (BCP 47 tags, e.g. "en-US") the server's content is available in, which each request's
+// Accept-Language header is matched against. The first is the default, used when nothing else matches.
+// Returns an error, leaving the server's locales unchanged, if any isn't a valid tag.
+func (s *Server[S]) Locales(defaultLocale string, supported ...string) error {
+	names := append([]string{defaultLocale}, supported...)
+	tags := make([]language.Tag, len(names))
+	for idx, name := range names {
+		tag, err := language.Parse(name)
+		if err != nil {
+			return fmt.Errorf("Invalid locale [%s]: %w", name, err)
+		}
+		tags[idx] = tag
+	}
+	s.locales = &locales{names: names, matcher: language.NewMatcher(tags)}
+	return nil
+}
+
+// Locale returns whichever of the server's Locales best matches the request's Accept-Language header,
+// or "" if the server hasn't any. The response is marked as varying by Accept-Language.
+func (req *Request) Locale() string {
+	if req.locales == nil {
+		return ""
+	}
+	if req.locale == "" {
+		// Unparseable headers are no different to none at all, so the default is matched
+		tags, _, _ := language.ParseAcceptLanguage(req.Headers.Get("Accept-Language"))
+		_, idx, _ := req.locales.matcher.Match(tags...)
+		req.locale = req.locales.names[idx]
+	}
+	addVary(req.ResponseHeaders, "Accept-Language")
+	return req.locale
+}
@@ -3,6 +3,7 @@ package webserver
 import (
 	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -13,22 +14,71 @@ type Logger interface {
 	LogError(req *Request, err error)
 }
 
+// RequestLogger logs through the server's Logger on behalf of a single request
+type RequestLogger struct {
+	req *Request
+}
+
+// Log returns a logger for the request. Fields attached with With are carried by every subsequent log line for the request.
+func (req *Request) Log() *RequestLogger {
+	return &RequestLogger{req: req}
+}
+
+// With attaches a key/value pair to the request, returning the same logger for chaining.
+func (logger *RequestLogger) With(key string, value any) *RequestLogger {
+	logger.req.logFields = append(logger.req.logFields, key, value)
+	return logger
+}
+
+func (logger *RequestLogger) Message(msg any) {
+	logger.logger().LogMessage(logger.req, msg)
+}
+
+func (logger *RequestLogger) Error(err error) {
+	logger.logger().LogError(logger.req, err)
+}
+
+func (logger *RequestLogger) logger() Logger {
+	if logger.req.logger == nil {
+		return DefaultLogger
+	}
+	return logger.req.logger
+}
+
+// LogFields returns the key/value pairs attached to the request via Log().With, in the order they were attached.
+func (req *Request) LogFields() []any {
+	return req.logFields
+}
+
+// Formats the request's log fields as " key=value" pairs
+func formatLogFields(req *Request) string {
+	var b strings.Builder
+	for idx := 0; idx+1 < len(req.logFields); idx += 2 {
+		fmt.Fprintf(&b, " %v=%v", req.logFields[idx], req.logFields[idx+1])
+	}
+	return b.String()
+}
+
 type defaultLogger byte
 
 var DefaultLogger defaultLogger
 
 // Default Logger behavior is to use log.Print and fmt.Print* commands
 func (logger defaultLogger) LogRequest(req *Request) {
-	fmt.Printf("%v %s %s %v %d %d %s\n", time.Now().Format(time.RFC3339), req.Verb, req.Path, req.BodySize(), req.ResponseCode, req.responseSize, time.Since(req.Start()))
+	var cause string
+	if err := req.ResponseError(); err != nil {
+		cause = fmt.Sprintf(" (%v)", err)
+	}
+	fmt.Printf("%v %s %s %v %d %d %s%s%s\n", time.Now().Format(time.RFC3339), req.method(), req.Path, req.BodySize(), req.ResponseCode, req.responseSize, time.Since(req.Start()), cause, formatLogFields(req))
 }
 func (logger defaultLogger) LogMessage(req *Request, msg any) {
-	fmt.Printf("%v %s %s %v\n", time.Now().Format(time.RFC3339), req.Verb, req.Path, msg)
+	fmt.Printf("%v %s %s %v%s\n", time.Now().Format(time.RFC3339), req.method(), req.Path, msg, formatLogFields(req))
 }
 
 func (logger defaultLogger) LogPanic(req *Request, p any) {
-	log.Printf("panic() processing %s %s: %v", req.Verb, req.Path, p)
+	log.Printf("panic() processing %s %s: %v%s", req.method(), req.Path, p, formatLogFields(req))
 }
 
 func (logger defaultLogger) LogError(req *Request, err error) {
-	log.Printf("%s %s: %v", req.Verb, req.Path, err)
+	log.Printf("%s %s: %v%s", req.method(), req.Path, err, formatLogFields(req))
 }
@@ -0,0 +1,87 @@
+package webserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maintenanceMode holds whether the server is in maintenance mode, and which requests are exempt from it
+type maintenanceMode struct {
+	enabled atomic.Bool
+	mu      sync.RWMutex
+	paths   []string
+	ips     []netip.Prefix
+}
+
+// SetMaintenance switches maintenance mode on or off. While on, every request not exempted by MaintenanceBypass
+// is answered with a 503 from the error handler before reaching any route. Safe to call at any time.
+func (s *Server[S]) SetMaintenance(enabled bool) {
+	s.maintenance.enabled.Store(enabled)
+}
+
+// Maintenance reports whether the server is in maintenance mode
+func (s *Server[S]) Maintenance() bool {
+	return s.maintenance.enabled.Load()
+}
+
+// MaintenanceBypass sets which requests are still served in maintenance mode: those to any of paths (or beneath one,
+// for paths ending in "/"), such as health checks, and those from clients whose IP matches one of ips, given as
+// addresses or CIDR ranges (e.g. "10.0.0.0/8"). Replaces any previous bypass.
+func (s *Server[S]) MaintenanceBypass(paths []string, ips []string) error {
+	prefixes := make([]netip.Prefix, len(ips))
+	for idx, ip := range ips {
+		var err error
+		if strings.Contains(ip, "/") {
+			prefixes[idx], err = netip.ParsePrefix(ip)
+		} else if addr, addrErr := netip.ParseAddr(ip); addrErr == nil {
+			prefixes[idx] = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		} else {
+			err = addrErr
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid maintenance bypass IP [%s]: %v", ip, err)
+		}
+	}
+
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	s.maintenance.paths = paths
+	s.maintenance.ips = prefixes
+	return nil
+}
+
+// Whether r is to be turned away due to maintenance mode
+func (s *Server[S]) inMaintenance(r *http.Request) bool {
+	if !s.maintenance.enabled.Load() {
+		return false
+	}
+
+	s.maintenance.mu.RLock()
+	defer s.maintenance.mu.RUnlock()
+	for _, path := range s.maintenance.paths {
+		if r.URL.Path == path || (strings.HasSuffix(path, "/") && strings.HasPrefix(r.URL.Path, path)) {
+			return false
+		}
+	}
+	if len(s.maintenance.ips) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return true
+		}
+		for _, prefix := range s.maintenance.ips {
+			if prefix.Contains(addr.Unmap()) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -16,19 +16,39 @@ type MultipartFormDataParser interface {
 	ParseMultipartFormData(io.Reader, string) *Error
 }
 
+// MultipartPartParser is an alternative to MultipartFormDataParser which receives each part of the form as it's
+// read off the connection, rather than once the whole form has been buffered. Large uploads can then be copied
+// straight to their destination. Any of the part not read by ParseMultipartPart is discarded.
+type MultipartPartParser interface {
+	ParseMultipartPart(part *multipart.Part) *Error
+}
+
 type PlainTextParser interface {
 	ParsePlainText(io.Reader) *Error
 }
 
+// Validator is implemented by request bodies which check their own contents once parsed.
+// It runs after any `validate` struct tags on a JSON body have passed (see validateTags).
+// Returning a ValidationError responds with a 422, any other error with a 400.
+type Validator interface {
+	Validate() error
+}
+
+// RawBody is a body type which skips parsing entirely, leaving the request body to be streamed from
+// Request.BodyReader, e.g. to process newline delimited JSON a line at a time.
+type RawBody struct{}
+
 type RequestBody struct {
 	url.Values
 	Files map[string][]multipart.File
+	// Holds any temporary files the upload was spooled to
+	form *multipart.Form
 }
 
 func (body *RequestBody) ParseFormData(rdr io.Reader) *Error {
 	data, err := io.ReadAll(rdr)
 	if err != nil {
-		return &Error{Code: http.StatusInternalServerError, Error: err}
+		return bodyReadError(err)
 	}
 
 	values, err := url.ParseQuery(string(data))
@@ -44,13 +64,9 @@ func (body *RequestBody) ParseMultipartFormData(rdr io.Reader, boundary string)
 	mpr := multipart.NewReader(rdr, boundary)
 	form, err := mpr.ReadForm(1024 * 1024 * 10)
 	if err != nil {
-		var maxBytesErr *http.MaxBytesError
-		if errors.As(err, &maxBytesErr) {
-			return &Error{Code: http.StatusRequestEntityTooLarge, Error: err}
-		} else {
-			return &Error{Code: http.StatusBadRequest, Error: err}
-		}
+		return bodyReadError(err)
 	}
+	body.form = form
 	body.Values = form.Value
 	body.Files = make(map[string][]multipart.File)
 	for key, headers := range form.File {
@@ -58,12 +74,53 @@ func (body *RequestBody) ParseMultipartFormData(rdr io.Reader, boundary string)
 		for fdx, header := range headers {
 			file, err := header.Open()
 			if err != nil {
+				// The server only closes bodies which parsed successfully
+				body.Close()
 				return &Error{Code: http.StatusInternalServerError, Error: err}
 			}
 
-			// This will need to be closed after being read.
+			// Closed by Close once the request is done
 			body.Files[key][fdx] = file
 		}
 	}
 	return nil
 }
+
+func parseMultipartParts(rdr io.Reader, boundary string, parser MultipartPartParser) *Error {
+	mpr := multipart.NewReader(rdr, boundary)
+	for {
+		part, err := mpr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return bodyReadError(err)
+		}
+
+		parseErr := parser.ParseMultipartPart(part)
+		part.Close()
+		if parseErr != nil {
+			return parseErr
+		}
+	}
+}
+
+// Close closes the uploaded files, removing any temporary files they were spooled to.
+// The server calls this once the request is done.
+func (body *RequestBody) Close() error {
+	var errs []error
+	for _, files := range body.Files {
+		for _, file := range files {
+			if file == nil {
+				continue
+			} else if err := file.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if body.form != nil {
+		if err := body.form.RemoveAll(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package webserver
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/gzip"
+)
+
+// Buffers grown beyond this are left for the garbage collector, rather than pinning their memory in the pool
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// Returns buf to the pool. Nothing may hold on to its contents afterwards.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() any {
+			return gzip.NewWriter(nil)
+		},
+	}
+	flateWriterPool = sync.Pool{
+		New: func() any {
+			encoder, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return encoder
+		},
+	}
+	brotliWriterPool = sync.Pool{
+		New: func() any {
+			return brotli.NewWriter(nil)
+		},
+	}
+)
+
+// Returns a compressor for encoding writing to w, along with a function to close it and return it to its pool.
+// ok is false for encodings which aren't supported.
+func getEncoder(encoding string, w io.Writer) (encoder io.Writer, release func() error, ok bool) {
+	switch encoding {
+	case "gzip":
+		gz := gzipWriterPool.Get().(*gzip.Writer)
+		gz.Reset(w)
+		return gz, func() error {
+			defer gzipWriterPool.Put(gz)
+			return gz.Close()
+		}, true
+	case "deflate":
+		fl := flateWriterPool.Get().(*flate.Writer)
+		fl.Reset(w)
+		return fl, func() error {
+			defer flateWriterPool.Put(fl)
+			return fl.Close()
+		}, true
+	case "br":
+		br := brotliWriterPool.Get().(*brotli.Writer)
+		br.Reset(w)
+		return br, func() error {
+			defer brotliWriterPool.Put(br)
+			return br.Close()
+		}, true
+	}
+	return nil, nil, false
+}
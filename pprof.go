@@ -0,0 +1,65 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// Pprof serves the net/http/pprof profiling handlers under prefix (e.g. "/debug/pprof/").
+// Profiles expose the internals of the server, so middlewares should be given to guard them (e.g. with authentication).
+// They run after the server's own middlewares; any middleware returning an Error or responding itself stops the
+// request before a profile is served.
+func (s *Server[S]) Pprof(prefix string, middlewares ...Middleware) {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	s.mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		req := newRequest(w, r)
+		req.logger = s.Logger
+		req.locales = s.locales
+		req.routePattern = prefix
+		req.Verb, _ = ParseVerb(r.Method)
+		defer s.startSpan(req, req.routePattern)()
+		defer func() {
+			s.runPostMiddlewares(req, nil)
+			req.runCleanups()
+		}()
+		defer s.recoverRequest(req, w)
+
+		session := s.newSession(req)
+		if err := session.load(req.Context); err != nil {
+			s.Logger.LogError(req, fmt.Errorf("Error loading session: %v", err))
+		}
+		// Profiles never change the session
+		session.release()
+		req.Session = session.Data
+
+		// The server's middlewares first, as for any other route
+		for _, mw := range append(append([]Middleware(nil), s.middlewares...), middlewares...) {
+			if err := mw(req); err != nil {
+				s.applyError(req, *err, w)
+				return
+			} else if req.written {
+				return
+			}
+		}
+
+		rw := &responseWriter{ResponseWriter: w}
+		switch name := strings.TrimPrefix(r.URL.Path, prefix); name {
+		case "":
+			pprof.Index(rw, req.req)
+		case "cmdline":
+			pprof.Cmdline(rw, req.req)
+		case "profile":
+			pprof.Profile(rw, req.req)
+		case "symbol":
+			pprof.Symbol(rw, req.req)
+		case "trace":
+			pprof.Trace(rw, req.req)
+		default:
+			pprof.Handler(name).ServeHTTP(rw, req.req)
+		}
+		req.responded(rw)
+		s.logRequest(req)
+	})
+}
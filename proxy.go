@@ -0,0 +1,64 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// Context key under which a proxied request records why the upstream couldn't be reached
+type proxyErrorKey struct{}
+
+// ReverseProxy forwards requests under path to target (e.g. http://backend:9000), joining target's path with the
+// request's. The request's context is passed on, so the upstream request is cancelled along with it.
+// Requests pass through the server's and route's middlewares (authentication, rate limiting...) before being forwarded,
+// with their bodies streamed to target unparsed - though still subject to the server's MaxPostSize or the route's MaxBodySize.
+// An unreachable upstream responds with a 502 Bad Gateway.
+func (s *Server[S]) ReverseProxy(path string, target *url.URL) *Route[RawBody, *bytes.Buffer] {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if proxyErr, ok := r.Context().Value(proxyErrorKey{}).(*error); ok {
+				*proxyErr = err
+			}
+		},
+	}
+
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		var proxyErr error
+		r := req.req.WithContext(context.WithValue(req.Context, proxyErrorKey{}, &proxyErr))
+		w := &responseWriter{ResponseWriter: req.w}
+		proxy.ServeHTTP(w, r)
+		if proxyErr != nil && w.status == 0 {
+			return nil, &Error{Code: http.StatusBadGateway, Error: proxyErr}
+		}
+		req.responded(w)
+		return nil, nil
+	}
+	// The body is left untouched for the proxy to stream, only counting its size as it goes
+	passBody := func(req *Request) *Error {
+		req.bodySizer = new(bodySizeReader)
+		req.req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(req.req.Body, req.bodySizer), req.req.Body}
+		return nil
+	}
+
+	verbs := []Verb{GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS}
+	handlers := make(map[Verb]func(req *Request) (*bytes.Buffer, *Error), len(verbs))
+	verbBodies := make(map[Verb]func(req *Request) *Error, len(verbs))
+	for _, verb := range verbs {
+		handlers[verb] = handler
+		verbBodies[verb] = passBody
+	}
+	route := ApplyRoute(s, path, RawBody{}, handlers)
+	route.verbBodies = verbBodies
+	return route
+}
@@ -0,0 +1,97 @@
+package webserver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimitStore tracks how many requests each client has made.
+// Implementations backed by a shared store (such as Redis) allow limits to hold across multiple server instances.
+type RateLimitStore interface {
+	// Take consumes one of key's limit requests per window, returning whether the request is allowed
+	// and, if not, how long until it would be.
+	Take(key string, limit uint, window time.Duration) (bool, time.Duration, error)
+}
+
+// InMemoryRateLimitStore is a token bucket per client, refilling at a rate of limit tokens per window
+type InMemoryRateLimitStore struct {
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mu        *sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewInMemoryRateLimitStore() *InMemoryRateLimitStore {
+	return &InMemoryRateLimitStore{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		mu:        new(sync.Mutex),
+	}
+}
+
+func (store *InMemoryRateLimitStore) Take(key string, limit uint, window time.Duration) (bool, time.Duration, error) {
+	if limit == 0 || window <= 0 {
+		// No rate to refill at, so no telling when a request would be allowed
+		return false, 0, fmt.Errorf("Invalid rate limit of %d per %v", limit, window)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(limit) / float64(window)
+
+	// Buckets idle for a full window have refilled completely, so are no different to a new bucket
+	if now.Sub(store.lastSweep) > window {
+		for k, bucket := range store.buckets {
+			if now.Sub(bucket.updated) > window {
+				delete(store.buckets, k)
+			}
+		}
+		store.lastSweep = now
+	}
+
+	bucket, isset := store.buckets[key]
+	if !isset {
+		bucket = &tokenBucket{tokens: float64(limit), updated: now}
+		store.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit), bucket.tokens+float64(now.Sub(bucket.updated))*rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate), nil
+	}
+	bucket.tokens--
+	return true, 0, nil
+}
+
+// RateLimit returns a middleware allowing each client IP limit requests per window.
+// Requests over the limit are rejected with a 429 and a Retry-After header.
+// If store is nil, a new InMemoryRateLimitStore is used. Panics if limit or window isn't positive.
+func RateLimit(limit uint, window time.Duration, store RateLimitStore) Middleware {
+	if limit == 0 || window <= 0 {
+		panic(fmt.Sprintf("invalid rate limit of %d per %v", limit, window))
+	}
+	if store == nil {
+		store = NewInMemoryRateLimitStore()
+	}
+	return func(req *Request) *Error {
+		allowed, retryAfter, err := store.Take(req.ClientIP(), limit, window)
+		if err != nil {
+			// Better to let the request through than to fail every request while the store is unavailable
+			req.Log().Error(fmt.Errorf("Error checking rate limit: %v", err))
+			return nil
+		}
+		if !allowed {
+			return &Error{Code: http.StatusTooManyRequests, RetryAfter: retryAfter}
+		}
+		return nil
+	}
+}
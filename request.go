@@ -2,17 +2,36 @@ package webserver
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
 type Request struct {
 	req       *http.Request
+	w         http.ResponseWriter
+	written   bool
 	startTime time.Time
 
 	Session interface{}
@@ -25,26 +44,245 @@ type Request struct {
 	Context         context.Context
 	ResponseHeaders http.Header
 	ResponseCode    int
-	bodySize        uint
-	responseSize    uint
+	bodySizer       *bodySizeReader
+	bodyReader      io.Reader
+	responseType    reflect.Type
+	// The content types of the server's registered interfaces, for streamed responses to set their Content-Type
+	interfaceContentTypes map[reflect.Type]string
+	// Interfaces registered with RegisterBodyParser, by media type
+	bodyParsers    map[string]reflect.Type
+	responseBody   []byte
+	responseBuffer *bytes.Buffer
+	responseSize   uint
+	cacheHit       bool
+	// The cause of an error response, for loggers
+	responseErr error
+
+	maxBodySize int64
+	// Whether responses are to be sent uncompressed: always, or when their Content-Type is one of uncompressedTypes
+	noCompression     bool
+	uncompressedTypes []string
+
+	logger    Logger
+	logFields []any
+	values    map[any]any
+	cleanups  []func()
+	// Saves the session, for handlers writing the response themselves before they return
+	saveSession func() error
+
+	routePattern string
+	requestID    string
+	locales      *locales
+	locale       string
+
+	wsCloseCode   WebsocketCloseCode
+	wsCloseReason string
+}
+
+// Context key holding when a request arrived, for those received before their Request is created
+type requestStartKey struct{}
+
+func newRequest(w http.ResponseWriter, r *http.Request) *Request {
+	startTime, isset := r.Context().Value(requestStartKey{}).(time.Time)
+	if !isset {
+		startTime = time.Now()
+	}
+	return &Request{
+		req:             r,
+		w:               w,
+		startTime:       startTime,
+		Path:            r.URL.Path,
+		Headers:         r.Header,
+		Cookies:         r.Cookies(),
+		Context:         r.Context(),
+		ResponseHeaders: w.Header(),
+	}
+}
+
+// Returns the verb the request is handled as, or the method as sent if it isn't a Verb (e.g. when responding 501)
+func (req *Request) method() string {
+	if req.Verb == 0 {
+		return req.req.Method
+	}
+	return req.Verb.String()
 }
 
 func (req *Request) Start() time.Time {
 	return req.startTime
 }
 
+// Cookie returns the named cookie sent with the request
+func (req *Request) Cookie(name string) (*http.Cookie, bool) {
+	for _, cookie := range req.Cookies {
+		if cookie.Name == name {
+			return cookie, true
+		}
+	}
+	return nil, false
+}
+
+// Reads the named cookie from the Cookie headers in header.
+// Malformed cookies are skipped by the standard library's parser rather than failing the whole header.
+func cookieFromHeader(header http.Header, name string) (*http.Cookie, bool) {
+	req := Request{Cookies: (&http.Request{Header: header}).Cookies()}
+	return req.Cookie(name)
+}
+
+// SetCookie adds a Set-Cookie header to the response. Each call adds another, so any number of cookies may be set,
+// except that a cookie with the same name, path and domain as one already set replaces it (as it would in the browser).
 func (req *Request) SetCookie(cookie http.Cookie) {
-	req.ResponseHeaders.Set("set-cookie", cookie.String())
+	values := req.ResponseHeaders.Values("Set-Cookie")
+	for idx, value := range values {
+		set := (&http.Response{Header: http.Header{"Set-Cookie": {value}}}).Cookies()
+		if len(set) == 1 && set[0].Name == cookie.Name && set[0].Path == cookie.Path && set[0].Domain == cookie.Domain {
+			values[idx] = cookie.String()
+			return
+		}
+	}
+	req.ResponseHeaders.Add("Set-Cookie", cookie.String())
+}
+
+// Set stores value under key for the remainder of the request, allowing middlewares to pass data on to the handler.
+// As with context.WithValue, keys must be comparable, and packages should use their own unexported key types.
+func (req *Request) Set(key any, value any) {
+	if req.values == nil {
+		req.values = make(map[any]any)
+	}
+	req.values[key] = value
+}
+
+// Get returns the value stored under key by Set
+func (req *Request) Get(key any) (any, bool) {
+	value, isset := req.values[key]
+	return value, isset
+}
+
+// GetValue returns the value stored under key by Set, if set and of type V
+func GetValue[V any](req *Request, key any) (V, bool) {
+	value, _ := req.Get(key)
+	v, ok := value.(V)
+	return v, ok
+}
+
+// Cleanup registers fn to be called once the response has been sent (after any post middlewares).
+// Cleanup functions are called in the reverse order they were registered, as with defer.
+func (req *Request) Cleanup(fn func()) {
+	req.cleanups = append(req.cleanups, fn)
+}
+
+func (req *Request) runCleanups() {
+	for idx := len(req.cleanups) - 1; idx >= 0; idx-- {
+		req.cleanups[idx]()
+	}
+	req.cleanups = nil
+
+	if req.responseBuffer != nil {
+		// Only now that post middlewares are done with responseBody can the buffer behind it be reused
+		req.responseBody = nil
+		putBuffer(req.responseBuffer)
+		req.responseBuffer = nil
+	}
+}
+
+// ClientIP returns the IP address of the client connected to the server
+func (req *Request) ClientIP() string {
+	host, _, err := net.SplitHostPort(req.req.RemoteAddr)
+	if err != nil {
+		return req.req.RemoteAddr
+	}
+	return host
+}
+
+// RequestID identifies the request in logs. A client (or proxy) supplied X-Request-ID header is used if it's sane,
+// otherwise a random ID is generated on first call.
+func (req *Request) RequestID() string {
+	if req.requestID == "" {
+		req.requestID = req.Headers.Get("X-Request-ID")
+		if !validRequestID(req.requestID) {
+			buf := make([]byte, 12)
+			rand.Read(buf)
+			req.requestID = hex.EncodeToString(buf)
+		}
+	}
+	return req.requestID
+}
+
+// Whether id is short printable ASCII, and so safe to copy into logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (req *Request) UserAgent() string {
+	return req.req.UserAgent()
+}
+
+// Proto returns the protocol the request was made over, e.g. "HTTP/1.1" or "HTTP/2.0"
+func (req *Request) Proto() string {
+	return req.req.Proto
+}
+
+// RequestURI returns the target of the request line as sent by the client (e.g. "/api/users?page=2"),
+// before any of the server's rewrites were applied to Path
+func (req *Request) RequestURI() string {
+	return req.req.RequestURI
+}
+
+// TLSState returns the state of the TLS connection the request was made over, or nil if it wasn't made over TLS.
+// The state is shared with net/http, so mustn't be modified.
+func (req *Request) TLSState() *tls.ConnectionState {
+	return req.req.TLS
+}
+
+// RoutePattern returns the path the matched route was registered with, e.g. "/users/" for a request to "/users/123".
+// Unlike Path, it groups requests by route for logging and metrics.
+func (req *Request) RoutePattern() string {
+	return req.routePattern
+}
+
+// Duration returns how long it's been since the request was received
+func (req *Request) Duration() time.Duration {
+	return time.Since(req.startTime)
 }
 
 func (req *Request) BodySize() uint {
-	return req.bodySize
+	if req.bodySizer == nil {
+		return 0
+	}
+	return uint(req.bodySizer.Size)
+}
+
+// BodyReader returns the decoded, size limited request body for routes whose body type is RawBody.
+// Any other route's body has already been consumed by its parser, so an empty reader is returned.
+func (req *Request) BodyReader() io.Reader {
+	if req.bodyReader == nil {
+		return http.NoBody
+	}
+	return req.bodyReader
 }
 
 func (req *Request) ResponseSize() uint {
 	return req.responseSize
 }
 
+// ResponseError returns the Error.Error an error response was sent for, or nil if there was none (or it had no cause).
+// It lets a Logger record why a request failed, not just its status code.
+func (req *Request) ResponseError() error {
+	return req.responseErr
+}
+
+// CacheHit reports whether the response was served from a cache, including the client's own via a 304 Not Modified.
+func (req *Request) CacheHit() bool {
+	return req.cacheHit || req.ResponseCode == http.StatusNotModified
+}
+
 type bodySizeReader struct {
 	Size int
 }
@@ -54,60 +292,258 @@ func (rdr *bodySizeReader) Write(buf []byte) (n int, err error) {
 	return len(buf), nil
 }
 
-// TODO: determine ahead of time if B implements the required interfaceDoes it implement interface for content type?
-func readBody[B any](req *Request, body *B) *Error {
-	sizer := new(bodySizeReader)
-	defer func() {
-		req.bodySize = uint(sizer.Size)
-	}()
+// Maps an error encountered while reading the request body to the appropriate response code.
+// The body being too large is the client's problem as much as a connection dropping mid-body is.
+func bodyReadError(err error) *Error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &Error{Code: http.StatusRequestEntityTooLarge, Error: err}
+	}
+	return &Error{Code: http.StatusBadRequest, Error: fmt.Errorf("Error reading request body: %w", err)}
+}
 
-	teeBody := io.TeeReader(req.req.Body, sizer)
-	bodyRdr := bufio.NewReader(teeBody)
+// Undoes the Content-Encoding(s) applied to the request body by the client.
+// As the encoded body's size is already limited, the decoded size is limited to maxSize as well.
+func decodeBody(body io.Reader, contentEncoding string, maxSize int64) (io.Reader, *Error) {
+	if contentEncoding == "" {
+		return body, nil
+	}
 
-	if _, err := bodyRdr.Peek(1); err == nil {
-		mediaType, params, err := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	// Encodings are listed in the order they were applied, so must be decoded in reverse
+	encodings := strings.Split(contentEncoding, ",")
+	for idx := len(encodings) - 1; idx >= 0; idx-- {
+		var err error
+		switch encoding := strings.ToLower(strings.TrimSpace(encodings[idx])); encoding {
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = zlib.NewReader(body)
+		case "br":
+			body = brotli.NewReader(body)
+		case "identity", "":
+		default:
+			return nil, &Error{Code: http.StatusUnsupportedMediaType, Error: fmt.Errorf("Unsupported content encoding [%s]", encoding)}
+		}
 		if err != nil {
-			return &Error{Code: http.StatusBadRequest, Error: err}
+			return nil, bodyReadError(err)
 		}
-		switch mediaType {
-		case "application/x-www-form-urlencoded":
-			parser, ok := (interface{}(body)).(FormDataParser)
-			if ok {
-				err := parser.ParseFormData(bodyRdr)
-				if err != nil {
-					return err
-				}
-			}
-		case "multipart/form-data":
-			parser, ok := (interface{}(body)).(MultipartFormDataParser)
-			if ok {
-				err := parser.ParseMultipartFormData(bodyRdr, params["boundary"])
-				if err != nil {
-					return err
-				}
-			}
-		case "application/json":
-			reqBody, err := io.ReadAll(bodyRdr)
-			if err != nil {
-				return &Error{Code: http.StatusInternalServerError, Error: err}
-			}
-			err = json.Unmarshal(reqBody, body)
+	}
+
+	if maxSize > 0 {
+		body = http.MaxBytesReader(nil, io.NopCloser(body), maxSize)
+	}
+	return body, nil
+}
+
+// Returns the decoder for charset, or nil if the content is already UTF-8 (or charset is unknown, in which case
+// UTF-8 is the best guess there is)
+func charsetDecoder(charset string) *encoding.Decoder {
+	if charset == "" {
+		return nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil || enc == unicode.UTF8 {
+		return nil
+	}
+	return enc.NewDecoder()
+}
+
+// Transcodes rdr from charset to UTF-8
+func transcode(rdr io.Reader, charset string) io.Reader {
+	if decoder := charsetDecoder(charset); decoder != nil {
+		return transform.NewReader(rdr, decoder)
+	}
+	return rdr
+}
+
+// Form data is percent-encoded ASCII, so it's the decoded keys and values which need transcoding from charset.
+// The result is re-encoded, leaving parsers none the wiser.
+func transcodeFormData(rdr io.Reader, charset string) (io.Reader, error) {
+	decoder := charsetDecoder(charset)
+	if decoder == nil {
+		return rdr, nil
+	}
+
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		// Leave it to the parser to reject
+		return bytes.NewReader(data), nil
+	}
+
+	transcoded := url.Values{}
+	for key, vals := range values {
+		utf8Key, err := decoder.String(key)
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			utf8Val, err := decoder.String(val)
 			if err != nil {
-				return &Error{Code: http.StatusBadRequest, Error: err}
+				return nil, err
 			}
-		case "text":
-			parser, ok := (interface{}(body)).(PlainTextParser)
-			if ok {
-				err := parser.ParsePlainText(bodyRdr)
-				if err != nil {
-					return err
-				}
+			transcoded.Add(utf8Key, utf8Val)
+		}
+	}
+	return strings.NewReader(transcoded.Encode()), nil
+}
+
+// Unmarshals a JSON request body into body, checking its validate tags
+func parseJSON(rdr io.Reader, body any) *Error {
+	reqBody, err := io.ReadAll(rdr)
+	if err != nil {
+		return bodyReadError(err)
+	}
+	err = json.Unmarshal(reqBody, body)
+	if err != nil {
+		return &Error{Code: http.StatusBadRequest, Error: err}
+	}
+	return checkTags(body)
+}
+
+// Checks the validate tags of body's fields, with a 400 should any fail
+func checkTags(body any) *Error {
+	failures, err := validateTags(body)
+	if err != nil {
+		return &Error{Code: http.StatusInternalServerError, Error: fmt.Errorf("Invalid validate tag: %w", err)}
+	} else if failures != nil {
+		return &Error{Code: http.StatusBadRequest, Error: failures}
+	}
+	return nil
+}
+
+// Runs body's Validate method, if it has one
+func runValidator(body any) *Error {
+	if validator, ok := body.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			var validationErr ValidationError
+			if errors.As(err, &validationErr) {
+				return &Error{Code: http.StatusUnprocessableEntity, Error: err}
 			}
+			return &Error{Code: http.StatusBadRequest, Error: err}
+		}
+	}
+	return nil
+}
 
-		default:
-			return &Error{Code: http.StatusUnsupportedMediaType, Error: fmt.Errorf("Unsupported media type [%s] parsed from header [%s]", mediaType, req.Headers.Get("Content-Type"))}
+// limitTrackingReader remembers whether reading ran into the request body's size limit
+type limitTrackingReader struct {
+	io.Reader
+	exceeded error
+}
+
+func (rdr *limitTrackingReader) Read(p []byte) (int, error) {
+	n, err := rdr.Reader.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if err != nil && errors.As(err, &maxBytesErr) {
+		rdr.exceeded = err
+	}
+	return n, err
+}
+
+// TODO: determine ahead of time if B implements the required interfaceDoes it implement interface for content type?
+func readBody[B any](req *Request, body *B) *Error {
+	// BodySize is the number of bytes read off the wire, which when reading fails is only what arrived beforehand
+	req.bodySizer = new(bodySizeReader)
+	teeBody := io.TeeReader(req.req.Body, req.bodySizer)
+	rawRdr := bufio.NewReader(teeBody)
+
+	if _, err := rawRdr.Peek(1); errors.Is(err, io.EOF) {
+		// No body was sent, so its zero value must be valid
+		if err := checkTags(body); err != nil {
+			return err
 		}
+		return runValidator(body)
+	} else if err != nil {
+		return bodyReadError(err)
+	}
+
+	bodyRdr, decodeErr := decodeBody(rawRdr, req.Headers.Get("Content-Encoding"), req.maxBodySize)
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	if _, ok := (interface{}(body)).(*RawBody); ok {
+		// Left for the handler to stream from BodyReader
+		req.bodyReader = bodyRdr
 		req.Body = *body
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(req.Headers.Get("Content-Type"))
+	if err != nil {
+		return &Error{Code: http.StatusBadRequest, Error: err}
+	}
+	parserType := mediaType
+	if strings.HasPrefix(mediaType, "text/") {
+		// text/plain, text/csv etc. are all handed to the PlainTextParser
+		parserType = "text"
+	} else if strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json") {
+		// Structured syntax suffix types, e.g. application/vnd.api+json or application/problem+json
+		parserType = "application/json"
+	}
+
+	// Parsers are free to report errors reading the body however they like, so whether the body was too large is
+	// tracked independently, for a consistent 413
+	limited := &limitTrackingReader{Reader: bodyRdr}
+	bodyRdr = limited
+
+	var parseErr *Error
+	if parser, isset := req.bodyParsers[mediaType]; isset {
+		if value := reflect.ValueOf(body); value.Type().Implements(parser) {
+			result := value.Convert(parser).Method(0).Call([]reflect.Value{reflect.ValueOf(&bodyRdr).Elem()})
+			parseErr = result[0].Interface().(*Error)
+			parserType = ""
+		}
+	}
+	switch parserType {
+	case "":
+		// Parsed by a registered parser
+	case "application/x-www-form-urlencoded":
+		if parser, ok := (interface{}(body)).(FormDataParser); ok {
+			if bodyRdr, err = transcodeFormData(bodyRdr, params["charset"]); err != nil {
+				parseErr = bodyReadError(err)
+			} else {
+				parseErr = parser.ParseFormData(bodyRdr)
+			}
+		}
+	case "multipart/form-data":
+		if parser, ok := (interface{}(body)).(MultipartPartParser); ok {
+			parseErr = parseMultipartParts(bodyRdr, params["boundary"], parser)
+		} else if parser, ok := (interface{}(body)).(MultipartFormDataParser); ok {
+			parseErr = parser.ParseMultipartFormData(bodyRdr, params["boundary"])
+		}
+	case "application/json":
+		parseErr = parseJSON(bodyRdr, body)
+	case "text":
+		if parser, ok := (interface{}(body)).(PlainTextParser); ok {
+			parseErr = parser.ParsePlainText(transcode(bodyRdr, params["charset"]))
+		}
+
+	default:
+		return &Error{Code: http.StatusUnsupportedMediaType, Error: fmt.Errorf("Unsupported media type [%s] parsed from header [%s]", mediaType, req.Headers.Get("Content-Type"))}
+	}
+	if limited.exceeded != nil {
+		return bodyReadError(limited.exceeded)
+	} else if parseErr != nil {
+		return parseErr
+	}
+
+	if closer, ok := (interface{}(body)).(io.Closer); ok {
+		// Bodies holding on to resources (such as uploaded files) release them once the request is done
+		req.Cleanup(func() {
+			if err := closer.Close(); err != nil {
+				req.Log().Error(fmt.Errorf("Error closing request body: %v", err))
+			}
+		})
+	}
+
+	if err := runValidator(body); err != nil {
+		return err
 	}
+	req.Body = *body
 	return nil
 }
@@ -0,0 +1,381 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+)
+
+// Delivers its content and then fails, as if the connection dropped mid-body
+type failingReader struct {
+	content io.Reader
+}
+
+func (rdr *failingReader) Read(buf []byte) (int, error) {
+	n, err := rdr.content.Read(buf)
+	if errors.Is(err, io.EOF) {
+		return n, errors.New("connection reset by peer")
+	}
+	return n, err
+}
+
+func newTestRequest(method string, contentType string, body io.Reader) *Request {
+	r := httptest.NewRequest(method, "/", body)
+	r.Header.Set("Content-Type", contentType)
+	return newRequest(httptest.NewRecorder(), r)
+}
+
+func TestReadBodyFailure(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		body        io.Reader
+		expected    uint
+		size        uint
+	}{
+		{"application/json", &failingReader{strings.NewReader(`{"Values":`)}, http.StatusBadRequest, 10},
+		{"application/json", &failingReader{strings.NewReader(``)}, http.StatusBadRequest, 0},
+		{"application/x-www-form-urlencoded", &failingReader{strings.NewReader(`a=1&b=`)}, http.StatusBadRequest, 6},
+		{"multipart/form-data; boundary=xyz", &failingReader{strings.NewReader("--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1")}, http.StatusBadRequest, 52},
+		{"application/json", http.MaxBytesReader(nil, io.NopCloser(strings.NewReader(`{"Values":{}}`)), 4), http.StatusRequestEntityTooLarge, 4},
+	} {
+		req := newTestRequest("POST", test.contentType, test.body)
+		err := readBody(req, new(RequestBody))
+		if err == nil || err.Code != test.expected {
+			t.Errorf("Did not return expected code [%d] for a failed [%s] body\n\tReturned: %v", test.expected, test.contentType, err)
+		}
+		if req.BodySize() != test.size {
+			t.Errorf("Did not record expected body size [%d] for a failed [%s] body\n\tRecorded: %d", test.size, test.contentType, req.BodySize())
+		}
+	}
+
+	// An empty body isn't a failure
+	req := newTestRequest("POST", "application/json", strings.NewReader(""))
+	if err := readBody(req, new(RequestBody)); err != nil {
+		t.Errorf("Empty body returned error: %v", err)
+	}
+}
+
+func TestRequestValues(t *testing.T) {
+	type userKey struct{}
+	type user struct {
+		Name string
+	}
+
+	req := newTestRequest("GET", "", nil)
+	if _, isset := req.Get(userKey{}); isset {
+		t.Errorf("Unset key reported as set")
+	}
+
+	req.Set(userKey{}, &user{Name: "alice"})
+	req.Set("count", 3)
+
+	if u, ok := GetValue[*user](req, userKey{}); !ok || u.Name != "alice" {
+		t.Errorf("Did not get expected user back: %v %v", u, ok)
+	}
+	if _, ok := GetValue[string](req, "count"); ok {
+		t.Errorf("GetValue returned a value of the wrong type")
+	}
+	if count, ok := GetValue[int](req, "count"); !ok || count != 3 {
+		t.Errorf("Did not get expected count back: %v %v", count, ok)
+	}
+}
+
+func TestReadBodyContentEncoding(t *testing.T) {
+	type payload struct {
+		Message string
+	}
+	content := []byte(`{"Message":"` + strings.Repeat("hello ", 100) + `"}`)
+
+	var gzipped, deflated, brotlied bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(content)
+	gz.Close()
+	zl := zlib.NewWriter(&deflated)
+	zl.Write(content)
+	zl.Close()
+	br := brotli.NewWriter(&brotlied)
+	br.Write(content)
+	br.Close()
+
+	for _, test := range []struct {
+		encoding string
+		body     []byte
+		maxSize  int64
+		expected uint
+	}{
+		{"gzip", gzipped.Bytes(), 1 << 20, 0},
+		{"deflate", deflated.Bytes(), 1 << 20, 0},
+		{"br", brotlied.Bytes(), 1 << 20, 0},
+		{"identity", content, 1 << 20, 0},
+		{"gzip", gzipped.Bytes(), int64(len(content) - 1), http.StatusRequestEntityTooLarge},
+		{"gzip", content, 1 << 20, http.StatusBadRequest},
+		{"compress", content, 1 << 20, http.StatusUnsupportedMediaType},
+	} {
+		req := newTestRequest("POST", "application/json", bytes.NewReader(test.body))
+		req.Headers.Set("Content-Encoding", test.encoding)
+		req.maxBodySize = test.maxSize
+
+		body := new(payload)
+		err := readBody(req, body)
+		if test.expected == 0 {
+			if err != nil {
+				t.Errorf("Unable to read [%s] encoded body: %v", test.encoding, err.Error)
+			} else if body.Message != strings.Repeat("hello ", 100) {
+				t.Errorf("[%s] encoded body was not parsed as expected: %q", test.encoding, body.Message)
+			}
+		} else if err == nil || err.Code != test.expected {
+			t.Errorf("Did not return expected code [%d] for [%s] encoded body with limit %d\n\tReturned: %v", test.expected, test.encoding, test.maxSize, err)
+		}
+	}
+}
+
+type testUpload struct {
+	Fields map[string]string
+	Sizes  map[string]int64
+}
+
+func (upload *testUpload) ParseMultipartPart(part *multipart.Part) *Error {
+	if part.FileName() == "" {
+		value, _ := io.ReadAll(part)
+		upload.Fields[part.FormName()] = string(value)
+		return nil
+	}
+	size, err := io.Copy(io.Discard, part)
+	if err != nil {
+		return bodyReadError(err)
+	}
+	upload.Sizes[part.FileName()] = size
+	return nil
+}
+
+func TestReadBodyMultipartParts(t *testing.T) {
+	var buf bytes.Buffer
+	mpw := multipart.NewWriter(&buf)
+	mpw.WriteField("title", "Holiday")
+	file, _ := mpw.CreateFormFile("photo", "beach.jpg")
+	file.Write(bytes.Repeat([]byte{0xff}, 1<<16))
+	mpw.Close()
+
+	req := newTestRequest("POST", mpw.FormDataContentType(), &buf)
+	upload := &testUpload{Fields: map[string]string{}, Sizes: map[string]int64{}}
+	if err := readBody(req, upload); err != nil {
+		t.Fatalf("Unable to read multipart body: %v", err.Error)
+	}
+	if upload.Fields["title"] != "Holiday" || upload.Sizes["beach.jpg"] != 1<<16 {
+		t.Errorf("Multipart parts not parsed as expected: %v %v", upload.Fields, upload.Sizes)
+	}
+}
+
+func TestReadBodyCharset(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"application/x-www-form-urlencoded; charset=iso-8859-1", "season=%E9t%E9", "été"},
+		{"application/x-www-form-urlencoded; charset=windows-1252", "price=%8010", "€10"},
+		{"application/x-www-form-urlencoded; charset=utf-8", "season=%C3%A9t%C3%A9", "été"},
+		{"application/x-www-form-urlencoded", "season=%C3%A9t%C3%A9", "été"},
+		{"application/x-www-form-urlencoded; charset=made-up", "season=%C3%A9t%C3%A9", "été"},
+	} {
+		req := newTestRequest("POST", test.contentType, strings.NewReader(test.body))
+		body := new(RequestBody)
+		if err := readBody(req, body); err != nil {
+			t.Errorf("Unable to read body with Content-Type [%s]: %v", test.contentType, err.Error)
+			continue
+		}
+		for _, values := range body.Values {
+			if values[0] != test.expected {
+				t.Errorf("Did not transcode [%s] body as expected %q\n\tReturned: %q", test.contentType, test.expected, values[0])
+			}
+		}
+	}
+}
+
+type testPlainText struct {
+	Text string
+}
+
+func (body *testPlainText) ParsePlainText(rdr io.Reader) *Error {
+	text, err := io.ReadAll(rdr)
+	if err != nil {
+		return bodyReadError(err)
+	}
+	body.Text = string(text)
+	return nil
+}
+
+func TestReadBodyPlainText(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"text/plain", "hello", "hello"},
+		{"text/plain; charset=utf-8", "hello", "hello"},
+		{"text/csv", "a,b\n1,2", "a,b\n1,2"},
+		{"text/plain; charset=iso-8859-1", "\xe9t\xe9", "été"},
+	} {
+		req := newTestRequest("POST", test.contentType, strings.NewReader(test.body))
+		body := new(testPlainText)
+		if err := readBody(req, body); err != nil {
+			t.Errorf("Unable to read body with Content-Type [%s]: %v", test.contentType, err.Error)
+		} else if body.Text != test.expected {
+			t.Errorf("PlainTextParser did not receive expected text %q for Content-Type [%s]\n\tReceived: %q", test.expected, test.contentType, body.Text)
+		}
+	}
+}
+
+func TestReadBodyJSONMediaTypes(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		expected    uint
+	}{
+		{"application/json", 0},
+		{"application/json; charset=utf-8", 0},
+		{"application/vnd.api+json", 0},
+		{"application/problem+json; charset=utf-8", 0},
+		{"application/json-seq", http.StatusUnsupportedMediaType},
+		{"image/svg+json", http.StatusUnsupportedMediaType},
+	} {
+		req := newTestRequest("POST", test.contentType, strings.NewReader(`{"Text":"hello"}`))
+		body := new(testPlainText)
+		err := readBody(req, body)
+		if test.expected == 0 && (err != nil || body.Text != "hello") {
+			t.Errorf("Expected [%s] body to be read, received %q (%v)", test.contentType, body.Text, err)
+		} else if test.expected != 0 && (err == nil || err.Code != test.expected) {
+			t.Errorf("Expected %d for [%s] body, received %v", test.expected, test.contentType, err)
+		}
+	}
+}
+
+type testTaggedAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type testTaggedBody struct {
+	Name    string            `json:"name" validate:"required,max=10"`
+	Email   string            `json:"email" validate:"required,email"`
+	Age     int               `json:"age" validate:"min=18"`
+	Tags    []string          `json:"tags" validate:"max=2"`
+	Address testTaggedAddress `json:"address"`
+}
+
+func TestReadBodyValidateTags(t *testing.T) {
+	for _, test := range []struct {
+		body     string
+		expected ValidationError
+	}{
+		{`{"name":"Bob","email":"bob@example.com","age":30,"address":{"city":"Paris"}}`, nil},
+		{`{"age":30,"address":{"city":"Paris"}}`, ValidationError{"name": "is required", "email": "is required"}},
+		{`{"name":"Bartholomew Jr","email":"bob","age":17,"tags":["a","b","c"]}`, ValidationError{
+			"name":         "must have a length of at most 10",
+			"email":        "must be a valid email address",
+			"age":          "must be at least 18",
+			"tags":         "must have a length of at most 2",
+			"address.city": "is required",
+		}},
+	} {
+		req := newTestRequest("POST", "application/json", strings.NewReader(test.body))
+		err := readBody(req, new(testTaggedBody))
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("Unexpected error reading %s: %v", test.body, err.Error)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Expected validation to fail for %s", test.body)
+			continue
+		}
+		var failures ValidationError
+		if err.Code != http.StatusBadRequest || !errors.As(err.Error, &failures) {
+			t.Errorf("Expected 400 ValidationError for %s, received %d: %v", test.body, err.Code, err.Error)
+		} else if !reflect.DeepEqual(failures, test.expected) {
+			t.Errorf("Unexpected validation failures for %s\n\tExpected: %v\n\tReceived: %v", test.body, test.expected, failures)
+		}
+	}
+}
+
+func TestReadBodyValidateTagsMalformed(t *testing.T) {
+	type malformed struct {
+		Name string `json:"name" validate:"requird"`
+	}
+	req := newTestRequest("POST", "application/json", strings.NewReader(`{"name":"Bob"}`))
+	if err := readBody(req, new(malformed)); err == nil || err.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a 500 for an unknown validation rule, received %v", err)
+	}
+}
+
+func TestReadBodyValidateEmpty(t *testing.T) {
+	req := newTestRequest("POST", "application/json", strings.NewReader(""))
+	err := readBody(req, new(testTaggedBody))
+	var failures ValidationError
+	if err == nil || err.Code != http.StatusBadRequest || !errors.As(err.Error, &failures) || failures["name"] != "is required" {
+		t.Errorf("Expected a 400 ValidationError for an empty body missing required fields, received %v", err)
+	}
+
+	req = newTestRequest("POST", "", strings.NewReader(""))
+	if err := readBody(req, new(RequestBody)); err != nil {
+		t.Errorf("Unexpected error for an empty body without validation: %v", err.Error)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		expected string
+	}{
+		{"abc-123", "abc-123"},
+		{"", ""},
+		{"has spaces", ""},
+		{strings.Repeat("a", 129), ""},
+	} {
+		req := newTestRequest("GET", "", nil)
+		req.Headers.Set("X-Request-ID", test.header)
+		id := req.RequestID()
+		if test.expected != "" && id != test.expected {
+			t.Errorf("Expected request ID [%s] from header, received [%s]", test.expected, id)
+		} else if test.expected == "" && len(id) != 24 {
+			t.Errorf("Expected a generated request ID for header [%s], received [%s]", test.header, id)
+		}
+		if again := req.RequestID(); again != id {
+			t.Errorf("Request ID changed between calls, from [%s] to [%s]", id, again)
+		}
+	}
+}
+
+func TestRequestAccessors(t *testing.T) {
+	req := newTestRequest("GET", "", nil)
+	req.Headers.Set("User-Agent", "test-agent/1.0")
+	if req.UserAgent() != "test-agent/1.0" {
+		t.Errorf("Expected UserAgent [test-agent/1.0], received [%s]", req.UserAgent())
+	}
+	if req.Proto() != "HTTP/1.1" {
+		t.Errorf("Expected Proto [HTTP/1.1], received [%s]", req.Proto())
+	}
+	if req.ClientIP() != "192.0.2.1" {
+		t.Errorf("Expected ClientIP [192.0.2.1], received [%s]", req.ClientIP())
+	}
+	if req.Duration() <= 0 {
+		t.Errorf("Expected a positive Duration, received %v", req.Duration())
+	}
+	if req.TLSState() != nil {
+		t.Errorf("Expected no TLSState for a plain HTTP request, received %+v", req.TLSState())
+	}
+
+	req = newRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "https://example.com/", nil))
+	if state := req.TLSState(); state == nil || !state.HandshakeComplete {
+		t.Errorf("Expected a completed TLSState for an HTTPS request, received %+v", state)
+	}
+}
@@ -0,0 +1,40 @@
+package webserver
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Rewrite returns the path a request should be routed by, e.g. to strip a prefix added by a proxy.
+// Returning r.URL.Path leaves the request unchanged.
+type Rewrite func(r *http.Request) string
+
+// Rewrite adds rw to the rewrites applied to each request's path, in the order added, before it's matched to a route.
+// Handlers see the rewritten path as Request.Path, while the original remains available from Request.RequestURI.
+func (s *Server[S]) Rewrite(rw Rewrite) {
+	s.rewrites = append(s.rewrites, rw)
+}
+
+// StripPrefix is a Rewrite removing prefix (e.g. "/api") from the start of request paths, leaving other paths unchanged
+func StripPrefix(prefix string) Rewrite {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(r *http.Request) string {
+		path := r.URL.Path
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			return path
+		}
+		if path = strings.TrimPrefix(path, prefix); path == "" {
+			return "/"
+		}
+		return path
+	}
+}
+
+// Applies the server's rewrites to r
+func (s *Server[S]) rewrite(r *http.Request) {
+	for _, rw := range s.rewrites {
+		if path := rw(r); path != r.URL.Path {
+			r.URL.Path, r.URL.RawPath = path, ""
+		}
+	}
+}
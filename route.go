@@ -1,23 +1,114 @@
 package webserver
 
+import (
+	"slices"
+	"time"
+)
+
 type Route[B any, T any] struct {
-	path        string
-	middlewares []Middleware
-	websocket   WebsocketHandler
-	eventStream EventStreamHandler
-	handlers    map[Verb]func(req *Request) (T, *Error)
+	path            string
+	middlewares     []Middleware
+	postMiddlewares []PostMiddleware
+	websocket       WebsocketMessageHandler
+	eventStream     EventStreamHandler
+	handlers        map[Verb]func(req *Request) (T, *Error)
+
+	concurrency     semaphore
+	concurrencyWait time.Duration
+	websocketConns  semaphore
+	etag            bool
+	noCompression   bool
+	maxBodySize     int64
+
+	defaultContentType string
+	trailingSlashes    map[string]TrailingSlash
+	verbBodies         map[Verb]func(req *Request) *Error
 }
 
 func (r *Route[B, T]) Middleware(mw Middleware) {
 	r.middlewares = append(r.middlewares, mw)
 }
 
+func (r *Route[B, T]) PostMiddleware(mw PostMiddleware) {
+	r.postMiddlewares = append(r.postMiddlewares, mw)
+}
+
+// Websocket accepts websocket connections to the route, sending each message from handler as a text frame
 func (r *Route[B, T]) Websocket(handler WebsocketHandler) {
-	r.websocket = handler
+	r.websocket = textMessages(handler)
 }
 
-var eventStreamMessagePrefix = []byte("data: ")
+// WebsocketMessages accepts websocket connections to the route, with handler choosing between text and binary frames
+func (r *Route[B, T]) WebsocketMessages(handler WebsocketMessageHandler) {
+	r.websocket = handler
+}
 
 func (r *Route[B, T]) EventStream(handler EventStreamHandler) {
 	r.eventStream = handler
 }
+
+// MaxConcurrency caps how many of the route's handlers may run at once.
+// Requests beyond the limit wait up to wait for a handler to finish, and are otherwise rejected with a 503.
+func (r *Route[B, T]) MaxConcurrency(limit int, wait time.Duration) {
+	r.concurrency = newSemaphore(limit)
+	r.concurrencyWait = wait
+}
+
+// MaxWebsocketConnections caps how many websocket connections to the route may be open at once.
+// Upgrade requests beyond the limit are rejected with a 503.
+func (r *Route[B, T]) MaxWebsocketConnections(limit int) {
+	r.websocketConns = newSemaphore(limit)
+}
+
+// MaxBodySize overrides the server's MaxPostSize for requests to the route.
+// Bodies larger than n bytes (once decoded, if compressed) are rejected with a 413.
+func (r *Route[B, T]) MaxBodySize(n int64) {
+	r.maxBodySize = n
+}
+
+// DefaultContentType sets the registered content type to respond with when the request's Accept header doesn't match
+// anything the route's response implements, taking precedence over the server's DefaultContentType.
+func (r *Route[B, T]) DefaultContentType(contentType string) {
+	r.defaultContentType = contentType
+}
+
+// TrailingSlash overrides the server's TrailingSlash policy for requests to the route's path with its trailing slash
+// added or removed. Use TrailingSlashStrict to opt the route out of a server-wide redirect.
+func (r *Route[B, T]) TrailingSlash(policy TrailingSlash) {
+	r.trailingSlashes[r.path] = policy
+}
+
+// ETag opts the route in to validating its GET responses: each is sent with an ETag hashed from its (uncompressed) body,
+// and a request whose If-None-Match matches it gets an empty 304 Not Modified instead.
+// An ETag set on the response by the handler itself is used as is.
+func (r *Route[B, T]) ETag() {
+	r.etag = true
+}
+
+// DisableCompression sends the route's responses uncompressed whatever the client's Accept-Encoding, e.g. for bodies
+// which are already compressed or encrypted, or too small to benefit.
+func (r *Route[B, T]) DisableCompression() {
+	r.noCompression = true
+}
+
+// ApplyVerbBody parses the bodies of requests to route using verb as body's type, instead of the route's own body type.
+// For paths whose methods accept different payloads, such as a POST creating and a PATCH partially updating.
+func ApplyVerbBody[V any, B any, T any](route *Route[B, T], verb Verb, body V) {
+	if route.verbBodies == nil {
+		route.verbBodies = make(map[Verb]func(req *Request) *Error)
+	}
+	route.verbBodies[verb] = func(req *Request) *Error {
+		return readBody(req, new(V))
+	}
+}
+
+// Parses req's body as the type configured for its verb. Bodies of requests using verbs besides bodyVerbs are ignored,
+// unless the route was given a body type for the verb with ApplyVerbBody.
+func (r *Route[B, T]) readBody(req *Request, bodyVerbs []Verb) *Error {
+	if read, isset := r.verbBodies[req.Verb]; isset {
+		return read(req)
+	} else if !slices.Contains(bodyVerbs, req.Verb) {
+		return nil
+	}
+	return readBody(req, new(B))
+}
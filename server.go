@@ -1,46 +1,102 @@
 package webserver
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
-	"log"
 	"net"
 	"net/http"
-	"os"
 	"reflect"
-	"sort"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/andybalholm/brotli"
-	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
-	"github.com/klauspost/compress/flate"
-	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // This reflection lookup is used in both ApplyErrorHandler as well as ApplyRoute functions
 var rdrInterface = reflect.TypeOf((*io.Reader)(nil)).Elem()
 
 type Server[S any] struct {
-	Logger                defaultLogger
-	SecureConfig          *tls.Config
-	MaxPostSize           uint
+	Logger       Logger
+	SecureConfig *tls.Config
+	MaxPostSize  int64
+	MaxURILength uint
+	// Respond to every request with Connection: close, rather than only those from clients which asked for it
+	CloseConnections bool
+	// Verbs a POST request may be treated as instead, by sending an X-HTTP-Method-Override header or a _method form field.
+	// For clients (e.g. HTML forms) which can only send GET and POST. Disabled when empty.
+	MethodOverrides []Verb
+	// Verbs whose request bodies are parsed. Those of other verbs (by default GET, HEAD, DELETE, OPTIONS and TRACE)
+	// are ignored, unless a route opts in with ApplyVerbBody.
+	BodyVerbs []Verb
+	// Media types of responses never to compress (e.g. "application/zip"), as they're already compressed.
+	// An entry ending in "/" matches every media type beginning with it, e.g. "image/" or "video/".
+	UncompressedTypes []string
+	// Which requests are logged through Logger.LogRequest. Every request when it's the zero value.
+	AccessLog AccessLogPolicy
+	// How concurrent requests sharing a session are kept from losing each other's changes to it
+	SessionConcurrency SessionConcurrency
+	// How requests to a route's path with its trailing slash added or removed are handled, e.g. /counts/ for /counts
+	TrailingSlash TrailingSlash
+	// Notified of each panic while handling a request, and of each 5xx error responded with. Not reporting when nil.
+	ErrorReporter ErrorReporter
+	// How long an event stream may go without sending an event before a keepalive comment is sent, so idle streams
+	// aren't cut off by proxies. No keepalives when 0.
+	EventStreamHeartbeat time.Duration
+	// Sent as the retry field at the start of each event stream, telling the client how long to wait before reconnecting.
+	// Browsers reconnect whenever the stream ends, including when the handler closes its channel, so a stream which
+	// is finished for good should be ended on the client (e.g. EventSource.close()) instead.
+	EventStreamRetry time.Duration
+	// How long a websocket connection may go without receiving anything from the client before it's closed.
+	// Idle clients are pinged at half this interval, so only unresponsive ones time out. No limit when 0.
+	WebsocketReadTimeout time.Duration
+	// How long writing a frame to a websocket connection may take before the connection is deemed dead. No limit when 0.
+	WebsocketWriteTimeout time.Duration
+	// Traces each request to a route with an OpenTelemetry span. Not tracing when nil.
+	Tracer trace.Tracer
+	// Parent of the context of every request received by the server's listeners, e.g. to share values with handlers.
+	// Cancelling it cancels every request in progress, including websocket and event stream connections.
+	// context.Background() when nil. Must be set before the server starts listening.
+	BaseContext           context.Context
 	sessionStore          SessionStore
+	sessionLocks          *keyedLocks
 	middlewares           []Middleware
+	postMiddlewares       []PostMiddleware
 	contentTypeInterfaces map[string]reflect.Type
+	contentTypeOrder      []string
+	interfaceContentTypes map[reflect.Type]string
+	bodyParsers           map[string]reflect.Type
+	defaultContentTypes   map[Verb]string
 	mux                   *http.ServeMux
 	errorHandler          *errorHandler[S]
+	publicRoutes          map[string]*PublicRoute
+	trailingSlashes       map[string]TrailingSlash
+	rewrites              []Rewrite
+	acceptHeaders         acceptCache
+	certManager           *autocert.Manager
+	implementsCache       sync.Map
+	locales               *locales
+	listeners             []*Listener
+	listenersMu           sync.Mutex
+	notReady              atomic.Bool
+	maintenance           maintenanceMode
+	websocketConnections  semaphore
+	inFlight              semaphore
+	inFlightWait          time.Duration
+	inFlightRetryAfter    time.Duration
 }
 
 type Middleware func(req *Request) *Error
+
+// PostMiddleware runs once the response has been written, with ResponseCode and ResponseSize populated
+type PostMiddleware func(req *Request)
 type WebsocketHandler func(req *Request, inFeed <-chan []byte) <-chan []byte
 type EventStreamHandler func(req *Request) <-chan EventStreamer
 
@@ -48,15 +104,30 @@ func New[S any](sessionStore SessionStore) *Server[S] {
 	s := &Server[S]{
 		Logger:                DefaultLogger,
 		MaxPostSize:           10 << 20, // 10MB
+		MaxURILength:          8 << 10,  // 8KB
+		BodyVerbs:             []Verb{POST, PUT, PATCH},
 		middlewares:           make([]Middleware, 0),
 		sessionStore:          sessionStore,
+		sessionLocks:          newKeyedLocks(),
 		contentTypeInterfaces: make(map[string]reflect.Type),
+		interfaceContentTypes: make(map[reflect.Type]string),
+		bodyParsers:           make(map[string]reflect.Type),
+		defaultContentTypes:   make(map[Verb]string),
 		mux:                   http.NewServeMux(),
+		publicRoutes:          make(map[string]*PublicRoute),
+		trailingSlashes:       make(map[string]TrailingSlash),
 	}
 
 	s.RegisterContentTypeInterface("html", (*Htmler)(nil))
 	s.RegisterContentTypeInterface("csv", (*Csver)(nil))
 	s.RegisterContentTypeInterface("json", (*Jsoner)(nil))
+	// Streamed rather than delivered as []byte, so registered directly
+	s.registerContentType("application/x-ndjson", ndjsonerInterface)
+	// Both names are in use; the last registered is the one responses are sent as
+	s.RegisterContentTypeInterface("application/protobuf", (*Protobuffer)(nil))
+	s.RegisterContentTypeInterface("application/x-protobuf", (*Protobuffer)(nil))
+	s.RegisterContentTypeInterface("application/x-msgpack", (*MsgPacker)(nil))
+	s.RegisterContentTypeInterface("application/msgpack", (*MsgPacker)(nil))
 
 	return s
 }
@@ -83,8 +154,58 @@ func (s *Server[S]) RegisterContentTypeInterface(contentType string, i interface
 		fn.Out(0) != byteSlice {
 		panic("interface must implement a single method with no arguments returning []byte")
 	}
+	s.registerContentType(contentType, reflection)
+}
 
+func (s *Server[S]) registerContentType(contentType string, reflection reflect.Type) {
+	if _, isset := s.contentTypeInterfaces[contentType]; !isset {
+		s.contentTypeOrder = append(s.contentTypeOrder, contentType)
+	}
 	s.contentTypeInterfaces[contentType] = reflection
+	s.interfaceContentTypes[reflection] = contentType
+	s.implementsCache.Range(func(t, _ any) bool {
+		s.implementsCache.Delete(t)
+		return true
+	})
+}
+
+// RegisterBodyParser parses request bodies of mediaType (e.g. "application/cbor") with the interface i, which must
+// have a single method accepting an io.Reader and returning a *Error, much like FormDataParser. Bodies of routes whose
+// body type implements i are parsed by it, taking precedence over the built in parsers.
+func (s *Server[S]) RegisterBodyParser(mediaType string, i interface{}) {
+	reflection := reflect.TypeOf(i)
+	if reflection.Kind() == reflect.Pointer {
+		reflection = reflection.Elem()
+	}
+	if reflection.Kind() != reflect.Interface {
+		panic("type of i is not an interface.")
+	}
+
+	if reflection.NumMethod() != 1 {
+		panic("interface must implement a single method accepting an io.Reader and returning *Error")
+	}
+	fn := reflection.Method(0).Type
+	if fn.NumIn() != 1 ||
+		fn.In(0) != readerInterface ||
+		fn.NumOut() != 1 ||
+		fn.Out(0) != errorPointer {
+		panic("interface must implement a single method accepting an io.Reader and returning *Error")
+	}
+
+	s.bodyParsers[strings.ToLower(mediaType)] = reflection
+}
+
+// Returns which of the registered content type interfaces t implements
+func (s *Server[S]) implementsMap(t reflect.Type) map[string]bool {
+	if cached, isset := s.implementsCache.Load(t); isset {
+		return cached.(map[string]bool)
+	}
+	implements := map[string]bool{}
+	for contentType, i := range s.contentTypeInterfaces {
+		implements[contentType] = t.Implements(i)
+	}
+	s.implementsCache.Store(t, implements)
+	return implements
 }
 
 func (s *Server[S]) Middleware(mw Middleware) {
@@ -92,71 +213,142 @@ func (s *Server[S]) Middleware(mw Middleware) {
 	s.middlewares = append(s.middlewares, mw)
 }
 
-func (s *Server[S]) determineResponseInterface(acceptHeader string, implementsMap map[string]bool) reflect.Type {
+func (s *Server[S]) PostMiddleware(mw PostMiddleware) {
+	// apply mw after all requests, including those answered by the error handler
+	s.postMiddlewares = append(s.postMiddlewares, mw)
+}
+
+// MaxWebsocketConnections caps how many websocket connections may be open across all routes at once.
+// Upgrade requests beyond the limit are rejected with a 503. Must be called before the server starts.
+func (s *Server[S]) MaxWebsocketConnections(limit int) {
+	s.websocketConnections = newSemaphore(limit)
+}
 
-	if len(acceptHeader) == 0 {
-		return nil
+// MaxInFlight caps how many requests may be processed at once across the server, shedding load rather than letting
+// latency climb. Requests beyond the limit wait up to wait for another to finish, and are otherwise rejected with a 503
+// asking the client to retry after retryAfter. Time spent waiting counts towards the request's Duration.
+// Websocket and event stream connections are long-lived, so aren't counted (see MaxWebsocketConnections instead).
+// Must be called before the server starts.
+func (s *Server[S]) MaxInFlight(limit int, wait time.Duration, retryAfter time.Duration) {
+	s.inFlight = newSemaphore(limit)
+	s.inFlightWait = wait
+	s.inFlightRetryAfter = retryAfter
+}
+
+// Route-level post middlewares run ahead of those applied to the server, unwinding in the reverse order of Middleware
+func (s *Server[S]) runPostMiddlewares(req *Request, routeMiddlewares []PostMiddleware) {
+	for _, mw := range routeMiddlewares {
+		mw(req)
+	}
+	for _, mw := range s.postMiddlewares {
+		mw(req)
 	}
+}
 
-	offers := []string{}
-	for contentType, implements := range implementsMap {
-		if implements {
-			if strings.Contains(contentType, "/") {
-				offers = append(offers, contentType)
-			} else {
-				offers = append(offers, "text/"+contentType)
-			}
+// DefaultContentType sets the registered content type to respond with when the request's Accept header doesn't
+// match anything the response implements (or is absent). If any verbs are given, the default only applies to
+// requests using those verbs, taking precedence over a default set without verbs.
+func (s *Server[S]) DefaultContentType(contentType string, verbs ...Verb) {
+	if len(verbs) == 0 {
+		// The zero Verb stands in for all verbs
+		verbs = []Verb{0}
+	}
+	for _, verb := range verbs {
+		s.defaultContentTypes[verb] = contentType
+	}
+}
 
+// Determines the interface to deliver the response as, given the content types the response implements.
+// The route's default is preferred over the server's, both for matching wildcards in the Accept header and when
+// it doesn't match at all. A client sending no Accept header accepts anything, getting the preferred content type.
+func (s *Server[S]) negotiate(req *Request, implementsMap map[string]bool, routeDefault string) reflect.Type {
+	serverDefault, isset := s.defaultContentTypes[req.Verb]
+	if !isset {
+		serverDefault = s.defaultContentTypes[0]
+	}
+	preferred := []string{routeDefault, serverDefault}
+
+	acceptHeader := req.Headers.Get("Accept")
+	if strings.TrimSpace(acceptHeader) == "" {
+		return s.preferredInterface("*", implementsMap, preferred, nil)
+	}
+	if responseInterface := s.determineResponseInterface(acceptHeader, implementsMap, preferred...); responseInterface != nil {
+		return responseInterface
+	}
+
+	for _, contentType := range preferred {
+		if implementsMap[contentType] {
+			return s.contentTypeInterfaces[contentType]
 		}
 	}
+	return nil
+}
 
-	type acceptedContentType struct {
-		contentType string
-		weight      float64
+// Sets the Content-Type header for a response delivered as responseInterface, unless the handler already set one.
+// Text is assumed to be UTF-8 encoded.
+func setContentType(header http.Header, interfaceContentTypes map[reflect.Type]string, responseInterface reflect.Type) {
+	if header.Get("Content-Type") != "" {
+		return
+	}
+	contentType, isset := interfaceContentTypes[responseInterface]
+	if !isset {
+		return
 	}
+	mediaType := mediaTypeOf(contentType)
+	if strings.Contains(mediaType, "*") {
+		// A catch-all interface doesn't say what it delivers
+		return
+	} else if strings.HasPrefix(mediaType, "text/") {
+		mediaType += "; charset=utf-8"
+	}
+	header.Set("Content-Type", mediaType)
+}
 
-	acceptHeaderSplit := strings.Split(acceptHeader, ",")
+// Matches the Accept header against the content types in implementsMap. Wildcards (*/* or type/*) match the first
+// content type implemented of preferred, then those registered in the order they were.
+func (s *Server[S]) determineResponseInterface(acceptHeader string, implementsMap map[string]bool, preferred ...string) reflect.Type {
 
-	acceptedContentTypes := make([]acceptedContentType, len(acceptHeaderSplit))
-	for idx, contentType := range acceptHeaderSplit {
+	if len(acceptHeader) == 0 {
+		return nil
+	}
 
-		acceptedParts := strings.Split(contentType, ";q=")
-		acceptedType := acceptedContentType{contentType: acceptedParts[0], weight: 1.0}
-		if len(acceptedParts) > 1 {
-			weight, err := strconv.ParseFloat(acceptedParts[1], 64)
-			if err != nil {
-				log.Println("Error parsing weight value:", err)
-				continue
+	acceptedTypes := s.acceptHeaders.parse(acceptHeader)
+	for _, accepted := range acceptedTypes {
+		if accepted.weight == 0 {
+			// Only unacceptable types remain
+			break
+		}
+		if implementsMap[accepted.contentType] {
+			return s.contentTypeInterfaces[accepted.contentType]
+		} else if accepted.subType == "" {
+			continue
+		}
+
+		if accepted.subType == "*" {
+			// text/* or similar - a content type may have been registered for the main type itself
+			if implementsMap[accepted.mainType] {
+				return s.contentTypeInterfaces[accepted.mainType]
+			}
+			if responseInterface := s.preferredInterface(accepted.mainType, implementsMap, preferred, acceptedTypes); responseInterface != nil {
+				return responseInterface
 			}
-			acceptedType.weight = weight
+		} else if implementsMap[accepted.subType] {
+			return s.contentTypeInterfaces[accepted.subType]
 		}
-		acceptedContentTypes[idx] = acceptedType
 	}
+	return nil
+}
 
-	sort.Slice(acceptedContentTypes, func(i, j int) bool {
-		return acceptedContentTypes[i].weight > acceptedContentTypes[j].weight
-	})
-
-	for _, contentTypeEntry := range acceptedContentTypes {
-		// is contentTypeInterfaces[contentType] set?
-		contentType := contentTypeEntry.contentType
-		if implementsMap[contentType] {
-			return s.contentTypeInterfaces[contentType]
-		} else {
-			parts := strings.Split(contentType, "/")
-			if len(parts) == 1 {
+// Returns the interface of the first content type implemented whose media type is of mainType ("*" matching any),
+// checking preferred before all registered content types. Content types excluded by accepted are skipped.
+func (s *Server[S]) preferredInterface(mainType string, implementsMap map[string]bool, preferred []string, accepted []acceptedContentType) reflect.Type {
+	for _, contentTypes := range [][]string{preferred, s.contentTypeOrder} {
+		for _, contentType := range contentTypes {
+			if !implementsMap[contentType] || excludedContentType(accepted, contentType) {
 				continue
 			}
-
-			if parts[1] == "*" {
-				// text/* or similar - need to match on parts[0]
-				if implementsMap[parts[0]] {
-					return s.contentTypeInterfaces[parts[0]]
-				}
-			} else {
-				if implementsMap[parts[1]] {
-					return s.contentTypeInterfaces[parts[1]]
-				}
+			if mainType == "*" || strings.HasPrefix(mediaTypeOf(contentType), mainType+"/") {
+				return s.contentTypeInterfaces[contentType]
 			}
 		}
 	}
@@ -167,54 +359,58 @@ func (s *Server[S]) determineResponseInterface(acceptHeader string, implementsMa
 func ApplyRoute[T any, S any, B any](s *Server[S], Path string, body B, handlers map[Verb]func(req *Request) (T, *Error)) *Route[B, T] {
 
 	route := &Route[B, T]{
-		path:        Path,
-		middlewares: make([]Middleware, 0),
-		handlers:    handlers,
+		path:            Path,
+		middlewares:     make([]Middleware, 0),
+		handlers:        handlers,
+		trailingSlashes: s.trailingSlashes,
 	}
 
-	implements := map[string]bool{}
 	responseType := reflect.TypeOf(new(T)).Elem()
-	for t, i := range s.contentTypeInterfaces {
-		implements[t] = responseType.Implements(i)
-	}
-
-	isReader := reflect.TypeOf(new(T)).Elem().Implements(rdrInterface)
-
-	// TODO: If T is an interface then check will have to be performed at run-time (maybe it's an Htmler which is also a Csver)..
+	implements := s.implementsMap(responseType)
+	isReader := responseType.Implements(rdrInterface)
+	// When T is an interface, the value returned may implement more than T itself does (maybe it's an Htmler which is
+	// also a Csver), so negotiation is repeated against each response's concrete type.
+	isInterface := responseType.Kind() == reflect.Interface
+	isNoContentType := responseType == noContentType
 
 	s.mux.HandleFunc(Path, func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, int64(s.MaxPostSize))
-		req := &Request{
-			req:             r,
-			startTime:       time.Now(),
-			Path:            r.URL.Path,
-			Headers:         r.Header,
-			Cookies:         r.Cookies(),
-			Context:         r.Context(),
-			ResponseHeaders: w.Header(),
-		}
-		session := Session[S]{
-			store: s.sessionStore,
-			req:   req,
-		}
-
-		if err := session.load(context.TODO()); err != nil {
+		maxBodySize := s.MaxPostSize
+		if route.maxBodySize > 0 {
+			maxBodySize = route.maxBodySize
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		req := newRequest(w, r)
+		req.logger = s.Logger
+		req.locales = s.locales
+		req.interfaceContentTypes = s.interfaceContentTypes
+		req.bodyParsers = s.bodyParsers
+		req.maxBodySize = maxBodySize
+		req.routePattern = route.path
+		req.noCompression = route.noCompression
+		req.uncompressedTypes = s.UncompressedTypes
+		defer s.startSpan(req, req.routePattern)()
+		defer func() {
+			s.runPostMiddlewares(req, route.postMiddlewares)
+			req.runCleanups()
+		}()
+		defer s.recoverRequest(req, w)
+		session := s.newSession(req)
+		if err := session.load(req.Context); err != nil {
 			s.Logger.LogError(req, fmt.Errorf("Error loading session: %v", err))
 		}
 
+		// Stops at the first middleware to return an error, or to respond itself
 		runMiddlewares := func() *Error {
 			for _, mw := range s.middlewares {
 				err := mw(req)
-				if err != nil {
-					s.errorHandler.Apply(req, *err, w)
+				if err != nil || req.written {
 					return err
 				}
 			}
 
 			for _, mw := range route.middlewares {
 				err := mw(req)
-				if err != nil {
-					s.errorHandler.Apply(req, *err, w)
+				if err != nil || req.written {
 					return err
 				}
 			}
@@ -228,47 +424,63 @@ func ApplyRoute[T any, S any, B any](s *Server[S], Path string, body B, handlers
 		req.Verb, verbErr = ParseVerb(r.Method)
 		if verbErr != nil {
 			// https://stackoverflow.com/questions/72217705/http-response-status-for-unknown-nonexistent-http-method
-			s.errorHandler.Apply(req, Error{Code: http.StatusNotImplemented}, w)
+			s.applyError(req, Error{Code: http.StatusNotImplemented}, w)
 			return
 		}
+		if r.ContentLength > maxBodySize {
+			// Rejected before reading any of the body, so a client waiting on Expect: 100-continue never sends it
+			s.applyError(req, Error{Code: http.StatusRequestEntityTooLarge}, w)
+			return
+		}
+		if req.Verb == POST && len(s.MethodOverrides) > 0 {
+			if verb, err := methodOverride(r, s.MethodOverrides); err != nil {
+				s.applyError(req, *err, w)
+				return
+			} else if verb != 0 {
+				req.Verb = verb
+				r.Method = verb.String()
+			}
+		}
 		session.req = req
 
 		handler, isset := handlers[req.Verb]
-		if !isset {
-			s.errorHandler.Apply(req, Error{Code: http.StatusMethodNotAllowed}, w)
+		if !isset && req.Verb == OPTIONS {
+			// Any body has to be read off the connection before it can be reused for the next request
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				s.applyError(req, *bodyReadError(err), w)
+				return
+			}
+			if err := runMiddlewares(); err != nil {
+				s.applyError(req, *err, w)
+				return
+			}
+			w.Header().Set("Allow", allowHeader(handlers))
+			req.ResponseCode = http.StatusNoContent
+			w.WriteHeader(req.ResponseCode)
+			s.logRequest(req)
+			return
+		} else if !isset {
+			w.Header().Set("Allow", allowHeader(handlers))
+			s.applyError(req, Error{Code: http.StatusMethodNotAllowed}, w)
 			return
 		}
 
 		// TODO: Error if event-stream and not supported on route...
 		if r.Header.Get("Accept") == "text/event-stream" && route.eventStream != nil {
-			if err := readBody(req, new(B)); err != nil {
+			if err := route.readBody(req, s.BodyVerbs); err != nil {
 				s.Logger.LogError(req, err.Error)
-				s.errorHandler.Apply(req, *err, w)
+				s.applyError(req, *err, w)
 				return
 			}
 
 			err := runMiddlewares()
 			if err != nil {
-				s.errorHandler.Apply(req, *err, w)
+				s.applyError(req, *err, w)
 				return
 			}
 
-			w.Header().Set("Content-Type", "text/event-stream")
-			w.Header().Set("Cache-Control", "no-cache")
-			w.Header().Set("Connection", "keep-alive")
-			// should this be r.Context.Done()?
-			events := route.eventStream(req)
-
-			for evt := range events {
-				_, err := fmt.Fprintf(w, "data: %s\n\n", evt.AsEventStream())
-				if err != nil {
-					s.Logger.LogError(req, fmt.Errorf("Error sending event: %v", err))
-					break
-				}
-
-				w.(http.Flusher).Flush()
-			}
-
+			session.release()
+			s.serveEventStream(req, w, route.eventStream)
 			return
 		}
 
@@ -278,81 +490,77 @@ func ApplyRoute[T any, S any, B any](s *Server[S], Path string, body B, handlers
 
 			err := runMiddlewares()
 			if err != nil {
-				s.errorHandler.Apply(req, *err, w)
+				s.applyError(req, *err, w)
 				return
 			}
 
-			var closedConnectionError = &wsutil.ClosedError{}
-			in := make(chan []byte)
-
-			conn, _, _, upgradeErr := ws.UpgradeHTTP(r, w)
-
-			if upgradeErr != nil {
-				// handle error
-				s.Logger.LogError(req, fmt.Errorf("Error upgrading websocket connection! %v", upgradeErr))
-				s.errorHandler.Apply(req, Error{Code: http.StatusInternalServerError, Error: upgradeErr}, w)
-				return
-			}
-			ctx, cancel := context.WithCancel(req.Context)
-			req.Context = ctx
-			out := route.websocket(req, in)
-
-			// TODO: Configurable keepalive?
-			go func() {
-				defer func() {
-					close(in)
-					cancel()
-				}()
-
-				for {
-					payload, err := wsutil.ReadClientText(conn)
-					if err != nil {
-						// Only really care if it's not a closed connection error...
-						if !errors.As(err, closedConnectionError) {
-							s.Logger.LogError(req, fmt.Errorf("Error reading websocket payload! %v", err))
-						}
-						return
-					}
-					in <- payload
-				}
-			}()
-
-			for msg := range out {
-				// TODO: Allow for Binary vs Text messages
-				wsErr := wsutil.WriteServerMessage(conn, ws.OpText, msg)
-				if err != nil {
-					s.Logger.LogError(req, fmt.Errorf("Error writing message: %v", wsErr))
+			// Upgrades beyond the server's or route's limit are turned away before any goroutines are started for them
+			for _, limit := range []semaphore{s.websocketConnections, route.websocketConns} {
+				if limit == nil {
+					continue
+				} else if !limit.acquire(req.Context, 0) {
+					s.applyError(req, Error{Code: http.StatusServiceUnavailable}, w)
+					return
 				}
-
+				defer limit.release()
 			}
+
+			session.release()
+			s.serveWebsocket(req, w, r, route.websocket)
 			return
 		}
 
-		responseInterface := s.determineResponseInterface(r.Header.Get("Accept"), implements)
+		responseInterface := s.negotiate(req, implements, route.defaultContentType)
+		req.responseType = responseInterface
 
-		if responseInterface == nil {
+		if responseInterface == nil && !isReader && !isInterface && !isNoContentType {
 			// if T implements io.Reader then interface will be that
-			if !isReader {
-				s.errorHandler.Apply(req, Error{Code: http.StatusNotAcceptable}, w)
-				return
-			}
+			s.applyError(req, Error{Code: http.StatusNotAcceptable}, w)
+			return
 		}
 
-		if err := readBody(req, new(B)); err != nil {
+		if err := route.readBody(req, s.BodyVerbs); err != nil {
 			s.Logger.LogError(req, err.Error)
-			s.errorHandler.Apply(req, *err, w)
+			s.applyError(req, *err, w)
 			return
 		}
 
 		if err := runMiddlewares(); err != nil {
-			s.errorHandler.Apply(req, *err, w)
+			s.applyError(req, *err, w)
+			return
+		} else if req.written {
+			// A middleware (such as ResponseCache) has responded itself
+			s.logRequest(req)
 			return
 		}
 
+		if route.concurrency != nil {
+			if !route.concurrency.acquire(req.Context, route.concurrencyWait) {
+				s.applyError(req, Error{Code: http.StatusServiceUnavailable}, w)
+				return
+			}
+			defer route.concurrency.release()
+		}
+
+		req.saveSession = func() error {
+			session.Data = req.Session.(*S)
+			return session.save(req.Context)
+		}
 		response, err := handler(req)
+		if !req.written && errors.Is(req.Context.Err(), context.DeadlineExceeded) {
+			// The handler overran its deadline (see Timeout), so whatever it returned is discarded
+			err = &Error{Code: http.StatusServiceUnavailable, Error: req.Context.Err()}
+		}
 
-		if err != nil {
-			s.errorHandler.Apply(req, *err, w)
+		if req.written {
+			// The handler has responded itself, so it's too late to send an error
+			if err != nil {
+				s.Logger.LogError(req, fmt.Errorf("Error %d returned after responding: %v", err.Code, err.Error))
+			}
+			s.logRequest(req)
+			return
+		} else if err != nil {
+			s.applyError(req, *err, w)
 			return
 		} else {
 
@@ -360,35 +568,92 @@ func ApplyRoute[T any, S any, B any](s *Server[S], Path string, body B, handlers
 				req.ResponseCode = 200
 			}
 
+			noContent := isNoContent(response)
+			if noContent {
+				responseInterface = nil
+				req.responseType = nil
+				if req.ResponseCode == http.StatusOK {
+					req.ResponseCode = http.StatusNoContent
+				}
+			} else if isInterface {
+				responseInterface = s.negotiate(req, s.implementsMap(reflect.TypeOf(response)), route.defaultContentType)
+				req.responseType = responseInterface
+			}
+
+			if responseInterface == ndjsonerInterface {
+				// Streamed as it's produced, so the session is saved before anything is sent
+				session.Data = req.Session.(*S)
+				if err := session.save(req.Context); errors.Is(err, ErrSessionConflict) {
+					s.applyError(req, Error{Code: http.StatusConflict, Error: err}, w)
+					return
+				} else if err != nil {
+					s.Logger.LogError(req, fmt.Errorf("Error saving session: %v", err))
+				}
+				if err := streamNDJson(req, any(response).(NDJsoner).AsNDJson()); err != nil {
+					s.Logger.LogError(req, fmt.Errorf("Error streaming response: %v", err))
+				}
+				s.logRequest(req)
+				return
+			}
+
 			var b []byte
-			if responseInterface != nil {
+			if noContent {
+				// Nothing to deliver
+			} else if responseInterface != nil {
 				b = deliverContentAsInterface(response, responseInterface)
 
+			} else if rdr, ok := (interface{})(response).(io.Reader); !ok {
+				s.applyError(req, Error{Code: http.StatusNotAcceptable}, w)
+				return
 			} else {
-				rdr := (interface{})(response).(io.Reader)
-				var rdrErr error
-				b, rdrErr = io.ReadAll(rdr)
+				req.responseBuffer = getBuffer()
+				_, rdrErr := req.responseBuffer.ReadFrom(rdr)
+				b = req.responseBuffer.Bytes()
 				if rdrErr != nil {
-					s.Logger.LogError(req, fmt.Errorf("Error reading from Reader: %v", err))
-					s.errorHandler.Apply(req, Error{Code: http.StatusInternalServerError}, w)
+					s.Logger.LogError(req, fmt.Errorf("Error reading from Reader: %v", rdrErr))
+					s.applyError(req, Error{Code: http.StatusInternalServerError}, w)
 					return
 				}
 			}
 
 			session.Data = req.Session.(*S)
-			err := session.save(context.TODO())
-
-			if err != nil {
+			err := session.save(req.Context)
+			if errors.Is(err, ErrSessionConflict) {
+				// Another request saved the session first, so this one's changes can't be kept
+				s.applyError(req, Error{Code: http.StatusConflict, Error: err}, w)
+				return
+			} else if err != nil {
 				s.Logger.LogError(req, fmt.Errorf("Error saving session: %v", err))
 			}
 
+			if responseInterface != nil {
+				addVary(req.ResponseHeaders, "Accept")
+				setContentType(req.ResponseHeaders, s.interfaceContentTypes, responseInterface)
+			}
+			addVary(req.ResponseHeaders, "Accept-Encoding")
+
+			if route.etag && req.Verb == GET && req.ResponseCode == http.StatusOK {
+				etag := req.ResponseHeaders.Get("ETag")
+				if etag == "" {
+					etag = contentETag(b)
+					req.ResponseHeaders.Set("ETag", etag)
+				}
+				if etagMatch(r.Header.Get("If-None-Match"), etag) {
+					req.ResponseCode = http.StatusNotModified
+					w.WriteHeader(req.ResponseCode)
+					s.logRequest(req)
+					return
+				}
+			}
+
+			req.responseBody = b
 			req.responseSize = uint(len(b))
-			err = writeWithContentEncoding(b, r.Header.Get("Accept-Encoding"), w, req.ResponseCode)
+			err = writeWithContentEncoding(b, req, w, req.ResponseCode)
 			if err != nil {
 				s.Logger.LogError(req, fmt.Errorf("Error writing response content: %v", err))
 			}
 
-			s.Logger.LogRequest(req)
+			s.logRequest(req)
 		}
 	})
 
@@ -396,141 +661,250 @@ func ApplyRoute[T any, S any, B any](s *Server[S], Path string, body B, handlers
 
 }
 
-func writeWithContentEncoding(content []byte, acceptEncodingHeader string, w http.ResponseWriter, statusCode int) error {
-	if len(content) == 0 {
-		return nil
+// Responds to a request whose processing panicked (or was aborted), so one bad request can't take down the server.
+// Must be deferred directly.
+func (s *Server[S]) recoverRequest(req *Request, w http.ResponseWriter) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	if p == http.ErrAbortHandler {
+		// net/http's own signal to abandon the response
+		panic(p)
 	}
-	var writer io.Writer = w
-
-	encodings := strings.Split(acceptEncodingHeader, ",")
-ENCODINGLOOP:
-	for _, encoding := range encodings {
-		switch strings.TrimSpace(encoding) {
-		case "gzip":
-			w.Header().Set("Content-Encoding", "gzip")
-			encoding := gzip.NewWriter(w)
-			defer encoding.Flush()
-			writer = encoding
-			break ENCODINGLOOP
-		case "deflate":
-			w.Header().Set("Content-Encoding", "deflate")
-			encoding, _ := flate.NewWriter(w, flate.DefaultCompression)
-			defer encoding.Flush()
-			writer = encoding
-			break ENCODINGLOOP
-		case "br":
-			w.Header().Set("Content-Encoding", "br")
-			encoding := brotli.NewWriter(w)
-			defer encoding.Flush()
-			writer = encoding
-			break ENCODINGLOOP
-		case "identity":
-			break
-			// TODO: case "compress":
-			// TODO: case "zstd":
 
-		}
+	if abort, ok := p.(abortSignal); ok && req.written {
+		s.Logger.LogError(req, fmt.Errorf("Request aborted with %d after responding: %v", abort.err.Code, abort.err.Error))
+		return
+	} else if ok {
+		s.applyError(req, abort.err, w)
+		return
 	}
-	w.WriteHeader(statusCode)
-	_, err := writer.Write(content)
-	return err
+
+	err := fmt.Errorf("panic: %v", p)
+	s.Logger.LogPanic(req, p)
+	if s.ErrorReporter != nil {
+		s.ErrorReporter.Report(req, err, debug.Stack())
+	}
+	if req.written {
+		// The response is already underway, so can't be replaced with an error
+		return
+	}
+	s.errorHandler.Apply(req, Error{Code: http.StatusInternalServerError, Error: err}, w)
 }
 
-func (s *Server[S]) PublicRoute(dirPath string, pathPrefix string) {
-	// Read all subdirectories of dirPath
-	// for each directory found, create route at pathPrefix/directory
+// Responds to req with err via the error handler, reporting server errors to the ErrorReporter
+func (s *Server[S]) applyError(req *Request, err Error, w http.ResponseWriter) {
+	if err.Code >= 500 && s.ErrorReporter != nil {
+		reported := err.Error
+		if reported == nil {
+			reported = errors.New(http.StatusText(int(err.Code)))
+		}
+		s.ErrorReporter.Report(req, reported, nil)
+	}
+	s.errorHandler.Apply(req, err, w)
+}
 
-	if !strings.HasSuffix(pathPrefix, "/") {
-		pathPrefix += "/"
+// ServeHTTP is the entrypoint for every request the server receives, prior to route matching.
+func (s *Server[S]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Close || s.CloseConnections {
+		// net/http closes the connection once the response is written
+		w.Header().Set("Connection", "close")
 	}
 
-	fileHashMap := map[string]string{}
-	_ = fileHashMap
+	if s.MaxURILength > 0 && uint(len(r.RequestURI)) > s.MaxURILength {
+		s.serveError(w, r, Error{Code: http.StatusRequestURITooLong})
+		return
+	}
 
-	fs.WalkDir(os.DirFS(dirPath), ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			log.Fatal(err)
+	s.rewrite(r)
+	if s.inMaintenance(r) {
+		s.serveError(w, r, Error{Code: http.StatusServiceUnavailable})
+		return
+	}
+	if s.inFlight != nil && r.Header.Get("Upgrade") != "websocket" && r.Header.Get("Accept") != "text/event-stream" {
+		// The request is timed from its arrival, not from when it's let through
+		r = r.WithContext(context.WithValue(r.Context(), requestStartKey{}, time.Now()))
+		if !s.inFlight.acquire(r.Context(), s.inFlightWait) {
+			s.serveError(w, r, Error{Code: http.StatusServiceUnavailable, RetryAfter: s.inFlightRetryAfter})
+			return
 		}
+		defer s.inFlight.release()
+	}
 
-		if path == "." {
-			return nil
+	_, pattern := s.mux.Handler(r)
+	if pattern != r.URL.Path && (s.TrailingSlash != TrailingSlashStrict || len(s.trailingSlashes) > 0) {
+		if path, policy := s.trailingSlashAlternative(r); policy == TrailingSlashRedirect {
+			u := *r.URL
+			u.Path, u.RawPath = path, ""
+			http.Redirect(w, r, u.RequestURI(), permanentRedirectCode(r))
+			return
+		} else if policy == TrailingSlashEquivalent {
+			r.URL.Path, r.URL.RawPath = path, ""
+			pattern = path
 		}
+	}
 
-		if strings.Contains(path, "/") {
-			return fs.SkipDir
-		}
+	if pattern == "" {
+		// No route matches, so respond with the error handler rather than ServeMux's plain text 404
+		s.serveError(w, r, Error{Code: http.StatusNotFound})
+		return
+	}
 
-		ApplyRoute(s, pathPrefix+path+"/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
-			GET: func(req *Request) (*bytes.Buffer, *Error) {
-				hashCheck := req.Headers.Get("If-None-Match")
-				if hashCheck > "" && fileHashMap[req.Path] == hashCheck {
-					// return 304
-					req.ResponseCode = http.StatusNotModified
-					return new(bytes.Buffer), nil
-				}
+	s.mux.ServeHTTP(w, r)
+}
 
-				b, err := os.ReadFile(dirPath + req.Path)
-				if err != nil {
-					var internalServerError Error
-					if errors.Is(err, os.ErrNotExist) {
-						s.Logger.LogError(req, fmt.Errorf("FILE NOT FOUND!!"))
-						internalServerError = Error{Code: http.StatusNotFound}
-					} else {
-						internalServerError = Error{Code: http.StatusInternalServerError}
-					}
-
-					return nil, &internalServerError
-				}
+// Responds with err for requests which never made it to a route
+func (s *Server[S]) serveError(w http.ResponseWriter, r *http.Request, err Error) {
+	req := newRequest(w, r)
+	req.logger = s.Logger
+	req.locales = s.locales
+	req.Verb, _ = ParseVerb(r.Method)
+	s.applyError(req, err, w)
+	s.runPostMiddlewares(req, nil)
+}
 
-				// Set ETag to md5 of file
-				etag := fmt.Sprintf("%x", md5.Sum(b))
-				fileHashMap[req.Path] = etag
+// Writes statusCode and content as the response to req, compressed according to its Accept-Encoding header.
+// Responses which can't have a body (to HEAD requests, or with a 1xx, 204 or 304 status) are sent without one.
+func writeWithContentEncoding(content []byte, req *Request, w http.ResponseWriter, statusCode int) error {
+	if !bodyAllowed(req.Verb, statusCode) {
+		w.Header().Del("Content-Encoding")
+		if req.Verb == HEAD && bodyAllowed(GET, statusCode) {
+			// The length of the body a GET would have had, albeit uncompressed
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		}
+		w.WriteHeader(statusCode)
+		return nil
+	}
+	if len(content) == 0 {
+		w.WriteHeader(statusCode)
+		return nil
+	}
+	writer, release := contentEncoder(req, w)
+	w.WriteHeader(statusCode)
+	_, err := writer.Write(content)
+	if release != nil {
+		if closeErr := release(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
 
-				// Perform a hash check again, in case fileHashMap simply hadn't been initialized..
-				if hashCheck == etag {
-					req.ResponseCode = http.StatusNotModified
-					return new(bytes.Buffer), nil
-				}
-				req.ResponseHeaders.Add("ETag", etag)
-				return bytes.NewBuffer(b), nil
-			},
-		})
+// Returns a writer compressing the response to req according to its Accept-Encoding header, having set the response's
+// Content-Encoding, along with a function to finish compressing. If no encoding is accepted, w is returned as is
+// with a nil function.
+func contentEncoder(req *Request, w http.ResponseWriter) (io.Writer, func() error) {
+	if req.noCompression || matchesMediaType(w.Header().Get("Content-Type"), req.uncompressedTypes) {
+		return w, nil
+	}
+	addVary(w.Header(), "Accept-Encoding")
+	// TODO: "compress", "zstd"
+	for _, encoding := range strings.Split(req.Headers.Get("Accept-Encoding"), ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoder, release, ok := getEncoder(encoding, w); ok {
+			w.Header().Set("Content-Encoding", encoding)
+			return encoder, release
+		}
+	}
+	return w, nil
+}
 
-		return nil
-	})
+// Reports whether contentType's media type is one of mediaTypes, or begins with one ending in "/"
+func matchesMediaType(contentType string, mediaTypes []string) bool {
+	if len(mediaTypes) == 0 || contentType == "" {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, candidate := range mediaTypes {
+		candidate = strings.ToLower(candidate)
+		if mediaType == candidate || (strings.HasSuffix(candidate, "/") && strings.HasPrefix(mediaType, candidate)) {
+			return true
+		}
+	}
+	return false
+}
 
+// Whether a response with statusCode to a verb request may have a body
+func bodyAllowed(verb Verb, statusCode int) bool {
+	if verb == HEAD {
+		return false
+	}
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+// Adds names to the Vary header, skipping any it already lists
+func addVary(header http.Header, names ...string) {
+	existing := map[string]bool{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			existing[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for _, name := range names {
+		if !existing[name] && !existing["*"] {
+			header.Add("Vary", name)
+			existing[name] = true
+		}
+	}
 }
 
 // Starts listening on the server
 // Returns host and port used (in case 0 is returned), or error if there is one
 func (s *Server[S]) Start(addr string) (string, uint, error) {
+	l, err := s.Listen(addr, s.SecureConfig)
+	if err != nil {
+		return "", 0, err
+	}
+	return l.Host, l.Port, nil
+}
 
-	// Listen on the specified address.
+// StartRedirect listens on addr for plain HTTP requests, redirecting each to its https:// equivalent on the same host,
+// preserving path and query. httpsPort is the port the secure server was started on, omitted from the redirect if 443.
+// GET and HEAD requests are redirected with a 301, others with a 308 so the method and body are kept.
+// When AutoCert is in use, ACME challenges are answered rather than redirected.
+// Returns host and port used, or error if there is one.
+func (s *Server[S]) StartRedirect(addr string, httpsPort uint) (string, uint, error) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return "", 0, err
 	}
 
-	if s.SecureConfig != nil {
-		l = tls.NewListener(l, s.SecureConfig)
+	var handler http.Handler = httpsRedirect(httpsPort)
+	if s.certManager != nil {
+		handler = s.certManager.HTTPHandler(handler)
 	}
 
-	addrParts := strings.Split(l.Addr().String(), ":")
+	listener := s.serve(l, handler)
+	return listener.Host, listener.Port, nil
+}
 
-	go func() {
-		defer l.Close()
-		server := http.Server{
-			Handler: s.mux,
+func httpsRedirect(httpsPort uint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			// IPv6 literal without a port, bracketed again below
+			host = host[1 : len(host)-1]
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.FormatUint(uint64(httpsPort), 10))
+		} else if strings.Contains(host, ":") {
+			// IPv6 literal
+			host = "[" + host + "]"
 		}
-		server.Serve(l)
-	}()
 
-	// parse the port to a uint
-	var port uint
-	for _, r := range addrParts[1] {
-		port = (port * 10) + uint(r-'0')
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), permanentRedirectCode(r))
 	}
+}
 
-	return addrParts[0], port, nil
-
+// Returns 301 Moved Permanently for GET and HEAD requests. Other methods get 308 Permanent Redirect, which (unlike 301)
+// clients must repeat with the same method and body.
+func permanentRedirectCode(r *http.Request) int {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return http.StatusPermanentRedirect
+	}
+	return http.StatusMovedPermanently
 }
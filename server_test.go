@@ -1,13 +1,38 @@
 package webserver
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TestXmler interface {
@@ -33,6 +58,16 @@ func TestDetermineResponseInterface(t *testing.T) {
 		{"text/html", map[string]bool{"html": true}, reflect.TypeOf((*Htmler)(nil)).Elem()},
 		{"text/*", map[string]bool{"text": true}, reflect.TypeOf((*TestTexter)(nil)).Elem()},
 		{"DONTPANIC", map[string]bool{"text/xml": true}, nil},
+		{"text/html, application/json", map[string]bool{"json": true}, reflect.TypeOf((*Jsoner)(nil)).Elem()},
+		{"text/html;q=0.5, application/json", map[string]bool{"html": true, "json": true}, reflect.TypeOf((*Jsoner)(nil)).Elem()},
+		{"text/html;level=1;q=0.9, application/json;q=0.9", map[string]bool{"html": true, "json": true}, reflect.TypeOf((*Htmler)(nil)).Elem()},
+		{"text/html;q=0, */*", map[string]bool{"html": true}, nil},
+		{"*/*", map[string]bool{"json": true}, reflect.TypeOf((*Jsoner)(nil)).Elem()},
+		{"*/*", map[string]bool{"html": true, "json": true}, reflect.TypeOf((*Htmler)(nil)).Elem()},
+		{"text/html;q=0, */*", map[string]bool{"html": true, "json": true}, reflect.TypeOf((*Jsoner)(nil)).Elem()},
+		{"application/*", map[string]bool{"html": true, "json": true}, reflect.TypeOf((*Jsoner)(nil)).Elem()},
+		{"text/*", map[string]bool{"json": true}, nil},
+		{"text/*", map[string]bool{"text/xml": true, "json": true}, reflect.TypeOf((*TestXmler)(nil)).Elem()},
 	} {
 
 		responseType := server.determineResponseInterface(test.header, test.implementsMap)
@@ -44,14 +79,4258 @@ func TestDetermineResponseInterface(t *testing.T) {
 
 }
 
+func BenchmarkDetermineResponseInterface(b *testing.B) {
+	server := New[Sessionless](nil)
+	implementsMap := map[string]bool{"html": true, "json": true}
+	header := "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8"
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		server.determineResponseInterface(header, implementsMap)
+	}
+}
+
+func TestMaxURILength(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.MaxURILength = 64
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	for _, test := range []struct {
+		path     string
+		expected int
+	}{
+		{"/", http.StatusOK},
+		{"/" + strings.Repeat("a", 63), http.StatusOK},
+		{"/" + strings.Repeat("a", 64), http.StatusRequestURITooLong},
+		{"/?q=" + strings.Repeat("a", 64), http.StatusRequestURITooLong},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.expected {
+			t.Errorf("Did not return expected status [%d] for path of length %d\n\tReturned: %d", test.expected, len(test.path), w.Code)
+		}
+	}
+}
+
+// Writes files (keyed by path relative to dir) to a temporary directory, returning the directory
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unable to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write file: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	server := New[Sessionless](Sessionless{})
+	server.Logger = NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	ApplyRoute(server, "/greet/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			req.Log().With("user", "bob").Message("greeting")
+			return bytes.NewBufferString("Hello"), nil
+		},
+	})
+	r := httptest.NewRequest("GET", "/greet/bob", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	var records []map[string]any
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("Unable to decode log record: %v", err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 log records, received %d", len(records))
+	}
+
+	for idx, expected := range []map[string]any{
+		{"level": "INFO", "msg": "greeting", "verb": "GET", "path": "/greet/bob", "route": "/greet/", "user": "bob"},
+		{"level": "INFO", "msg": "request", "verb": "GET", "path": "/greet/bob", "route": "/greet/", "user": "bob", "status": 200.0, "bytes_out": 5.0, "client_ip": "192.0.2.1", "proto": "HTTP/1.1"},
+	} {
+		for key, value := range expected {
+			if records[idx][key] != value {
+				t.Errorf("Record %d: expected %s to be %v, received %v", idx, key, value, records[idx][key])
+			}
+		}
+	}
+	for _, key := range []string{"duration", "request_id", "user_agent"} {
+		if _, isset := records[1][key]; !isset {
+			t.Errorf("Expected request record to include %s", key)
+		}
+	}
+}
+
+func TestSlogLoggerUnknownMethod(t *testing.T) {
+	var buf bytes.Buffer
+	server := New[Sessionless](Sessionless{})
+	server.Logger = NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	ApplyErrorHandler(server, func(req *Request, err Error) *bytes.Buffer {
+		return bytes.NewBufferString(http.StatusText(int(err.Code)))
+	})
+	ApplyRoute(server, "/x", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"FOO", "/x", http.StatusNotImplemented},
+		{"FOO", "/nope", http.StatusNotFound},
+		{"GET", "/nope", http.StatusNotFound},
+	} {
+		buf.Reset()
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d, received %d", test.method, test.path, test.code, w.Code)
+		}
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("%s %s: unable to decode log record %q: %v", test.method, test.path, buf.String(), err)
+		}
+		if record["verb"] != test.method || record["status"] != float64(test.code) {
+			t.Errorf("%s %s: expected the method and status to be logged, received %v", test.method, test.path, record)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	server := New[Sessionless](Sessionless{})
+	server.Tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	var handlerSpan trace.SpanContext
+	ApplyRoute(server, "/items/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			handlerSpan = trace.SpanContextFromContext(req.Context)
+			if req.Path == "/items/broken" {
+				return nil, &Error{Code: http.StatusInternalServerError}
+			}
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	r := httptest.NewRequest("GET", "/items/42", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	server.ServeHTTP(httptest.NewRecorder(), r)
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items/broken", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, received %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /items/" || span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("Unexpected span name [%s] or kind [%v]", span.Name(), span.SpanKind())
+	}
+	if span.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || span.SpanContext().TraceID() != span.Parent().TraceID() {
+		t.Errorf("Span did not continue the propagated trace, parent is %v", span.Parent())
+	}
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes() {
+		attributes[attr.Key] = attr.Value
+	}
+	if attributes["http.request.method"].AsString() != "GET" || attributes["http.route"].AsString() != "/items/" || attributes["http.response.status_code"].AsInt64() != 200 {
+		t.Errorf("Unexpected span attributes %v", attributes)
+	}
+
+	if spans[1].Status().Code != codes.Error {
+		t.Errorf("Expected a 500 to mark the span as an error, received status %v", spans[1].Status())
+	}
+	if handlerSpan.SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("Expected the span to be available from the handler's context")
+	}
+}
+
+func TestStartRedirect(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	host, port, err := server.StartRedirect("127.0.0.1:0", 8443)
+	if err != nil {
+		t.Fatalf("Unable to start redirect listener: %v", err)
+	}
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	base := fmt.Sprintf("http://%s:%d", host, port)
+
+	for _, test := range []struct {
+		method   string
+		path     string
+		code     int
+		location string
+	}{
+		{"GET", "/", http.StatusMovedPermanently, "https://127.0.0.1:8443/"},
+		{"GET", "/a/b?c=d&e=f", http.StatusMovedPermanently, "https://127.0.0.1:8443/a/b?c=d&e=f"},
+		{"POST", "/form", http.StatusPermanentRedirect, "https://127.0.0.1:8443/form"},
+	} {
+		r, _ := http.NewRequest(test.method, base+test.path, nil)
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("Unable to request %s: %v", test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code || resp.Header.Get("Location") != test.location {
+			t.Errorf("%s %s: expected %d to %s, received %d to %s", test.method, test.path, test.code, test.location, resp.StatusCode, resp.Header.Get("Location"))
+		}
+	}
+
+	// The standard HTTPS port is left implied
+	for _, test := range []struct {
+		host     string
+		port     uint
+		location string
+	}{
+		{"example.com:80", 443, "https://example.com/page"},
+		{"example.com", 443, "https://example.com/page"},
+		{"[::1]:80", 443, "https://[::1]/page"},
+		{"[::1]", 443, "https://[::1]/page"},
+		{"[::1]", 8443, "https://[::1]:8443/page"},
+		{"[2001:db8::1]:8080", 8443, "https://[2001:db8::1]:8443/page"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/page", nil)
+		r.Host = test.host
+		httpsRedirect(test.port)(w, r)
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Host %s: expected redirect to %s, received %s", test.host, test.location, location)
+		}
+	}
+}
+
+func TestStartAddr(t *testing.T) {
+	for _, test := range []struct {
+		addr string
+		host string
+	}{
+		{"127.0.0.1:0", "127.0.0.1"},
+		{"[::1]:0", "::1"},
+	} {
+		if test.host == "::1" {
+			if l, err := net.Listen("tcp", test.addr); err != nil {
+				t.Logf("Skipping %s, IPv6 is unavailable: %v", test.addr, err)
+				continue
+			} else {
+				l.Close()
+			}
+		}
+
+		server := New[Sessionless](Sessionless{})
+		ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				return bytes.NewBufferString("OK"), nil
+			},
+		})
+		host, port, err := server.Start(test.addr)
+		if err != nil {
+			t.Fatalf("Unable to start server on %s: %v", test.addr, err)
+		}
+		defer server.Shutdown(context.Background())
+		if host != test.host || port == 0 {
+			t.Errorf("Expected %s to start on host %s with a port assigned, received %s port %d", test.addr, test.host, host, port)
+			continue
+		}
+
+		resp, err := http.Get("http://" + net.JoinHostPort(host, strconv.Itoa(int(port))) + "/")
+		if err != nil {
+			t.Errorf("Unable to request server started on %s: %v", test.addr, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "OK" {
+			t.Errorf("Expected OK from server started on %s, received %q", test.addr, body)
+		}
+	}
+}
+
+func TestListenersShutdown(t *testing.T) {
+	// Borrow httptest's self-signed certificate, along with a client trusting it
+	tlsServer := httptest.NewTLSServer(nil)
+	secureConfig := tlsServer.TLS.Clone()
+	client := tlsServer.Client()
+	tlsServer.Close()
+
+	server := New[Sessionless](Sessionless{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			if req.Headers.Get("X-Slow") != "" {
+				close(started)
+				<-release
+			}
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	plain, err := server.Listen("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("Unable to listen over HTTP: %v", err)
+	}
+	secure, err := server.Listen("127.0.0.1:0", secureConfig)
+	if err != nil {
+		t.Fatalf("Unable to listen over HTTPS: %v", err)
+	}
+	plainURL := fmt.Sprintf("http://%s:%d/", plain.Host, plain.Port)
+	secureURL := fmt.Sprintf("https://%s:%d/", secure.Host, secure.Port)
+
+	for _, url := range []string{plainURL, secureURL} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Unable to request %s: %v", url, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "OK" {
+			t.Errorf("Expected OK from %s, received %q", url, body)
+		}
+	}
+
+	// A request in progress is allowed to finish
+	slowBody := make(chan string)
+	go func() {
+		r, _ := http.NewRequest("GET", plainURL, nil)
+		r.Header.Set("X-Slow", "1")
+		resp, err := client.Do(r)
+		if err != nil {
+			slowBody <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		slowBody <- string(body)
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if body := <-slowBody; body != "OK" {
+		t.Errorf("Expected in progress request to complete, received %q", body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Unexpected error shutting down: %v", err)
+	}
+	for _, listener := range []*Listener{plain, secure} {
+		if err := listener.Wait(); err != nil {
+			t.Errorf("Expected listener to stop cleanly, received %v", err)
+		}
+	}
+	if _, err := client.Get(plainURL); err == nil {
+		t.Errorf("Expected requests to fail once shut down")
+	}
+}
+
+type testContextKey struct{}
+
+func TestBaseContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), testContextKey{}, "shared"))
+	defer cancel()
+	server := New[Sessionless](Sessionless{})
+	server.BaseContext = ctx
+	started := make(chan struct{})
+	ApplyRoute(server, "/value", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			value, _ := req.Context.Value(testContextKey{}).(string)
+			return bytes.NewBufferString(value), nil
+		},
+	})
+	ApplyRoute(server, "/wait", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			close(started)
+			<-req.Context.Done()
+			return nil, &Error{Code: http.StatusServiceUnavailable}
+		},
+	})
+
+	listener, err := server.Listen("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+	baseURL := fmt.Sprintf("http://%s:%d", listener.Host, listener.Port)
+
+	resp, err := http.Get(baseURL + "/value")
+	if err != nil {
+		t.Fatalf("Unable to request /value: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "shared" {
+		t.Errorf("Expected the request context to descend from BaseContext, received %q", body)
+	}
+
+	// Cancelling the base context cancels requests in progress
+	code := make(chan int)
+	go func() {
+		resp, err := http.Get(baseURL + "/wait")
+		if err != nil {
+			code <- 0
+			return
+		}
+		resp.Body.Close()
+		code <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+	select {
+	case received := <-code:
+		if received != http.StatusServiceUnavailable {
+			t.Errorf("Expected the cancelled request to return 503, received %d", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Request in progress wasn't cancelled along with the base context")
+	}
+}
+
+func TestAutoCert(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.AutoCert(t.TempDir(), "example.com")
+	if server.SecureConfig == nil || server.SecureConfig.GetCertificate == nil {
+		t.Fatalf("Expected AutoCert to configure SecureConfig with GetCertificate")
+	}
+
+	host, port, err := server.StartRedirect("127.0.0.1:0", 443)
+	if err != nil {
+		t.Fatalf("Unable to start redirect listener: %v", err)
+	}
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for path, expected := range map[string]int{
+		"/page": http.StatusMovedPermanently,
+		// An unknown token, but answered rather than redirected
+		"/.well-known/acme-challenge/token": http.StatusNotFound,
+	} {
+		r, _ := http.NewRequest("GET", fmt.Sprintf("http://%s:%d%s", host, port, path), nil)
+		r.Host = "example.com"
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatalf("Unable to request %s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("Expected %d for %s, received %d", expected, path, resp.StatusCode)
+		}
+	}
+}
+
+func TestPublicRoutePrecedence(t *testing.T) {
+	override := writeTestFiles(t, map[string]string{
+		"css/style.css": "override",
+		"robots.txt":    "override robots",
+	})
+	base := writeTestFiles(t, map[string]string{
+		"css/style.css": "base",
+		"css/other.css": "base other",
+		"js/main.js":    "base js",
+	})
+
+	server := New[Sessionless](Sessionless{})
+	server.PublicRoute(override, "/static")
+	server.PublicRoute(base, "/static")
+
+	for _, test := range []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{"/static/css/style.css", http.StatusOK, "override"},
+		{"/static/css/other.css", http.StatusOK, "base other"},
+		{"/static/js/main.js", http.StatusOK, "base js"},
+		{"/static/robots.txt", http.StatusOK, "override robots"},
+		{"/static/css/missing.css", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("Did not return expected response [%d %q] for path [%s]\n\tReturned: %d %q", test.code, test.expected, test.path, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Records everything logged, for tests to inspect
+type testLogger struct {
+	mu       sync.Mutex
+	requests []*Request
+	messages []string
+	errors   []error
+}
+
+func (logger *testLogger) LogRequest(req *Request) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.requests = append(logger.requests, req)
+}
+func (logger *testLogger) LogMessage(req *Request, msg any) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.messages = append(logger.messages, fmt.Sprintf("%v%s", msg, formatLogFields(req)))
+}
+func (logger *testLogger) LogPanic(req *Request, p any) {
+	logger.LogMessage(req, p)
+}
+func (logger *testLogger) LogError(req *Request, err error) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.errors = append(logger.errors, err)
+}
+
+func TestRequestLogFields(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	server.Middleware(func(req *Request) *Error {
+		req.Log().With("user", "alice")
+		return nil
+	})
+	route := ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			req.Log().Message("handled")
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+	route.Middleware(func(req *Request) *Error {
+		req.Log().With("role", "admin")
+		return nil
+	})
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	expected := []string{"handled user=alice role=admin"}
+	if !reflect.DeepEqual(logger.messages, expected) {
+		t.Errorf("Did not log expected messages %q\n\tLogged: %q", expected, logger.messages)
+	}
+}
+
+func TestDefaultLoggerFields(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(func(req *Request) *Error {
+		req.Log().With("user", "alice")
+		return nil
+	})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			panic("something went wrong")
+		},
+	})
+
+	// Requests are logged to stdout, panics through the log package
+	var panics bytes.Buffer
+	log.SetOutput(&panics)
+	defer log.SetOutput(os.Stderr)
+	rdr, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unable to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = wr
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	os.Stdout = stdout
+	wr.Close()
+	requests, _ := io.ReadAll(rdr)
+
+	if !strings.HasSuffix(string(requests), " user=alice\n") {
+		t.Errorf("Expected request log line to carry the request's fields, logged %q", requests)
+	}
+	if !strings.HasSuffix(panics.String(), "something went wrong user=alice\n") {
+		t.Errorf("Expected panic log line to carry the request's fields, logged %q", panics.String())
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	ApplyErrorHandler(server, func(req *Request, err Error) *bytes.Buffer {
+		return bytes.NewBufferString(http.StatusText(int(err.Code)))
+	})
+	cause := errors.New("inventory service unreachable")
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			if req.Headers.Get("X-Fail") != "" {
+				return nil, &Error{Code: http.StatusBadGateway, Error: cause}
+			}
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Fail", "1")
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(logger.requests) != 2 {
+		t.Fatalf("Expected 2 logged requests, received %d", len(logger.requests))
+	}
+	if err := logger.requests[0].ResponseError(); err != nil {
+		t.Errorf("Expected no error for a successful request, received %v", err)
+	}
+	if req := logger.requests[1]; req.ResponseCode != http.StatusBadGateway || req.ResponseError() != cause {
+		t.Errorf("Expected 502 logged with its cause, received %d %v", req.ResponseCode, req.ResponseError())
+	}
+}
+
+func TestAccessLogPolicy(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	server.AccessLog = AccessLogPolicy{
+		SkipPaths:  []string{"/healthz", "/static/"},
+		SkipVerbs:  []Verb{OPTIONS},
+		SkipStatus: []StatusRange{{Min: 300, Max: 399}},
+	}
+	ApplyErrorHandler(server, func(req *Request, err Error) *bytes.Buffer {
+		return bytes.NewBufferString(http.StatusText(int(err.Code)))
+	})
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		if code, _ := strconv.Atoi(req.Headers.Get("X-Status")); code >= 400 {
+			return nil, &Error{Code: uint(code)}
+		} else if code > 0 {
+			req.ResponseCode = code
+		}
+		return bytes.NewBufferString("OK"), nil
+	}
+	for _, path := range []string{"/", "/healthz", "/static/"} {
+		ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: handler,
+		})
+	}
+
+	for _, test := range []struct {
+		verb, path string
+		status     int
+		logged     bool
+	}{
+		{"GET", "/", 0, true},
+		{"GET", "/healthz", 0, false},
+		{"GET", "/static/app.js", 0, false},
+		{"OPTIONS", "/", 0, false},
+		{"GET", "/", http.StatusNotModified, false},
+		// Errors are logged whatever the path
+		{"GET", "/healthz", http.StatusServiceUnavailable, true},
+		{"GET", "/static/app.js", http.StatusInternalServerError, true},
+	} {
+		logger.requests = nil
+		r := httptest.NewRequest(test.verb, test.path, nil)
+		if test.status > 0 {
+			r.Header.Set("X-Status", strconv.Itoa(test.status))
+		}
+		server.ServeHTTP(httptest.NewRecorder(), r)
+		if logged := len(logger.requests) > 0; logged != test.logged {
+			t.Errorf("%s %s (%d): expected logged to be %v", test.verb, test.path, test.status, test.logged)
+		}
+	}
+
+	// Only a sample of successes is logged, but every error
+	server.AccessLog = AccessLogPolicy{SampleRate: 0.1}
+	logger.requests = nil
+	for i := 0; i < 1000; i++ {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if sampled := len(logger.requests); sampled < 50 || sampled > 200 {
+		t.Errorf("Expected around 100 of 1000 requests logged, received %d", sampled)
+	}
+	logger.requests = nil
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Status", "500")
+		server.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if len(logger.requests) != 10 {
+		t.Errorf("Expected every error logged, received %d of 10", len(logger.requests))
+	}
+}
+
+func TestRegisterVerb(t *testing.T) {
+	propfind := RegisterVerb("PROPFIND")
+	if again := RegisterVerb("propfind"); again != propfind {
+		t.Errorf("Expected registering PROPFIND again to return the same verb")
+	}
+	if verb := RegisterVerb("GET"); verb != GET {
+		t.Errorf("Expected registering GET to return GET, received %v", verb)
+	}
+	if verb, err := ParseVerb("propfind"); err != nil || verb != propfind || verb.String() != "PROPFIND" {
+		t.Errorf("Expected ParseVerb to recognize PROPFIND, received %v %v", verb, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected an invalid method name to panic")
+			}
+		}()
+		RegisterVerb("PROP FIND")
+	}()
+
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/dav/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("file"), nil
+		},
+		propfind: func(req *Request) (*bytes.Buffer, *Error) {
+			req.ResponseCode = http.StatusMultiStatus
+			return bytes.NewBufferString(req.Verb.String()), nil
+		},
+	})
+
+	for _, test := range []struct {
+		method   string
+		expected int
+		allow    string
+	}{
+		{"PROPFIND", http.StatusMultiStatus, ""},
+		{"OPTIONS", http.StatusNoContent, "GET, OPTIONS, PROPFIND"},
+		{"DELETE", http.StatusMethodNotAllowed, "GET, OPTIONS, PROPFIND"},
+		{"MKCOL", http.StatusNotImplemented, ""},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(test.method, "/dav/notes", nil))
+		if w.Code != test.expected || w.Header().Get("Allow") != test.allow {
+			t.Errorf("%s: expected %d with Allow [%s], received %d with Allow [%s]", test.method, test.expected, test.allow, w.Code, w.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestOptionsWithBody(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer conn.Close()
+
+	body := strings.Repeat("x", 1024)
+	fmt.Fprintf(conn, "OPTIONS / HTTP/1.1\r\nHost: test\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	rdr := bufio.NewReader(conn)
+	options, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatalf("Unable to read OPTIONS response: %v", err)
+	}
+	options.Body.Close()
+	if options.StatusCode != http.StatusNoContent || options.Header.Get("Allow") != "GET, POST, OPTIONS" {
+		t.Errorf("Unexpected OPTIONS response: %d Allow: %s", options.StatusCode, options.Header.Get("Allow"))
+	}
+
+	get, err := http.ReadResponse(rdr, nil)
+	if err != nil {
+		t.Fatalf("Unable to read GET response on the same connection: %v", err)
+	}
+	defer get.Body.Close()
+	if get.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected GET response following OPTIONS: %d", get.StatusCode)
+	}
+}
+
+type testEvent int
+
+func (evt testEvent) AsEventStream() []byte {
+	return []byte(fmt.Sprintf("count\n%d", evt))
+}
+
+func TestEventStream(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	route := ApplyRoute(server, "/events", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+	route.EventStream(func(req *Request) <-chan EventStreamer {
+		events := make(chan EventStreamer)
+		go func() {
+			defer close(events)
+			events <- testEvent(2)
+			events <- Event{ID: "1", Name: "tick", Data: "1", Retry: 1500 * time.Millisecond}
+			events <- Event{ID: "2\ndata: forged", Name: "tick\r\n\nevent: forged", Data: "a\r\nb\rc"}
+			events <- Event{Data: "done"}
+		}()
+		return events
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	server.ServeHTTP(w, r)
+
+	expected := "data: count\ndata: 2\n\n" +
+		"id: 1\nevent: tick\nretry: 1500\ndata: 1\n\n" +
+		"id: 2data: forged\nevent: tickevent: forged\ndata: a\ndata: b\ndata: c\n\n" +
+		"data: done\n\n"
+	if w.Body.String() != expected {
+		t.Errorf("Did not stream expected events %q\n\tStreamed: %q", expected, w.Body.String())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Unexpected Content-Type: %s", contentType)
+	}
+
+	// A configured retry hint leads the stream
+	server.EventStreamRetry = 3 * time.Second
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	expected = "retry: 3000\n\n" + expected
+	if w.Body.String() != expected {
+		t.Errorf("Did not stream expected events %q\n\tStreamed: %q", expected, w.Body.String())
+	}
+}
+
+func TestEventStreamHeartbeat(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.EventStreamHeartbeat = 10 * time.Millisecond
+	ApplyRoute(server, "/events", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	}).EventStream(func(req *Request) <-chan EventStreamer {
+		events := make(chan EventStreamer)
+		go func() {
+			defer close(events)
+			time.Sleep(55 * time.Millisecond)
+			events <- Event{Data: "late"}
+		}()
+		return events
+	})
+
+	r := httptest.NewRequest("GET", "/events", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	keepalives := strings.Count(body, ": keepalive\n\n")
+	if keepalives < 2 || !strings.HasSuffix(body, "data: late\n\n") || strings.ReplaceAll(body, ": keepalive\n\n", "") != "data: late\n\n" {
+		t.Errorf("Expected keepalives while idle followed by the event, received %q", body)
+	}
+
+	// None at all when disabled
+	server.EventStreamHeartbeat = 0
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Body.String() != "data: late\n\n" {
+		t.Errorf("Expected no keepalives with the heartbeat disabled, received %q", w.Body.String())
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/events", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	}).EventStream(func(req *Request) <-chan EventStreamer {
+		events := make(chan EventStreamer, 1)
+		events <- Event{Data: "resuming after [" + req.LastEventID() + "]"}
+		close(events)
+		return events
+	})
+
+	for _, test := range []struct {
+		header   []string
+		expected string
+	}{
+		{[]string{"41"}, "41"},
+		{[]string{""}, ""},
+		{nil, ""},
+	} {
+		r := httptest.NewRequest("GET", "/events", nil)
+		r.Header.Set("Accept", "text/event-stream")
+		if test.header != nil {
+			r.Header["Last-Event-Id"] = test.header
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if expected := "data: resuming after [" + test.expected + "]\n\n"; w.Body.String() != expected {
+			t.Errorf("Last-Event-ID %q: expected %q, received %q", test.header, expected, w.Body.String())
+		}
+	}
+}
+
+func TestDisableCompression(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.UncompressedTypes = []string{"image/", "application/zip"}
+	body := strings.Repeat("compressible ", 100)
+	for path, contentType := range map[string]string{
+		"/text":  "text/plain",
+		"/png":   "image/png",
+		"/zip":   "application/zip; name=x",
+		"/blob":  "application/octet-stream",
+		"/plain": "text/plain",
+	} {
+		contentType := contentType
+		route := ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				req.ResponseHeaders.Set("Content-Type", contentType)
+				return bytes.NewBufferString(body), nil
+			},
+		})
+		if path == "/plain" {
+			route.DisableCompression()
+		}
+		if path == "/text" {
+			route.Middleware(func(req *Request) *Error {
+				if req.Headers.Get("Accept") == "text/event-stream" {
+					// A stray header mustn't mark the stream as compressed
+					req.ResponseHeaders.Set("Content-Encoding", "gzip")
+				}
+				return nil
+			})
+			route.EventStream(func(req *Request) <-chan EventStreamer {
+				events := make(chan EventStreamer, 1)
+				events <- Event{Data: "plain"}
+				close(events)
+				return events
+			})
+		}
+	}
+
+	for path, compressed := range map[string]bool{
+		"/text":  true,
+		"/blob":  true,
+		"/png":   false,
+		"/zip":   false,
+		"/plain": false,
+	} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if encoding := w.Header().Get("Content-Encoding"); (encoding == "gzip") != compressed {
+			t.Errorf("%s: expected compressed %v, received Content-Encoding [%s]", path, compressed, encoding)
+		} else if !compressed && w.Body.String() != body {
+			t.Errorf("%s: expected the body uncompressed", path)
+		}
+	}
+
+	// Event streams are never compressed
+	r := httptest.NewRequest("GET", "/text", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != "data: plain\n\n" {
+		t.Errorf("Expected an uncompressed event stream, received Content-Encoding [%s] with %q", w.Header().Get("Content-Encoding"), w.Body.String())
+	}
+}
+
+func TestPublicRouteIndex(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"docs/index.html":     "docs index",
+		"docs/sub/index.html": "sub index",
+		"docs/page.html":      "page",
+		"other/page.html":     "other page",
+	})
+	server := New[Sessionless](Sessionless{})
+	server.PublicRoute(dir, "/static")
+
+	for _, test := range []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{"/static/docs/", http.StatusOK, "docs index"},
+		{"/static/docs/sub/", http.StatusOK, "sub index"},
+		{"/static/docs/page.html", http.StatusOK, "page"},
+		{"/static/other/", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("Did not return expected response [%d %q] for path [%s]\n\tReturned: %d %q", test.code, test.expected, test.path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestPublicRouteDirectoryListing(t *testing.T) {
+	first := writeTestFiles(t, map[string]string{
+		"docs/index.html":  "docs index",
+		"files/a.txt":      "a",
+		"files/sub/b.txt":  "b",
+		"files/<odd>.txt":  "odd",
+		"files/c:d.txt":    "colon",
+		"files/space x.md": "space",
+	})
+	second := writeTestFiles(t, map[string]string{
+		"files/z.txt": "z",
+		"top.txt":     "top",
+	})
+	server := New[Sessionless](Sessionless{})
+	server.PublicRoute(first, "/static")
+	public := server.PublicRoute(second, "/static")
+
+	// Off by default
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/static/files/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected directory listing to be off by default, received %d", w.Code)
+	}
+
+	public.DirectoryListing(true)
+	for _, test := range []struct {
+		path     string
+		code     int
+		contains []string
+	}{
+		{"/static/docs/", http.StatusOK, []string{"docs index"}},
+		{"/static/files/", http.StatusOK, []string{
+			`<a href="../">../</a>`,
+			`<a href="%3Codd%3E.txt">&lt;odd&gt;.txt</a>`,
+			`<a href="a.txt">a.txt</a>`,
+			`<a href="./c:d.txt">c:d.txt</a>`,
+			`<a href="space%20x.md">space x.md</a>`,
+			`<a href="sub/">sub/</a>`,
+			`<a href="z.txt">z.txt</a>`,
+		}},
+		{"/static/", http.StatusOK, []string{`<a href="docs/">docs/</a>`, `<a href="top.txt">top.txt</a>`}},
+		{"/static/missing/", http.StatusNotFound, nil},
+		{"/static/files/a.txt/", http.StatusNotFound, nil},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, received %d", test.path, test.code, w.Code)
+			continue
+		}
+		for _, expected := range test.contains {
+			if !strings.Contains(w.Body.String(), expected) {
+				t.Errorf("%s: expected listing to contain %s\n\tReceived: %s", test.path, expected, w.Body.String())
+			}
+		}
+	}
+
+	// Listings are validated with an ETag like any file
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/static/files/", nil))
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("Expected listing Content-Type text/html, received [%s]", contentType)
+	}
+	r := httptest.NewRequest("GET", "/static/files/", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged listing, received %d", w.Code)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	for expected, cc := range map[string]CacheControl{
+		"":                                     {},
+		"no-store":                             {NoStore: true},
+		"public, no-cache":                     {Public: true, NoCache: true},
+		"private, max-age=90, must-revalidate": {Private: true, MaxAge: 90 * time.Second, MustRevalidate: true},
+		"public, max-age=31536000, s-maxage=60, immutable": {
+			Public: true, MaxAge: 365 * 24 * time.Hour, SharedMaxAge: time.Minute, Immutable: true,
+		},
+	} {
+		if received := cc.String(); received != expected {
+			t.Errorf("Expected Cache-Control [%s], received [%s]", expected, received)
+		}
+	}
+
+	dir := writeTestFiles(t, map[string]string{
+		"app.js": "app",
+	})
+	server := New[Sessionless](Sessionless{})
+	public := server.PublicRoute(dir, "/static")
+	for _, test := range []struct {
+		cc       *CacheControl
+		expected string
+	}{
+		{nil, "public, no-cache"},
+		{&CacheControl{Public: true, MaxAge: time.Hour}, "public, max-age=3600"},
+	} {
+		if test.cc != nil {
+			public.CacheControl(*test.cc)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/static/app.js", nil))
+		if received := w.Header().Get("Cache-Control"); received != test.expected {
+			t.Errorf("Expected PublicRoute Cache-Control [%s], received [%s]", test.expected, received)
+		}
+	}
+}
+
+func TestPublicRouteImmutableFiles(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"app.abc123.js":          "fingerprinted",
+		"assets/logo-3f9a1c.png": "fingerprinted",
+		"app.js":                 "plain",
+		"app.config.js":          "plain",
+		"build.v2.js":            "plain",
+	})
+	server := New[Sessionless](Sessionless{})
+	server.PublicRoute(dir, "/static").ImmutableFiles(nil)
+
+	for path, expected := range map[string]string{
+		"/static/app.abc123.js":          "public, max-age=31536000, immutable",
+		"/static/assets/logo-3f9a1c.png": "public, max-age=31536000, immutable",
+		"/static/app.js":                 "public, no-cache",
+		"/static/app.config.js":          "public, no-cache",
+		"/static/build.v2.js":            "public, no-cache",
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if received := w.Header().Get("Cache-Control"); received != expected {
+			t.Errorf("%s: expected Cache-Control [%s], received [%s]", path, expected, received)
+		}
+	}
+}
+
+func TestPublicRouteSPA(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"index.html":     "app shell",
+		"assets/app.js":  "app script",
+		"docs/help.html": "help",
+	})
+	server := New[Sessionless](Sessionless{})
+	server.PublicRouteSPA(dir, "/app", "index.html")
+
+	for _, test := range []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/app/", http.StatusOK, "app shell"},
+		{"/app/assets/app.js", http.StatusOK, "app script"},
+		{"/app/docs/help.html", http.StatusOK, "help"},
+		{"/app/settings", http.StatusOK, "app shell"},
+		{"/app/users/42/profile", http.StatusOK, "app shell"},
+		{"/app/docs/", http.StatusOK, "app shell"},
+		{"/app/assets/missing.js", http.StatusNotFound, ""},
+		{"/app/favicon.ico", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, received %d", test.path, test.code, w.Code)
+		} else if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s: expected [%s], received [%s]", test.path, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestFaviconAndRobots(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"favicon.ico": "\x00\x00\x01\x00icon",
+		"robots.txt":  "User-agent: *\nDisallow: /private/\n",
+	})
+
+	for _, test := range []struct {
+		name        string
+		setup       func(server *Server[Sessionless])
+		path        string
+		code        int
+		body        string
+		contentType string
+	}{
+		{"favicon", func(server *Server[Sessionless]) { server.Favicon(filepath.Join(dir, "favicon.ico")) }, "/favicon.ico", http.StatusOK, "\x00\x00\x01\x00icon", "image/"},
+		{"missing favicon", func(server *Server[Sessionless]) { server.Favicon(filepath.Join(dir, "missing.ico")) }, "/favicon.ico", http.StatusNoContent, "", ""},
+		{"robots file", func(server *Server[Sessionless]) { server.Robots(filepath.Join(dir, "robots.txt")) }, "/robots.txt", http.StatusOK, "User-agent: *\nDisallow: /private/\n", "text/plain"},
+		{"robots content", func(server *Server[Sessionless]) { server.Robots("User-agent: *\nDisallow:\n") }, "/robots.txt", http.StatusOK, "User-agent: *\nDisallow:\n", "text/plain"},
+	} {
+		server := New[Sessionless](Sessionless{})
+		test.setup(server)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, received %d", test.name, test.code, w.Code)
+			continue
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("%s: expected body [%q], received [%q]", test.name, test.body, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+			t.Errorf("%s: expected Content-Type [%s], received [%s]", test.name, test.contentType, contentType)
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=86400" {
+			t.Errorf("%s: unexpected Cache-Control [%s]", test.name, cc)
+		}
+
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("%s: expected 304 on revalidation, received %d", test.name, w.Code)
+		}
+	}
+}
+
+func TestPublicRouteETag(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"app.js": "version 1",
+	})
+	path := filepath.Join(dir, "app.js")
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	server.PublicRoute(dir, "/static")
+
+	// Returns the logged response code alongside the response
+	get := func(etag string) (int, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest("GET", "/static/app.js", nil)
+		r.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return logger.requests[len(logger.requests)-1].ResponseCode, w
+	}
+
+	_, w := get("")
+	etag := w.Header().Get("ETag")
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Unable to set file times: %v", err)
+	}
+	if code, _ := get(etag); code != http.StatusNotModified {
+		t.Errorf("Expected 304 once the file was rehashed with unchanged contents, received %d", code)
+	}
+
+	// With its modification time and size unchanged, the file isn't read again - so the edit goes unnoticed
+	if err := os.WriteFile(path, []byte("version 2"), 0644); err != nil {
+		t.Fatalf("Unable to write file: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Unable to set file times: %v", err)
+	}
+	if code, w := get(etag); code != http.StatusNotModified || w.Header().Get("ETag") != etag {
+		t.Errorf("Expected 304 with ETag [%s], received %d with ETag [%s]", etag, code, w.Header().Get("ETag"))
+	}
+
+	modTime = modTime.Add(time.Minute)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Unable to set file times: %v", err)
+	}
+	code, w := get(etag)
+	if code != http.StatusOK || w.Body.String() != "version 2" || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected the modified file to be served with a new ETag, received %d %q with ETag [%s]", code, w.Body.String(), w.Header().Get("ETag"))
+	}
+}
+
+func TestPublicRouteWeakETags(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"app.js": "console.log(1)",
+	})
+	server := New[Sessionless](Sessionless{})
+	public := server.PublicRoute(dir, "/static")
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/static/app.js", nil)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	strong := get("").Header().Get("ETag")
+	if !strings.HasPrefix(strong, `"`) || !strings.HasSuffix(strong, `"`) {
+		t.Fatalf("Expected a quoted strong ETag, received [%s]", strong)
+	}
+
+	public.WeakETags(true)
+	weak := get("").Header().Get("ETag")
+	if weak != "W/"+strong {
+		t.Errorf("Expected weak ETag [W/%s], received [%s]", strong, weak)
+	}
+	// Both forms validate, whichever is currently sent
+	for _, ifNoneMatch := range []string{weak, strong, `"other", ` + weak} {
+		if w := get(ifNoneMatch); w.Code != http.StatusNotModified || w.Header().Get("ETag") != weak {
+			t.Errorf("If-None-Match [%s]: expected 304 with ETag [%s], received %d with [%s]", ifNoneMatch, weak, w.Code, w.Header().Get("ETag"))
+		}
+	}
+
+	public.WeakETags(false)
+	if w := get(weak); w.Code != http.StatusNotModified || w.Header().Get("ETag") != strong {
+		t.Errorf("Expected a weak If-None-Match to validate the strong ETag, received %d with [%s]", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+type testErrorResponse struct {
+	Code uint
+}
+
+func (response *testErrorResponse) AsJson() []byte {
+	return []byte(fmt.Sprintf(`{"code":%d}`, response.Code))
+}
+
+func TestUnmatchedRoute(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyErrorHandler(server, func(req *Request, err Error) *testErrorResponse {
+		return &testErrorResponse{Code: err.Code}
+	})
+	ApplyRoute(server, "/exists", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/missing", nil)
+	r.Header.Set("Accept", "application/json")
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"code":404}` {
+		t.Errorf("Did not return expected 404 from error handler\n\tReturned: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRouteMaxConcurrency(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	server := New[Sessionless](Sessionless{})
+	route := ApplyRoute(server, "/report", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			started <- struct{}{}
+			<-finish
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	serve := func() <-chan int {
+		code := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest("GET", "/report", nil))
+			code <- w.Code
+		}()
+		return code
+	}
+
+	// Excess requests are rejected outright
+	route.MaxConcurrency(1, 0)
+	first := serve()
+	<-started
+	if code := <-serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("Request over the concurrency limit returned %d", code)
+	}
+	finish <- struct{}{}
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("Request within the concurrency limit returned %d", code)
+	}
+
+	// Excess requests wait for a running handler to finish
+	route.MaxConcurrency(1, time.Minute)
+	first = serve()
+	<-started
+	second := serve()
+	finish <- struct{}{}
+	<-started
+	finish <- struct{}{}
+	for _, code := range []int{<-first, <-second} {
+		if code != http.StatusOK {
+			t.Errorf("Queued request returned %d", code)
+		}
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	started := make(chan time.Duration)
+	finish := make(chan struct{})
+	server := New[Sessionless](Sessionless{})
+	server.MaxInFlight(1, 0, 5*time.Second)
+	for _, path := range []string{"/report", "/other"} {
+		ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				started <- time.Since(req.Start())
+				<-finish
+				return bytes.NewBufferString("OK"), nil
+			},
+		})
+	}
+
+	serve := func(path string) <-chan *httptest.ResponseRecorder {
+		response := make(chan *httptest.ResponseRecorder)
+		go func() {
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			response <- w
+		}()
+		return response
+	}
+
+	// The limit is shared across routes
+	first := serve("/report")
+	<-started
+	if w := <-serve("/other"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("Request over the limit returned %d with Retry-After [%s]", w.Code, w.Header().Get("Retry-After"))
+	}
+	finish <- struct{}{}
+	if w := <-first; w.Code != http.StatusOK {
+		t.Errorf("Request within the limit returned %d", w.Code)
+	}
+
+	// Queued requests are timed from when they arrived
+	server.MaxInFlight(1, time.Minute, 5*time.Second)
+	first = serve("/report")
+	<-started
+	second := serve("/other")
+	time.Sleep(20 * time.Millisecond)
+	finish <- struct{}{}
+	if waited := <-started; waited < 20*time.Millisecond {
+		t.Errorf("Expected the queued request's duration to include its wait, received %s", waited)
+	}
+	finish <- struct{}{}
+	for _, w := range []*httptest.ResponseRecorder{<-first, <-second} {
+		if w.Code != http.StatusOK {
+			t.Errorf("Queued request returned %d", w.Code)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(Timeout(20 * time.Millisecond))
+	for path, handler := range map[string]func(req *Request) (*bytes.Buffer, *Error){
+		"/fast": func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+		"/observes": func(req *Request) (*bytes.Buffer, *Error) {
+			<-req.Context.Done()
+			return nil, &Error{Code: http.StatusInternalServerError, Error: req.Context.Err()}
+		},
+		"/ignores": func(req *Request) (*bytes.Buffer, *Error) {
+			time.Sleep(40 * time.Millisecond)
+			return bytes.NewBufferString("late"), nil
+		},
+		"/streams": func(req *Request) (*bytes.Buffer, *Error) {
+			req.Stream(func(w *StreamWriter) error {
+				<-req.Context.Done()
+				_, err := w.Write([]byte("partial"))
+				return err
+			})
+			return nil, nil
+		},
+	} {
+		ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: handler,
+		})
+	}
+
+	for path, expected := range map[string]int{
+		"/fast":     http.StatusOK,
+		"/observes": http.StatusServiceUnavailable,
+		"/ignores":  http.StatusServiceUnavailable,
+		"/streams":  http.StatusOK,
+	} {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Errorf("%s: expected %d, received %d", path, expected, w.Code)
+		}
+		if path == "/observes" && time.Since(start) > time.Second {
+			t.Errorf("%s: expected the request to be cut short at the deadline, took %s", path, time.Since(start))
+		}
+	}
+}
+
+func TestPostMiddleware(t *testing.T) {
+	var calls []string
+	server := New[Sessionless](Sessionless{})
+	server.PostMiddleware(func(req *Request) {
+		calls = append(calls, fmt.Sprintf("server %s %d %d", req.Path, req.ResponseCode, req.ResponseSize()))
+	})
+	route := ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("Hello"), nil
+		},
+		DELETE: func(req *Request) (*bytes.Buffer, *Error) {
+			return nil, &Error{Code: http.StatusForbidden}
+		},
+	})
+	route.PostMiddleware(func(req *Request) {
+		calls = append(calls, fmt.Sprintf("route %s %d", req.Path, req.ResponseCode))
+	})
+
+	for _, verb := range []string{"GET", "DELETE"} {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(verb, "/", nil))
+	}
+
+	expected := []string{
+		"route / 200",
+		"server / 200 5",
+		"route / 403",
+		"server / 403 0",
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Post middlewares not called as expected %q\n\tCalled: %q", expected, calls)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(RateLimit(2, time.Minute, nil))
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	for idx, test := range []struct {
+		remoteAddr string
+		code       int
+		retryAfter string
+	}{
+		{"192.0.2.1:1234", http.StatusOK, ""},
+		{"192.0.2.1:1235", http.StatusOK, ""},
+		{"192.0.2.1:1236", http.StatusTooManyRequests, "30"},
+		{"192.0.2.2:1234", http.StatusOK, ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || w.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("Request %d from %s did not return [%d Retry-After: %s]\n\tReturned: %d Retry-After: %s", idx, test.remoteAddr, test.code, test.retryAfter, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+
+	// Without a rate, no request could ever be allowed again
+	for _, test := range []struct {
+		limit  uint
+		window time.Duration
+	}{
+		{0, time.Minute},
+		{2, 0},
+		{2, -time.Second},
+	} {
+		if _, _, err := NewInMemoryRateLimitStore().Take("192.0.2.1", test.limit, test.window); err == nil {
+			t.Errorf("Expected an error taking from a limit of %d per %v", test.limit, test.window)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected RateLimit to panic for a limit of %d per %v", test.limit, test.window)
+				}
+			}()
+			RateLimit(test.limit, test.window, nil)
+		}()
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	maintenanceEnd := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.FixedZone("EST", -5*60*60))
+	for _, withHandler := range []bool{false, true} {
+		server := New[Sessionless](Sessionless{})
+		if withHandler {
+			ApplyErrorHandler(server, func(req *Request, err Error) *testErrorResponse {
+				return &testErrorResponse{Code: err.Code}
+			})
+		}
+		ApplyRoute(server, "/busy", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				return nil, &Error{Code: http.StatusServiceUnavailable, RetryAfter: 1500 * time.Millisecond}
+			},
+		})
+		ApplyRoute(server, "/maintenance", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				req.RetryAt(maintenanceEnd)
+				return nil, &Error{Code: http.StatusServiceUnavailable}
+			},
+		})
+
+		for path, expected := range map[string]string{
+			"/busy":        "2",
+			"/maintenance": "Wed, 02 Jan 2030 08:04:05 GMT",
+		} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", path, nil)
+			r.Header.Set("Accept", "application/json")
+			server.ServeHTTP(w, r)
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != expected {
+				t.Errorf("%s (error handler: %v): expected 503 with Retry-After [%s], received %d with [%s]", path, withHandler, expected, w.Code, w.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyErrorHandler(server, func(req *Request, err Error) *testErrorResponse {
+		return &testErrorResponse{Code: err.Code}
+	})
+	for _, path := range []string{"/", "/healthz", "/status/"} {
+		ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				return bytes.NewBufferString("OK"), nil
+			},
+		})
+	}
+	if err := server.MaintenanceBypass([]string{"/healthz", "/status/"}, []string{"192.0.2.1", "10.0.0.0/8", "2001:db8::/32"}); err != nil {
+		t.Fatalf("Unable to set maintenance bypass: %v", err)
+	}
+	if err := server.MaintenanceBypass(nil, []string{"not an ip"}); err == nil {
+		t.Errorf("Expected an invalid bypass IP to be rejected")
+	}
+
+	for _, test := range []struct {
+		maintenance bool
+		path        string
+		remoteAddr  string
+		code        int
+	}{
+		{false, "/", "198.51.100.1:1234", http.StatusOK},
+		{true, "/", "198.51.100.1:1234", http.StatusServiceUnavailable},
+		{true, "/missing", "198.51.100.1:1234", http.StatusServiceUnavailable},
+		{true, "/healthz", "198.51.100.1:1234", http.StatusOK},
+		{true, "/healthz/extra", "198.51.100.1:1234", http.StatusServiceUnavailable},
+		{true, "/status/db", "198.51.100.1:1234", http.StatusOK},
+		{true, "/", "192.0.2.1:1234", http.StatusOK},
+		{true, "/", "10.1.2.3:1234", http.StatusOK},
+		{true, "/", "[2001:db8::1]:1234", http.StatusOK},
+		{true, "/", "192.0.2.2:1234", http.StatusServiceUnavailable},
+		{false, "/", "198.51.100.1:1234", http.StatusOK},
+	} {
+		server.SetMaintenance(test.maintenance)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.RemoteAddr = test.remoteAddr
+		r.Header.Set("Accept", "application/json")
+		server.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Maintenance %v, %s from %s: expected %d, received %d", test.maintenance, test.path, test.remoteAddr, test.code, w.Code)
+		} else if test.code == http.StatusServiceUnavailable && w.Body.String() != `{"code":503}` {
+			t.Errorf("Expected maintenance response from the error handler, received %q", w.Body.String())
+		}
+	}
+}
+
+type testSignup struct {
+	Name  string
+	Email string
+	Age   int
+}
+
+func (body *testSignup) Validate() error {
+	errs := ValidationError{}
+	if body.Name == "" {
+		errs["Name"] = "is required"
+	}
+	if !strings.Contains(body.Email, "@") {
+		errs["Email"] = "must be an email address"
+	}
+	if body.Age < 0 {
+		return errors.New("age cannot be negative")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func TestValidationError(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyErrorHandler(server, func(req *Request, err Error) Jsoner {
+		var validationErr ValidationError
+		if errors.As(err.Error, &validationErr) {
+			return validationErr
+		}
+		return &testErrorResponse{Code: err.Code}
+	})
+	ApplyRoute(server, "/signup", testSignup{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	for _, test := range []struct {
+		body     string
+		code     int
+		expected string
+	}{
+		{`{"Name":"","Email":"nope"}`, http.StatusUnprocessableEntity, `{"errors":{"Email":"must be an email address","Name":"is required"}}`},
+		{`{"Name":"Ann","Email":"ann@example.com","Age":-1}`, http.StatusBadRequest, `{"code":400}`},
+		{`{"Name":"Ann","Email":"ann@example.com"}`, http.StatusOK, "OK"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/signup", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Accept", "application/json")
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("Did not return expected response [%d %s] for body %s\n\tReturned: %d %s", test.code, test.expected, test.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	whoami := map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			identity, _ := AuthIdentity(req)
+			return bytes.NewBufferString(fmt.Sprint(identity)), nil
+		},
+	}
+	ApplyRoute(server, "/basic", RequestBody{}, whoami).Middleware(BasicAuth("admin", func(username, password string) bool {
+		return username == "alice" && password == "secret"
+	}))
+	ApplyRoute(server, "/bearer", RequestBody{}, whoami).Middleware(BearerAuth("api", func(token string) (any, bool) {
+		if token == "abc123" {
+			return "bob", true
+		}
+		return nil, false
+	}))
+
+	basic := func(username, password string) string {
+		r := http.Request{Header: http.Header{}}
+		r.SetBasicAuth(username, password)
+		return r.Header.Get("Authorization")
+	}
+
+	for _, test := range []struct {
+		path          string
+		authorization string
+		code          int
+		body          string
+		challenge     string
+	}{
+		{"/basic", basic("alice", "secret"), http.StatusOK, "alice", ""},
+		{"/basic", basic("alice", "wrong"), http.StatusUnauthorized, "", `Basic realm="admin", charset="UTF-8"`},
+		{"/basic", "", http.StatusUnauthorized, "", `Basic realm="admin", charset="UTF-8"`},
+		{"/bearer", "Bearer abc123", http.StatusOK, "bob", ""},
+		{"/bearer", "bearer abc123", http.StatusOK, "bob", ""},
+		{"/bearer", "Bearer nope", http.StatusUnauthorized, "", `Bearer realm="api", error="invalid_token"`},
+		{"/bearer", basic("alice", "secret"), http.StatusUnauthorized, "", `Bearer realm="api"`},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.authorization > "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || w.Body.String() != test.body || w.Header().Get("WWW-Authenticate") != test.challenge {
+			t.Errorf("Did not return expected response [%d %q WWW-Authenticate: %s] for %s with [%s]\n\tReturned: %d %q WWW-Authenticate: %s", test.code, test.body, test.challenge, test.path, test.authorization, w.Code, w.Body.String(), w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+// Only returns if the request is allowed to continue
+func requireAdmin(req *Request) {
+	if req.Headers.Get("X-Admin") != "yes" {
+		req.Abort(http.StatusForbidden)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			requireAdmin(req)
+			return bytes.NewBufferString("OK"), nil
+		},
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			panic("something went wrong")
+		},
+	})
+
+	for _, test := range []struct {
+		verb  string
+		admin string
+		code  int
+		body  string
+	}{
+		{"GET", "yes", http.StatusOK, "OK"},
+		{"GET", "no", http.StatusForbidden, ""},
+		{"POST", "yes", http.StatusInternalServerError, ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.verb, "/", nil)
+		r.Header.Set("X-Admin", test.admin)
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || w.Body.String() != test.body {
+			t.Errorf("Did not return expected response [%d %q] for %s with X-Admin: %s\n\tReturned: %d %q", test.code, test.body, test.verb, test.admin, w.Code, w.Body.String())
+		}
+	}
+
+	if expected := []string{"something went wrong"}; !reflect.DeepEqual(logger.messages, expected) {
+		t.Errorf("Did not log expected panics %q\n\tLogged: %q", expected, logger.messages)
+	}
+}
+
+func TestPanicAfterResponding(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	ApplyErrorHandler(server, func(req *Request, err Error) *bytes.Buffer {
+		return bytes.NewBufferString("error page")
+	})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			req.Stream(func(w *StreamWriter) error {
+				_, err := fmt.Fprint(w, "partial")
+				return err
+			})
+			if req.Headers.Get("X-Abort") != "" {
+				req.Abort(http.StatusForbidden)
+			}
+			panic("something went wrong")
+		},
+	})
+
+	for _, abort := range []string{"", "1"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Abort", abort)
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "partial" {
+			t.Errorf("Expected only the response already written (X-Abort: %s), received %d %q", abort, w.Code, w.Body.String())
+		}
+	}
+	if len(logger.messages) != 1 || len(logger.errors) != 1 {
+		t.Errorf("Expected the panic and abort to be logged, received %q and %v", logger.messages, logger.errors)
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		closeConnections bool
+		header           string
+		expectClose      bool
+	}{
+		{false, "", false},
+		{false, "Connection: close\r\n", true},
+		{true, "", true},
+	} {
+		server.CloseConnections = test.closeConnections
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Unable to connect: %v", err)
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\n%s\r\n", test.header)
+		rdr := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(rdr, nil)
+		if err != nil {
+			t.Fatalf("Unable to read response: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.Close != test.expectClose {
+			t.Errorf("Response to [%q] with CloseConnections %v had Close %v", test.header, test.closeConnections, resp.Close)
+		}
+		if test.expectClose {
+			// The server should have hung up after responding
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := rdr.ReadByte(); err != io.EOF {
+				t.Errorf("Connection was not closed after response to [%q]: %v", test.header, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	server.PublicRoute(writeTestFiles(t, map[string]string{"css/style.css": "body {}"}), "/static")
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/static/css/style.css", nil))
+	r := httptest.NewRequest("GET", "/static/css/style.css", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(logger.requests) != 2 {
+		t.Fatalf("Expected 2 requests to be logged, %d were", len(logger.requests))
+	}
+	for idx, expected := range []bool{false, true} {
+		if logger.requests[idx].CacheHit() != expected {
+			t.Errorf("Request %d was logged with CacheHit %v", idx, !expected)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	cache := NewResponseCache(time.Minute, 0)
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(cache.Middleware)
+	server.PostMiddleware(cache.PostMiddleware)
+
+	calls := 0
+	var cacheHit bool
+	server.PostMiddleware(func(req *Request) {
+		cacheHit = req.CacheHit()
+	})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			calls++
+			req.ResponseHeaders.Set("Vary", "X-Lang")
+			return testPage(fmt.Sprintf("%d %s", calls, req.Headers.Get("X-Lang"))), nil
+		},
+		POST: func(req *Request) (testPage, *Error) {
+			return testPage("updated"), nil
+		},
+	})
+
+	for idx, test := range []struct {
+		method   string
+		accept   string
+		lang     string
+		expected string
+		hit      bool
+	}{
+		{"GET", "text/html", "en", "<p>1 en</p>", false},
+		{"GET", "text/html", "en", "<p>1 en</p>", true},
+		{"GET", "application/json", "en", `"2 en"`, false},
+		{"GET", "text/html", "fr", "<p>3 fr</p>", false},
+		{"GET", "text/html", "en", "<p>1 en</p>", true},
+		{"POST", "text/html", "en", "<p>updated</p>", false},
+		{"GET", "text/html", "en", "<p>4 en</p>", false},
+		{"GET", "application/json", "en", `"5 en"`, false},
+	} {
+		r := httptest.NewRequest(test.method, "/", nil)
+		r.Header.Set("Accept", test.accept)
+		r.Header.Set("X-Lang", test.lang)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Body.String() != test.expected || cacheHit != test.hit {
+			t.Errorf("Request %d: expected %q (cache hit %v), received %q (cache hit %v)", idx, test.expected, test.hit, w.Body.String(), cacheHit)
+		}
+	}
+
+	// Cached bodies are compressed as they're served
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html")
+	r.Header.Set("X-Lang", "en")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if !cacheHit || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected a gzipped cache hit, received Content-Encoding [%s] (cache hit %v)", w.Header().Get("Content-Encoding"), cacheHit)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to read gzipped response: %v", err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != "<p>4 en</p>" {
+		t.Errorf("Expected cached body [<p>4 en</p>], received %q", body)
+	}
+}
+
+func TestResponseContentEncoding(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString(content), nil
+		},
+	})
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(rdr io.Reader) (io.Reader, error) {
+			return gzip.NewReader(rdr)
+		},
+		"br": func(rdr io.Reader) (io.Reader, error) {
+			return brotli.NewReader(rdr), nil
+		},
+	}
+	// Each encoding twice over, so the second response is written with a pooled encoder
+	for _, encoding := range []string{"gzip", "br", "gzip", "br"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if received := w.Header().Get("Content-Encoding"); received != encoding {
+			t.Errorf("Expected Content-Encoding [%s], received [%s]", encoding, received)
+			continue
+		}
+		rdr, err := decoders[encoding](w.Body)
+		if err != nil {
+			t.Errorf("Unable to decode %s response: %v", encoding, err)
+			continue
+		}
+		// Reading to the end validates the encoder was closed, rather than merely flushed
+		if body, err := io.ReadAll(rdr); err != nil || string(body) != content {
+			t.Errorf("Unexpected %s response body (error %v): %q", encoding, err, body)
+		}
+	}
+}
+
+func TestBodylessResponses(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		req.ResponseCode, _ = strconv.Atoi(req.Headers.Get("X-Status"))
+		return bytes.NewBufferString(req.Headers.Get("X-Body")), nil
+	}
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET:  handler,
+		HEAD: handler,
+	})
+
+	for _, test := range []struct {
+		method   string
+		status   int
+		body     string
+		encoding string
+	}{
+		{"GET", http.StatusOK, "content", "gzip"},
+		{"GET", http.StatusOK, "", ""},
+		{"GET", http.StatusCreated, "created", "gzip"},
+		{"GET", http.StatusNoContent, "", ""},
+		{"GET", http.StatusNoContent, "ignored", ""},
+		{"GET", http.StatusNotModified, "ignored", ""},
+		{"HEAD", http.StatusOK, "content", ""},
+		{"HEAD", http.StatusNotModified, "content", ""},
+	} {
+		r := httptest.NewRequest(test.method, "/", nil)
+		r.Header.Set("X-Status", strconv.Itoa(test.status))
+		r.Header.Set("X-Body", test.body)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		label := fmt.Sprintf("%s %d with body %q", test.method, test.status, test.body)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, received %d", label, test.status, w.Code)
+		}
+		if encoding := w.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%s: expected Content-Encoding [%s], received [%s]", label, test.encoding, encoding)
+		}
+		if test.encoding == "" && w.Body.Len() != 0 {
+			t.Errorf("%s: expected no body, received %q", label, w.Body.String())
+		}
+		if test.method == "HEAD" && test.status == http.StatusOK && w.Header().Get("Content-Length") != strconv.Itoa(len(test.body)) {
+			t.Errorf("%s: expected Content-Length %d, received [%s]", label, len(test.body), w.Header().Get("Content-Length"))
+		}
+	}
+
+	// A 304 from PublicRoute has its status written
+	dir := writeTestFiles(t, map[string]string{"app.js": "app"})
+	server.PublicRoute(dir, "/static")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/static/app.js", nil))
+	r := httptest.NewRequest("GET", "/static/app.js", nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected an empty 304 from PublicRoute, received %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestResponseCacheInterfaceRoute(t *testing.T) {
+	cache := NewResponseCache(time.Minute, 0)
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(cache.Middleware)
+	server.PostMiddleware(cache.PostMiddleware)
+	var hit bool
+	server.PostMiddleware(func(req *Request) {
+		hit = req.CacheHit()
+	})
+
+	calls := 0
+	// Htmler alone can't be negotiated as JSON until the handler returns a testPage, which is also a Jsoner
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (Htmler, *Error){
+		GET: func(req *Request) (Htmler, *Error) {
+			calls++
+			return testPage(fmt.Sprint(calls)), nil
+		},
+	})
+
+	for idx, test := range []struct {
+		accept   string
+		expected string
+		hit      bool
+	}{
+		{"application/json", `"1"`, false},
+		{"application/json", `"1"`, true},
+		{"text/html", "<p>2</p>", false},
+		{"text/html", "<p>2</p>", true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Body.String() != test.expected || hit != test.hit {
+			t.Errorf("Request %d: expected %q (cache hit %v), received %q (cache hit %v)", idx, test.expected, test.hit, w.Body.String(), hit)
+		}
+	}
+}
+
+func TestResponseCacheCredentials(t *testing.T) {
+	cache := NewResponseCache(time.Minute, 0)
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(cache.Middleware)
+	server.PostMiddleware(cache.PostMiddleware)
+	var hit bool
+	server.PostMiddleware(func(req *Request) {
+		hit = req.CacheHit()
+	})
+
+	ApplyRoute(server, "/account", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			if user := req.Headers.Get("Authorization"); user != "" {
+				return testPage("Welcome " + user), nil
+			}
+			return testPage("Please sign in"), nil
+		},
+	})
+	ApplyRoute(server, "/news", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			req.SetCacheControl(CacheControl{Public: true, MaxAge: time.Minute})
+			return testPage("Headlines"), nil
+		},
+	})
+
+	for idx, test := range []struct {
+		path, auth, cookie string
+		expected           string
+		hit                bool
+	}{
+		// Not cached for anyone else, nor served to the same user from the cache
+		{"/account", "alice", "", "<p>Welcome alice</p>", false},
+		{"/account", "", "", "<p>Please sign in</p>", false},
+		{"/account", "alice", "", "<p>Welcome alice</p>", false},
+		{"/account", "", "", "<p>Please sign in</p>", true},
+		{"/account", "", "session_token=abc", "<p>Please sign in</p>", false},
+		// Unless marked public
+		{"/news", "alice", "", "<p>Headlines</p>", false},
+		{"/news", "", "", "<p>Headlines</p>", true},
+		{"/news", "bob", "", "<p>Headlines</p>", true},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept", "text/html")
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		if test.cookie != "" {
+			r.Header.Set("Cookie", test.cookie)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Body.String() != test.expected || hit != test.hit {
+			t.Errorf("Request %d: expected %q (cache hit %v), received %q (cache hit %v)", idx, test.expected, test.hit, w.Body.String(), hit)
+		}
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	cache := NewResponseCache(50*time.Millisecond, 2)
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(cache.Middleware)
+	server.PostMiddleware(cache.PostMiddleware)
+
+	calls := map[string]int{}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		path := path
+		ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+			GET: func(req *Request) (testPage, *Error) {
+				calls[path]++
+				return testPage(path), nil
+			},
+		})
+	}
+	get := func(path string) {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept", "text/html")
+		server.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// /a is the least recently used once /c is cached, so is evicted
+	for _, path := range []string{"/a", "/b", "/b", "/c", "/b", "/a"} {
+		get(path)
+	}
+	expected := map[string]int{"/a": 2, "/b": 1, "/c": 1}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected handler calls %v, received %v", expected, calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	get("/b")
+	if calls["/b"] != 2 {
+		t.Errorf("Expected expired response to be refreshed, /b was called %d times", calls["/b"])
+	}
+}
+
+type testReport struct {
+	req   *Request
+	err   error
+	stack []byte
+}
+type testReporter []testReport
+
+func (reporter *testReporter) Report(req *Request, err error, stack []byte) {
+	*reporter = append(*reporter, testReport{req, err, stack})
+}
+
+func TestErrorReporter(t *testing.T) {
+	reporter := new(testReporter)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = new(testLogger)
+	server.ErrorReporter = reporter
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			panic("something went wrong")
+		},
+		PUT: func(req *Request) (*bytes.Buffer, *Error) {
+			return nil, &Error{Code: http.StatusBadGateway, Error: errors.New("upstream unavailable")}
+		},
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return nil, &Error{Code: http.StatusBadRequest}
+		},
+	})
+
+	for _, verb := range []string{"GET", "PUT", "POST"} {
+		server.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(verb, "/", nil))
+	}
+
+	if len(*reporter) != 2 {
+		t.Fatalf("Expected 2 reports, received %d", len(*reporter))
+	}
+	panicked := (*reporter)[0]
+	if panicked.req.Verb != GET || panicked.err.Error() != "panic: something went wrong" || !bytes.Contains(panicked.stack, []byte("TestErrorReporter")) {
+		t.Errorf("Panic not reported as expected: %s %v\n%s", panicked.req.Verb, panicked.err, panicked.stack)
+	}
+	failed := (*reporter)[1]
+	if failed.req.Verb != PUT || failed.err.Error() != "upstream unavailable" || failed.stack != nil {
+		t.Errorf("5xx not reported as expected: %s %v\n%s", failed.req.Verb, failed.err, failed.stack)
+	}
+}
+
+type testPage string
+
+func (page testPage) AsHtml() []byte {
+	return []byte("<p>" + page + "</p>")
+}
+func (page testPage) AsJson() []byte {
+	return []byte(`"` + page + `"`)
+}
+
+type testCsvPage string
+
+func (page testCsvPage) AsHtml() []byte {
+	return []byte("<p>" + page + "</p>")
+}
+func (page testCsvPage) AsCsv() []byte {
+	return []byte("page\n" + page)
+}
+
+func TestInterfaceResponse(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (Htmler, *Error){
+		GET: func(req *Request) (Htmler, *Error) {
+			switch req.Headers.Get("X-Page") {
+			case "csv":
+				return testCsvPage("report"), nil
+			case "nil":
+				return nil, nil
+			}
+			return testPage("home"), nil
+		},
+	})
+
+	for _, test := range []struct {
+		page     string
+		accept   string
+		code     int
+		expected string
+	}{
+		{"", "text/html", http.StatusOK, "<p>home</p>"},
+		{"", "application/json", http.StatusOK, `"home"`},
+		{"", "text/csv", http.StatusNotAcceptable, ""},
+		{"csv", "text/csv", http.StatusOK, "page\nreport"},
+		{"csv", "text/html", http.StatusOK, "<p>report</p>"},
+		{"csv", "application/json", http.StatusNotAcceptable, ""},
+		{"nil", "text/html", http.StatusNoContent, ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Page", test.page)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("Page [%s] with Accept [%s]: expected %d %q, received %d %q", test.page, test.accept, test.code, test.expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestVary(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/page", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			if req.Headers.Get("X-Vary") != "" {
+				req.ResponseHeaders.Set("Vary", req.Headers.Get("X-Vary"))
+			}
+			return testPage("page"), nil
+		},
+	})
+	ApplyRoute(server, "/reader", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("reader"), nil
+		},
+	})
+
+	for _, test := range []struct {
+		path     string
+		vary     string
+		expected string
+	}{
+		{"/page", "", "Accept, Accept-Encoding"},
+		{"/page", "Cookie", "Cookie, Accept, Accept-Encoding"},
+		{"/page", "accept", "accept, Accept-Encoding"},
+		{"/page", "*", "*"},
+		{"/reader", "", "Accept-Encoding"},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept", "text/html")
+		r.Header.Set("X-Vary", test.vary)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if received := strings.Join(w.Header().Values("Vary"), ", "); received != test.expected {
+			t.Errorf("%s with Vary [%s]: expected Vary [%s], received [%s]", test.path, test.vary, test.expected, received)
+		}
+	}
+}
+
+func TestLocale(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString(req.Locale()), nil
+		},
+	})
+	get := func(acceptLanguage string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", acceptLanguage)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("fr"); w.Body.String() != "" {
+		t.Errorf("Expected no locale when none are configured, received %q", w.Body.String())
+	}
+
+	if err := server.Locales("en-US", "not a tag"); err == nil {
+		t.Errorf("Expected an error for an invalid locale")
+	}
+	if err := server.Locales("en-US", "fr", "de-DE"); err != nil {
+		t.Fatalf("Unable to set locales: %v", err)
+	}
+	for header, expected := range map[string]string{
+		"":                "en-US",
+		"fr-CA,fr;q=0.9":  "fr",
+		"de;q=0.5, es":    "de-DE",
+		"en-GB":           "en-US",
+		"ja":              "en-US",
+		"not a ;language": "en-US",
+	} {
+		w := get(header)
+		if w.Body.String() != expected {
+			t.Errorf("Expected locale [%s] for Accept-Language [%s], received [%s]", expected, header, w.Body.String())
+		}
+		if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept-Language") {
+			t.Errorf("Expected Vary to include Accept-Language, received %v", w.Header().Values("Vary"))
+		}
+	}
+}
+
+type testXmlPage string
+
+func (page testXmlPage) AsXml() []byte {
+	return []byte("<page>" + page + "</page>")
+}
+
+func TestContentTypeHeader(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.RegisterContentTypeInterface("text/xml", (*TestXmler)(nil))
+	ApplyErrorHandler(server, func(req *Request, err Error) *testErrorResponse {
+		return &testErrorResponse{Code: err.Code}
+	})
+	ApplyRoute(server, "/page", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			if req.Headers.Get("X-Content-Type") != "" {
+				req.ResponseHeaders.Set("Content-Type", req.Headers.Get("X-Content-Type"))
+			}
+			return testPage("page"), nil
+		},
+	})
+	ApplyRoute(server, "/xml", RequestBody{}, map[Verb]func(req *Request) (testXmlPage, *Error){
+		GET: func(req *Request) (testXmlPage, *Error) {
+			return testXmlPage("page"), nil
+		},
+	})
+
+	for _, test := range []struct {
+		path        string
+		accept      string
+		contentType string
+		expected    string
+	}{
+		{"/page", "text/html", "", "text/html; charset=utf-8"},
+		{"/page", "application/json", "", "application/json"},
+		{"/page", "text/html", "application/xhtml+xml", "application/xhtml+xml"},
+		{"/xml", "text/xml", "", "text/xml; charset=utf-8"},
+		{"/missing", "application/json", "", "application/json"},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept", test.accept)
+		r.Header.Set("X-Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if received := w.Header().Get("Content-Type"); received != test.expected {
+			t.Errorf("%s with Accept [%s]: expected Content-Type [%s], received [%s]", test.path, test.accept, test.expected, received)
+		}
+	}
+}
+
+func TestRouteDefaultContentType(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.DefaultContentType("html")
+	ApplyRoute(server, "/api", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			return "api", nil
+		},
+	}).DefaultContentType("json")
+	ApplyRoute(server, "/page", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			return "page", nil
+		},
+	})
+
+	for _, test := range []struct {
+		path     string
+		accept   string
+		expected string
+	}{
+		{"/api", "", `"api"`},
+		{"/api", "*/*", `"api"`},
+		{"/api", "text/html", "<p>api</p>"},
+		{"/page", "", "<p>page</p>"},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Body.String() != test.expected {
+			t.Errorf("%s with Accept [%s]: expected %q, received %d %q", test.path, test.accept, test.expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.DefaultContentType("html", GET)
+	server.DefaultContentType("json", POST)
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (testPage, *Error){
+		GET: func(req *Request) (testPage, *Error) {
+			return "hello", nil
+		},
+		POST: func(req *Request) (testPage, *Error) {
+			return "posted", nil
+		},
+		PUT: func(req *Request) (testPage, *Error) {
+			return "put", nil
+		},
+	})
+
+	for _, test := range []struct {
+		verb     string
+		accept   string
+		code     int
+		expected string
+	}{
+		{"GET", "", http.StatusOK, "<p>hello</p>"},
+		{"POST", "", http.StatusOK, `"posted"`},
+		{"GET", "application/json", http.StatusOK, `"hello"`},
+		{"POST", "text/html", http.StatusOK, "<p>posted</p>"},
+		{"POST", "text/csv", http.StatusOK, `"posted"`},
+		{"PUT", "text/csv", http.StatusNotAcceptable, ""},
+		// No Accept header accepts anything, so the first registered content type is used
+		{"PUT", "", http.StatusOK, "<p>put</p>"},
+		{"PUT", "text/csv, */*;q=0.1", http.StatusOK, "<p>put</p>"},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.verb, "/", nil)
+		if test.accept > "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("Did not return expected response [%d %s] for %s with Accept [%s]\n\tReturned: %d %s", test.code, test.expected, test.verb, test.accept, w.Code, w.Body.String())
+		}
+	}
+
+	// A default for all verbs covers those without their own
+	server.DefaultContentType("json")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("PUT", "/", nil))
+	if w.Body.String() != `"put"` {
+		t.Errorf("Did not fall back to the default for all verbs\n\tReturned: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{"report.txt": "0123456789"})
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/download/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			if err := req.ServeFile(filepath.Join(dir, strings.TrimPrefix(req.Path, "/download/"))); err != nil {
+				return nil, err
+			}
+			return bytes.NewBufferString("not sent"), nil
+		},
+	})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/download/report.txt", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Errorf("Full download not served as expected: %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	for _, test := range []struct {
+		path     string
+		header   string
+		value    string
+		code     int
+		expected string
+	}{
+		{"/download/report.txt", "Range", "bytes=2-5", http.StatusPartialContent, "2345"},
+		{"/download/report.txt", "Range", "bytes=-3", http.StatusPartialContent, "789"},
+		{"/download/report.txt", "If-None-Match", etag, http.StatusNotModified, ""},
+		{"/download/report.txt", "If-None-Match", `"stale"`, http.StatusOK, "0123456789"},
+		{"/download/missing.txt", "", "", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.header > "" {
+			r.Header.Set(test.header, test.value)
+		}
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || w.Body.String() != test.expected {
+			t.Errorf("Did not return expected response [%d %q] for %s with %s: %s\n\tReturned: %d %q", test.code, test.expected, test.path, test.header, test.value, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Bodies are created by the server, so testClosingBody can only record its closing here
+// Appended to by testClosingBody, whose Close method can't capture a test's own slice
+var testCleanupCalls []string
+
+type testClosingBody struct {
+	Name string
+}
+
+func (body *testClosingBody) Close() error {
+	testCleanupCalls = append(testCleanupCalls, "body "+body.Name)
+	return nil
+}
+
+func TestRequestCleanup(t *testing.T) {
+	testCleanupCalls = nil
+	server := New[Sessionless](Sessionless{})
+	server.PostMiddleware(func(req *Request) {
+		testCleanupCalls = append(testCleanupCalls, "post middleware")
+	})
+	ApplyRoute(server, "/", testClosingBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			req.Cleanup(func() {
+				testCleanupCalls = append(testCleanupCalls, "handler cleanup")
+			})
+			testCleanupCalls = append(testCleanupCalls, "handler")
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"Name":"upload"}`))
+	r.Header.Set("Content-Type", "application/json")
+	server.ServeHTTP(httptest.NewRecorder(), r)
+
+	expected := []string{"handler", "post middleware", "handler cleanup", "body upload"}
+	if !reflect.DeepEqual(testCleanupCalls, expected) {
+		t.Errorf("Cleanups not run as expected %q\n\tRan: %q", expected, testCleanupCalls)
+	}
+}
+
+func TestHealthRoutes(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	var dbErr error
+	checks := map[string]HealthCheck{
+		"db":    func(ctx context.Context) error { return dbErr },
+		"cache": func(ctx context.Context) error { return nil },
+	}
+	server.HealthRoute("/healthz", checks)
+	server.ReadinessRoute("/readyz", checks)
+
+	check := func(path string, expectedCode int, expected HealthReport) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expectedCode {
+			t.Errorf("%s: expected status %d, received %d", path, expectedCode, w.Code)
+		}
+		var report HealthReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("%s: unable to decode report %q: %v", path, w.Body.String(), err)
+		}
+		if !reflect.DeepEqual(report, expected) {
+			t.Errorf("%s: expected report %+v, received %+v", path, expected, report)
+		}
+	}
+	healthy := map[string]string{"db": "ok", "cache": "ok"}
+
+	// Not ready until listening
+	check("/healthz", http.StatusOK, HealthReport{Status: "ok", Checks: healthy})
+	check("/readyz", http.StatusServiceUnavailable, HealthReport{Status: "not ready", Checks: healthy})
+
+	if _, err := server.Listen("127.0.0.1:0", nil); err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	check("/readyz", http.StatusOK, HealthReport{Status: "ok", Checks: healthy})
+
+	server.SetReady(false)
+	check("/readyz", http.StatusServiceUnavailable, HealthReport{Status: "not ready", Checks: healthy})
+	server.SetReady(true)
+
+	dbErr = errors.New("connection refused")
+	unhealthy := map[string]string{"db": "connection refused", "cache": "ok"}
+	check("/healthz", http.StatusServiceUnavailable, HealthReport{Status: "unavailable", Checks: unhealthy})
+	check("/readyz", http.StatusServiceUnavailable, HealthReport{Status: "unavailable", Checks: unhealthy})
+	dbErr = nil
+
+	// A panicking check fails, rather than taking down the server
+	server.HealthRoute("/livez", map[string]HealthCheck{
+		"broken": func(ctx context.Context) error { panic("nil map") },
+	})
+	check("/livez", http.StatusServiceUnavailable, HealthReport{Status: "unavailable", Checks: map[string]string{"broken": "panic: nil map"}})
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unable to shut down: %v", err)
+	}
+	check("/readyz", http.StatusServiceUnavailable, HealthReport{Status: "not ready", Checks: healthy})
+}
+
+func TestPprof(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	var postMiddlewareCodes []int
+	server.PostMiddleware(func(req *Request) {
+		postMiddlewareCodes = append(postMiddlewareCodes, req.ResponseCode)
+	})
+	server.Pprof("/debug/pprof", func(req *Request) *Error {
+		if req.Headers.Get("Authorization") != "Bearer secret" {
+			return &Error{Code: http.StatusUnauthorized}
+		}
+		return nil
+	})
+
+	for _, test := range []struct {
+		path          string
+		authorization string
+		code          int
+		contains      string
+	}{
+		{"/debug/pprof/", "", http.StatusUnauthorized, ""},
+		{"/debug/pprof/goroutine?debug=1", "Bearer wrong", http.StatusUnauthorized, ""},
+		{"/debug/pprof/", "Bearer secret", http.StatusOK, "goroutine"},
+		{"/debug/pprof/goroutine?debug=1", "Bearer secret", http.StatusOK, "TestPprof"},
+		{"/debug/pprof/cmdline", "Bearer secret", http.StatusOK, ""},
+		{"/debug/pprof/nonexistent", "Bearer secret", http.StatusNotFound, ""},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d, received %d", test.path, test.code, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.contains) {
+			t.Errorf("%s: expected body to contain %q", test.path, test.contains)
+		}
+		if last := postMiddlewareCodes[len(postMiddlewareCodes)-1]; last != test.code {
+			t.Errorf("%s: expected post middlewares to see status %d, received %d", test.path, test.code, last)
+		}
+		if test.code != http.StatusUnauthorized {
+			if logged := logger.requests[len(logger.requests)-1]; logged.ResponseCode != test.code || logged.Path != strings.Split(test.path, "?")[0] {
+				t.Errorf("%s: expected request to be logged with status %d, received %s %d", test.path, test.code, logged.Path, logged.ResponseCode)
+			}
+		}
+	}
+}
+
+func TestPprofServerMiddleware(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.Middleware(func(req *Request) *Error {
+		if req.Headers.Get("Authorization") != "Bearer secret" {
+			return &Error{Code: http.StatusUnauthorized}
+		}
+		return nil
+	})
+	server.Pprof("/debug/pprof")
+
+	for _, test := range []struct {
+		path          string
+		authorization string
+		code          int
+	}{
+		{"/debug/pprof/", "", http.StatusUnauthorized},
+		{"/debug/pprof/cmdline", "", http.StatusUnauthorized},
+		{"/debug/pprof/cmdline", "Bearer secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d, received %d", test.path, test.code, w.Code)
+		}
+	}
+}
+
+type testForm struct {
+	Name string
+}
+
+func (form *testForm) ParseFormData(rdr io.Reader) *Error {
+	body, err := io.ReadAll(rdr)
+	if err != nil {
+		return &Error{Code: http.StatusBadRequest, Error: err}
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return &Error{Code: http.StatusBadRequest, Error: err}
+	}
+	form.Name = values.Get("name")
+	return nil
+}
+
+func TestMethodOverride(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.MethodOverrides = []Verb{PUT, DELETE}
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		form, _ := req.Body.(testForm)
+		return bytes.NewBufferString(req.Verb.String() + " " + form.Name), nil
+	}
+	ApplyRoute(server, "/item", testForm{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET:    handler,
+		POST:   handler,
+		PUT:    handler,
+		DELETE: handler,
+	})
+
+	for _, test := range []struct {
+		method   string
+		override string
+		body     string
+		code     int
+		expected string
+	}{
+		{"POST", "", "name=bob", http.StatusOK, "POST bob"},
+		{"POST", "PUT", "name=bob", http.StatusOK, "PUT bob"},
+		{"POST", "", "name=bob&_method=put", http.StatusOK, "PUT bob"},
+		{"POST", "", "name=bob&_method=delete", http.StatusOK, "DELETE "},
+		{"POST", "", "_method=PATCH", http.StatusBadRequest, ""},
+		{"POST", "BREW", "", http.StatusBadRequest, ""},
+		{"GET", "DELETE", "", http.StatusOK, "GET "},
+	} {
+		r := httptest.NewRequest(test.method, "/item", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.override != "" {
+			r.Header.Set("X-HTTP-Method-Override", test.override)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %q with override [%s]: expected status %d, received %d", test.method, test.body, test.override, test.code, w.Code)
+		} else if test.code == http.StatusOK && w.Body.String() != test.expected {
+			t.Errorf("%s %q with override [%s]: expected %q, received %q", test.method, test.body, test.override, test.expected, w.Body.String())
+		}
+	}
+
+	// Overrides are ignored unless enabled
+	server.MethodOverrides = nil
+	r := httptest.NewRequest("POST", "/item", strings.NewReader("_method=DELETE"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Body.String() != "POST " {
+		t.Errorf("Expected override to be ignored when disabled, received %q", w.Body.String())
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		return bytes.NewBufferString(req.Path), nil
+	}
+	for _, path := range []string{"/counts", "/items/"} {
+		ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET:  handler,
+			POST: handler,
+		})
+	}
+	ApplyRoute(server, "/exact", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: handler,
+	}).TrailingSlash(TrailingSlashStrict)
+
+	for _, test := range []struct {
+		policy   TrailingSlash
+		method   string
+		target   string
+		code     int
+		expected string // body, or Location of a redirect
+	}{
+		{TrailingSlashStrict, "GET", "/counts", http.StatusOK, "/counts"},
+		{TrailingSlashStrict, "GET", "/counts/", http.StatusNotFound, ""},
+		{TrailingSlashStrict, "GET", "/items", http.StatusMovedPermanently, "/items/"},
+		{TrailingSlashRedirect, "GET", "/counts/?page=2", http.StatusMovedPermanently, "/counts?page=2"},
+		{TrailingSlashRedirect, "POST", "/counts/", http.StatusPermanentRedirect, "/counts"},
+		{TrailingSlashRedirect, "GET", "/items", http.StatusMovedPermanently, "/items/"},
+		{TrailingSlashRedirect, "GET", "/items/42", http.StatusOK, "/items/42"},
+		{TrailingSlashRedirect, "GET", "/exact/", http.StatusNotFound, ""},
+		{TrailingSlashRedirect, "GET", "/missing/", http.StatusNotFound, ""},
+		{TrailingSlashEquivalent, "GET", "/counts/", http.StatusOK, "/counts"},
+		{TrailingSlashEquivalent, "GET", "/items", http.StatusOK, "/items/"},
+		{TrailingSlashEquivalent, "GET", "/exact/", http.StatusNotFound, ""},
+	} {
+		server.TrailingSlash = test.policy
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(test.method, test.target, nil))
+		if w.Code != test.code {
+			t.Errorf("Policy %d, %s %s: expected status %d, received %d", test.policy, test.method, test.target, test.code, w.Code)
+			continue
+		}
+		received := w.Body.String()
+		if w.Code >= 300 && w.Code < 400 {
+			received = w.Header().Get("Location")
+		}
+		if test.expected != "" && received != test.expected {
+			t.Errorf("Policy %d, %s %s: expected %q, received %q", test.policy, test.method, test.target, test.expected, received)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.Rewrite(StripPrefix("/api/"))
+	server.Rewrite(func(r *http.Request) string {
+		return strings.ToLower(r.URL.Path)
+	})
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		return bytes.NewBufferString(req.Path + " " + req.RequestURI()), nil
+	}
+	for _, path := range []string{"/", "/users/"} {
+		ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: handler,
+		})
+	}
+
+	for _, test := range []struct {
+		target   string
+		expected string
+	}{
+		{"/api/users/42", "/users/42 /api/users/42"},
+		{"/api/Users/42?x=1", "/users/42 /api/Users/42?x=1"},
+		{"/users/7", "/users/7 /users/7"},
+		{"/api", "/ /api"},
+		{"/apiusers/1", "/apiusers/1 /apiusers/1"},
+	} {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", test.target, nil))
+		if w.Code != http.StatusOK || w.Body.String() != test.expected {
+			t.Errorf("%s: expected 200 [%s], received %d [%s]", test.target, test.expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Backend", "yes")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("X-Forwarded-Host"), body)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL + "/v1")
+
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	server.ReverseProxy("/api/", target).Middleware(func(req *Request) *Error {
+		if req.Headers.Get("Authorization") == "" {
+			return &Error{Code: http.StatusUnauthorized}
+		}
+		return nil
+	})
+
+	unreachable, _ := url.Parse("http://127.0.0.1:1")
+	server.ReverseProxy("/down/", unreachable)
+
+	for _, test := range []struct {
+		method string
+		target string
+		auth   bool
+		body   string
+		code   int
+		echo   string
+	}{
+		{"GET", "/api/users?page=2", true, "", http.StatusCreated, "GET /v1/api/users?page=2 example.com "},
+		{"POST", "/api/users", true, `{"name":"bob"}`, http.StatusCreated, `POST /v1/api/users example.com {"name":"bob"}`},
+		{"GET", "/api/users", false, "", http.StatusUnauthorized, ""},
+		{"GET", "/down/", false, "", http.StatusBadGateway, ""},
+	} {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		if test.auth {
+			r.Header.Set("Authorization", "Bearer token")
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d, received %d", test.method, test.target, test.code, w.Code)
+			continue
+		}
+		if test.echo == "" {
+			continue
+		}
+		if logged := logger.requests[len(logger.requests)-1]; logged.ResponseCode != test.code || logged.BodySize() != uint(len(test.body)) {
+			t.Errorf("%s %s: expected %d with a %d byte body to be logged, received %d with %d", test.method, test.target, test.code, len(test.body), logged.ResponseCode, logged.BodySize())
+		}
+		if w.Body.String() != test.echo {
+			t.Errorf("%s %s: expected upstream to receive [%s], received [%s]", test.method, test.target, test.echo, w.Body.String())
+		}
+		if w.Header().Get("X-Backend") != "yes" {
+			t.Errorf("%s %s: expected the upstream's response headers to be copied", test.method, test.target)
+		}
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/empty", RequestBody{}, map[Verb]func(req *Request) (NoContent, *Error){
+		PUT: func(req *Request) (NoContent, *Error) {
+			return NoContent{}, nil
+		},
+	})
+	ApplyRoute(server, "/pointer", RequestBody{}, map[Verb]func(req *Request) (*testErrorResponse, *Error){
+		GET: func(req *Request) (*testErrorResponse, *Error) {
+			return &testErrorResponse{Code: 1}, nil
+		},
+		DELETE: func(req *Request) (*testErrorResponse, *Error) {
+			return nil, nil
+		},
+	})
+	ApplyRoute(server, "/interface", RequestBody{}, map[Verb]func(req *Request) (Jsoner, *Error){
+		DELETE: func(req *Request) (Jsoner, *Error) {
+			if req.Headers.Get("X-Reset") != "" {
+				req.ResponseCode = http.StatusResetContent
+			}
+			return nil, nil
+		},
+	})
+
+	for _, test := range []struct {
+		method string
+		path   string
+		reset  bool
+		code   int
+	}{
+		{"PUT", "/empty", false, http.StatusNoContent},
+		{"GET", "/pointer", false, http.StatusOK},
+		{"DELETE", "/pointer", false, http.StatusNoContent},
+		{"DELETE", "/interface", false, http.StatusNoContent},
+		{"DELETE", "/interface", true, http.StatusResetContent},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		r.Header.Set("Accept", "application/json")
+		r.Header.Set("Accept-Encoding", "gzip")
+		if test.reset {
+			r.Header.Set("X-Reset", "1")
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected status %d, received %d", test.method, test.path, test.code, w.Code)
+		}
+		if test.code == http.StatusOK {
+			continue
+		}
+		if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" || w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s %s: expected no content, received %q with headers %v", test.method, test.path, w.Body.String(), w.Header())
+		}
+	}
+}
+
+// Connects to the websocket at path, reading any frames the server sent along with its handshake response first
+func dialWebsocket(t *testing.T, ts *httptest.Server, path string) (io.ReadWriter, net.Conn) {
+	t.Helper()
+	conn, br, _, err := ws.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+path)
+	if err != nil {
+		t.Fatalf("Unable to connect to %s: %v", path, err)
+	}
+	if br == nil {
+		return conn, conn
+	}
+	return struct {
+		io.Reader
+		io.Writer
+	}{io.MultiReader(br, conn), conn}, conn
+}
+
+func TestWebsocketMessages(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	echo := func(req *Request) (*bytes.Buffer, *Error) {
+		return bytes.NewBufferString("echo"), nil
+	}
+	ApplyRoute(server, "/mixed", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: echo,
+	}).WebsocketMessages(func(req *Request, inFeed <-chan []byte) <-chan WebsocketMessage {
+		out := make(chan WebsocketMessage)
+		go func() {
+			defer close(out)
+			for in := range inFeed {
+				payload, binary := bytes.CutPrefix(in, []byte("bin:"))
+				out <- WebsocketMessage{Binary: binary, Payload: payload}
+			}
+		}()
+		return out
+	})
+	ApplyRoute(server, "/text", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: echo,
+	}).Websocket(func(req *Request, inFeed <-chan []byte) <-chan []byte {
+		out := make(chan []byte)
+		go func() {
+			defer close(out)
+			for in := range inFeed {
+				out <- in
+			}
+		}()
+		return out
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		path     string
+		send     string
+		op       ws.OpCode
+		expected string
+	}{
+		{"/mixed", "hello", ws.OpText, "hello"},
+		{"/mixed", "bin:\x00\x01", ws.OpBinary, "\x00\x01"},
+		{"/text", "bin:hello", ws.OpText, "bin:hello"},
+	} {
+		rw, conn := dialWebsocket(t, ts, test.path)
+		if err := wsutil.WriteClientText(rw, []byte(test.send)); err != nil {
+			t.Fatalf("Unable to send to %s: %v", test.path, err)
+		}
+		payload, op, err := wsutil.ReadServerData(rw)
+		if err != nil {
+			t.Fatalf("Unable to read from %s: %v", test.path, err)
+		}
+		if op != test.op || string(payload) != test.expected {
+			t.Errorf("%s sent %q: expected opcode %v with %q, received %v with %q", test.path, test.send, test.op, test.expected, op, payload)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebsocketCloseFrame(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	route := ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+	route.Websocket(func(req *Request, inFeed <-chan []byte) <-chan []byte {
+		out := make(chan []byte, 1)
+		switch req.req.URL.Query().Get("close") {
+		case "finished":
+			req.CloseWebsocket(WebsocketNormalClosure, "finished")
+		case "policy":
+			req.CloseWebsocket(WebsocketPolicyViolation, "not allowed")
+		}
+		out <- []byte("bye")
+		close(out)
+		return out
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		path   string
+		code   ws.StatusCode
+		reason string
+	}{
+		{"/", ws.StatusNormalClosure, ""},
+		{"/?close=finished", ws.StatusNormalClosure, "finished"},
+		{"/?close=policy", ws.StatusPolicyViolation, "not allowed"},
+	} {
+		rw, conn := dialWebsocket(t, ts, test.path)
+		var frame ws.Frame
+		for frame.Header.OpCode != ws.OpClose {
+			var err error
+			if frame, err = ws.ReadFrame(rw); err != nil {
+				t.Fatalf("%s: unable to read frame: %v", test.path, err)
+			}
+		}
+		code, reason := ws.ParseCloseFrameData(frame.Payload)
+		if code != test.code || reason != test.reason {
+			t.Errorf("%s: expected close %d %q, received %d %q", test.path, test.code, test.reason, code, reason)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebsocketWriteError(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	stop := make(chan struct{})
+	defer close(stop)
+	finished := make(chan struct{})
+	route := ApplyRoute(server, "/feed", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("feed"), nil
+		},
+	})
+	route.Websocket(func(req *Request, inFeed <-chan []byte) <-chan []byte {
+		// Sends regardless of the connection, until the test ends
+		out := make(chan []byte)
+		go func() {
+			defer close(out)
+			for {
+				select {
+				case out <- bytes.Repeat([]byte("x"), 1024):
+				case <-stop:
+					return
+				}
+			}
+		}()
+		return out
+	})
+	route.PostMiddleware(func(req *Request) {
+		close(finished)
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	rw, conn := dialWebsocket(t, ts, "/feed")
+	if _, _, err := wsutil.ReadServerData(rw); err != nil {
+		t.Fatalf("Unable to read: %v", err)
+	}
+	conn.Close()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Websocket write loop did not exit after its connection broke")
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logged := false
+	for _, err := range logger.errors {
+		logged = logged || strings.HasPrefix(err.Error(), "Error writing message")
+	}
+	if !logged {
+		t.Errorf("Expected the write error to be logged, logged %v", logger.errors)
+	}
+}
+
+func TestWebsocketReadTimeout(t *testing.T) {
+	logger := new(testLogger)
+	server := New[Sessionless](Sessionless{})
+	server.Logger = logger
+	server.WebsocketReadTimeout = 100 * time.Millisecond
+	server.WebsocketWriteTimeout = time.Second
+	finished := make(chan struct{}, 2)
+	route := ApplyRoute(server, "/idle", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("idle"), nil
+		},
+	})
+	route.Websocket(func(req *Request, inFeed <-chan []byte) <-chan []byte {
+		out := make(chan []byte)
+		go func() {
+			defer close(out)
+			for range inFeed {
+			}
+		}()
+		return out
+	})
+	route.PostMiddleware(func(req *Request) {
+		finished <- struct{}{}
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// A client answering pings stays connected, however long it's idle
+	rw, conn := dialWebsocket(t, ts, "/idle")
+	go wsutil.ReadServerData(rw)
+	select {
+	case <-finished:
+		t.Fatal("Responsive websocket client timed out")
+	case <-time.After(350 * time.Millisecond):
+	}
+	conn.Close()
+	<-finished
+
+	// One which doesn't is disconnected
+	_, conn = dialWebsocket(t, ts, "/idle")
+	defer conn.Close()
+	select {
+	case <-finished:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Unresponsive websocket client did not time out")
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if !reflect.DeepEqual(logger.messages, []string{"Websocket client timed out"}) {
+		t.Errorf("Expected one timeout to be logged, logged %q", logger.messages)
+	}
+}
+
+func TestMaxWebsocketConnections(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.MaxWebsocketConnections(2)
+	closed := make(chan struct{}, 1)
+	server.PostMiddleware(func(req *Request) {
+		if req.Headers.Get("Upgrade") == "websocket" && req.ResponseCode == 0 {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	drain := func(req *Request, inFeed <-chan []byte) <-chan []byte {
+		out := make(chan []byte)
+		go func() {
+			defer close(out)
+			for range inFeed {
+			}
+		}()
+		return out
+	}
+	for _, path := range []string{"/a", "/b"} {
+		route := ApplyRoute(server, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				return bytes.NewBufferString("OK"), nil
+			},
+		})
+		route.Websocket(drain)
+		if path == "/a" {
+			route.MaxWebsocketConnections(1)
+		}
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	dial := func(path string, expectedErr error) net.Conn {
+		t.Helper()
+		conn, _, _, err := ws.Dial(context.Background(), "ws"+strings.TrimPrefix(ts.URL, "http")+path)
+		if err != expectedErr {
+			t.Fatalf("Connecting to %s: expected error %v, received %v", path, expectedErr, err)
+		}
+		return conn
+	}
+	first := dial("/a", nil)
+	dial("/a", ws.StatusError(http.StatusServiceUnavailable))
+	second := dial("/b", nil)
+	defer second.Close()
+	dial("/b", ws.StatusError(http.StatusServiceUnavailable))
+
+	first.Close()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Websocket connection was not closed")
+	}
+	third := dial("/b", nil)
+	third.Close()
+}
+
+func TestSetCookie(t *testing.T) {
+	server := New[int](NewInMemorySessionStore[int]())
+	ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			req.SetCookie(http.Cookie{Name: "theme", Value: "light"})
+			req.SetCookie(http.Cookie{Name: "lang", Value: "en"})
+			req.SetCookie(http.Cookie{Name: "theme", Value: "dark"})
+			req.SetCookie(http.Cookie{Name: "theme", Value: "admin", Path: "/admin"})
+			return bytes.NewBufferString("OK"), nil
+		},
+	})
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	cookies := map[string]string{}
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name+" "+cookie.Path] = cookie.Value
+	}
+	if token := cookies["session_token "]; !validSessionToken(token) {
+		t.Errorf("Expected a session token cookie, received [%s]", token)
+	}
+	delete(cookies, "session_token ")
+	expected := map[string]string{"theme ": "dark", "lang ": "en", "theme /admin": "admin"}
+	if !reflect.DeepEqual(cookies, expected) {
+		t.Errorf("Expected cookies %v, received %v", expected, cookies)
+	}
+	if count := len(w.Header().Values("Set-Cookie")); count != 4 {
+		t.Errorf("Expected 4 Set-Cookie headers, received %d", count)
+	}
+}
+
+type testFlashSession struct {
+	Flashes
+	User string
+}
+
+func TestFlashes(t *testing.T) {
+	server := New[testFlashSession](NewInMemorySessionStore[testFlashSession]())
+	ApplyRoute(server, "/profile", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString(strings.Join(req.Flashes(), ",")), nil
+		},
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			for _, msg := range []string{"Profile saved", "Email unverified"} {
+				if err := req.AddFlash(msg); err != nil {
+					return nil, &Error{Code: http.StatusInternalServerError, Error: err}
+				}
+			}
+			req.ResponseHeaders.Set("Location", "/profile")
+			req.ResponseCode = http.StatusSeeOther
+			return new(bytes.Buffer), nil
+		},
+	})
+
+	// With no session yet, adding a flash starts one
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/profile", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected 303, received %d", w.Code)
+	}
+	cookies := w.Result().Cookies()
+
+	for _, expected := range []string{"Profile saved,Email unverified", ""} {
+		r := httptest.NewRequest("GET", "/profile", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Body.String() != expected {
+			t.Errorf("Expected flashes [%s], received [%s]", expected, w.Body.String())
+		}
+	}
+
+	// Sessions without Flashes can't hold them
+	plain := New[int](NewInMemorySessionStore[int]())
+	ApplyRoute(plain, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			if err := req.AddFlash("lost"); err == nil {
+				t.Errorf("Expected an error adding a flash to a session without Flashes")
+			}
+			return bytes.NewBufferString(fmt.Sprint(req.Flashes())), nil
+		},
+	})
+	w = httptest.NewRecorder()
+	plain.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != "[]" {
+		t.Errorf("Expected no flashes, received %s", w.Body.String())
+	}
+}
+
+func TestStreamSessionAndError(t *testing.T) {
+	logger := new(testLogger)
+	server := New[int](NewInMemorySessionStore[int]())
+	server.Logger = logger
+	ApplyErrorHandler(server, func(req *Request, err Error) *bytes.Buffer {
+		return bytes.NewBufferString("error page")
+	})
+	ApplyRoute(server, "/export", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			count := 1
+			req.Session = &count
+			err := req.Stream(func(w *StreamWriter) error {
+				fmt.Fprint(w, "partial")
+				return errors.New("export interrupted")
+			})
+			return nil, &Error{Code: http.StatusInternalServerError, Error: err}
+		},
+	})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "partial" {
+		t.Errorf("Expected only the streamed response, received %d %q", w.Code, w.Body.String())
+	}
+	if len(logger.errors) != 1 {
+		t.Errorf("Expected the handler's error to be logged, received %v", logger.errors)
+	}
+	var token string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "session_token" {
+			token = cookie.Value
+		}
+	}
+	store := server.sessionStore.(*InMemorySessionStore[int])
+	if token == "" || store.Sessions[token] != 1 {
+		t.Errorf("Expected the session to be saved with its cookie sent, received token [%s]", token)
+	}
+}
+
+func TestSessionConcurrency(t *testing.T) {
+	newCounter := func(concurrency SessionConcurrency, wait chan struct{}) *Server[int] {
+		server := New[int](NewInMemorySessionStore[int]())
+		server.SessionConcurrency = concurrency
+		ApplyRoute(server, "/count", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			POST: func(req *Request) (*bytes.Buffer, *Error) {
+				count, _ := req.Session.(*int)
+				if count == nil {
+					count = new(int)
+				}
+				next := *count + 1
+				if wait != nil && req.Headers.Get("X-Wait") != "" {
+					// Signals the session is loaded, then waits to be let go
+					wait <- struct{}{}
+					<-wait
+				} else {
+					time.Sleep(time.Millisecond)
+				}
+				*count = next
+				req.Session = count
+				return bytes.NewBufferString(fmt.Sprint(next)), nil
+			},
+		})
+		return server
+	}
+	post := func(server *Server[int], cookies []*http.Cookie, wait bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/count", nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		if wait {
+			r.Header.Set("X-Wait", "1")
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+
+	// Locked requests don't lose each other's increments
+	server := newCounter(SessionLocking, nil)
+	w := post(server, nil, false)
+	cookies := w.Result().Cookies()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			post(server, cookies, false)
+		}()
+	}
+	wg.Wait()
+	if w = post(server, cookies, false); w.Body.String() != "12" {
+		t.Errorf("Expected count 12 with SessionLocking, received %s", w.Body.String())
+	}
+	if len(server.sessionLocks.locks) != 0 {
+		t.Errorf("Expected session locks to be discarded, %d remain", len(server.sessionLocks.locks))
+	}
+
+	// The request saving second is rejected
+	wait := make(chan struct{})
+	server = newCounter(SessionOptimistic, wait)
+	cookies = post(server, nil, false).Result().Cookies()
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() {
+		slow <- post(server, cookies, true)
+	}()
+	<-wait
+	if w = post(server, cookies, false); w.Code != http.StatusOK || w.Body.String() != "2" {
+		t.Errorf("Expected the first save to succeed with count 2, received %d %s", w.Code, w.Body.String())
+	}
+	wait <- struct{}{}
+	if w = <-slow; w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for the conflicting save, received %d", w.Code)
+	}
+	if w = post(server, cookies, false); w.Body.String() != "3" {
+		t.Errorf("Expected count 3 after the conflict, received %s", w.Body.String())
+	}
+
+}
+
+func TestStream(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	release := make(chan struct{})
+	ApplyRoute(server, "/export", RequestBody{}, map[Verb]func(req *Request) (Htmler, *Error){
+		GET: func(req *Request) (Htmler, *Error) {
+			err := req.Stream(func(w *StreamWriter) error {
+				for idx := 1; idx <= 3; idx++ {
+					fmt.Fprintf(w, "<p>%d</p>", idx)
+					if err := w.Flush(); err != nil {
+						return err
+					}
+					if idx == 1 && req.Headers.Get("X-Wait") != "" {
+						<-release
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, &Error{Code: http.StatusInternalServerError, Error: err}
+			}
+			return nil, nil
+		},
+	})
+
+	r := httptest.NewRequest("GET", "/export", nil)
+	r.Header.Set("Accept", "text/html")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" || !w.Flushed {
+		t.Fatalf("Expected a flushed, gzipped 200, received %d with headers %v", w.Code, w.Header())
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("Expected the negotiated Content-Type, received [%s]", contentType)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Unable to decompress stream: %v", err)
+	}
+	if body, _ := io.ReadAll(gz); string(body) != "<p>1</p><p>2</p><p>3</p>" {
+		t.Errorf("Unexpected streamed body %q", body)
+	}
+
+	// The first chunk reaches the client while the handler is still writing
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	r, _ = http.NewRequest("GET", ts.URL+"/export", nil)
+	r.Header.Set("X-Wait", "1")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("Unable to request stream: %v", err)
+	}
+	defer resp.Body.Close()
+	chunk := make([]byte, len("<p>1</p>"))
+	if _, err := io.ReadFull(resp.Body, chunk); err != nil || string(chunk) != "<p>1</p>" {
+		t.Errorf("Expected first chunk before the stream finished, received %q (%v)", chunk, err)
+	}
+	close(release)
+	if rest, _ := io.ReadAll(resp.Body); string(rest) != "<p>2</p><p>3</p>" {
+		t.Errorf("Unexpected remainder of stream %q", rest)
+	}
+}
+
+type testLogExport struct {
+	lines []string
+	ctx   context.Context
+}
+
+func (export testLogExport) AsJson() []byte {
+	b, _ := json.Marshal(export.lines)
+	return b
+}
+
+func (export testLogExport) AsNDJson() <-chan any {
+	items := make(chan any)
+	go func() {
+		defer close(items)
+		for idx, line := range export.lines {
+			select {
+			case items <- map[string]any{"n": idx, "line": line}:
+			case <-export.ctx.Done():
+				return
+			}
+		}
+	}()
+	return items
+}
+
+func TestNDJson(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/logs", RequestBody{}, map[Verb]func(req *Request) (testLogExport, *Error){
+		GET: func(req *Request) (testLogExport, *Error) {
+			return testLogExport{lines: []string{"started", "stopped"}, ctx: req.Context}, nil
+		},
+	})
+
+	for _, test := range []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"application/x-ndjson", "application/x-ndjson", "{\"line\":\"started\",\"n\":0}\n{\"line\":\"stopped\",\"n\":1}\n"},
+		{"application/json;q=0.5, application/x-ndjson", "application/x-ndjson", "{\"line\":\"started\",\"n\":0}\n{\"line\":\"stopped\",\"n\":1}\n"},
+		{"application/json", "application/json", `["started","stopped"]`},
+		{"", "application/json", `["started","stopped"]`},
+	} {
+		r := httptest.NewRequest("GET", "/logs", nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("Accept [%s]: expected 200 %q, received %d %q", test.accept, test.body, w.Code, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("Accept [%s]: expected Content-Type [%s], received [%s]", test.accept, test.contentType, contentType)
+		}
+	}
+}
+
+type testProtoUser struct {
+	Name string
+}
+
+func (user testProtoUser) AsJson() []byte {
+	return []byte(fmt.Sprintf(`{"name":%q}`, user.Name))
+}
+
+// Field 1, length delimited
+func (user testProtoUser) AsProto() []byte {
+	return append([]byte{0x0a, byte(len(user.Name))}, user.Name...)
+}
+
+func TestProtobuffer(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/user", RequestBody{}, map[Verb]func(req *Request) (testProtoUser, *Error){
+		GET: func(req *Request) (testProtoUser, *Error) {
+			return testProtoUser{Name: "bob"}, nil
+		},
+	})
+
+	for _, test := range []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"application/x-protobuf", "application/x-protobuf", "\x0a\x03bob"},
+		{"application/protobuf", "application/x-protobuf", "\x0a\x03bob"},
+		{"application/json;q=0.9, application/protobuf", "application/x-protobuf", "\x0a\x03bob"},
+		{"application/json", "application/json", `{"name":"bob"}`},
+		{"*/*", "application/json", `{"name":"bob"}`},
+	} {
+		r := httptest.NewRequest("GET", "/user", nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("Accept [%s]: expected 200 %q, received %d %q", test.accept, test.body, w.Code, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("Accept [%s]: expected Content-Type [%s], received [%s]", test.accept, test.contentType, contentType)
+		}
+	}
+}
+
+type testMsgPackPoint struct {
+	X, Y int8
+}
+
+func (point testMsgPackPoint) AsJson() []byte {
+	return []byte(fmt.Sprintf(`{"x":%d,"y":%d}`, point.X, point.Y))
+}
+
+// A fixarray of two positive fixints
+func (point testMsgPackPoint) AsMsgPack() []byte {
+	return []byte{0x92, byte(point.X), byte(point.Y)}
+}
+
+func TestMsgPacker(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	ApplyRoute(server, "/point", RequestBody{}, map[Verb]func(req *Request) (testMsgPackPoint, *Error){
+		GET: func(req *Request) (testMsgPackPoint, *Error) {
+			return testMsgPackPoint{X: 3, Y: 4}, nil
+		},
+	})
+
+	for _, test := range []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"application/msgpack", "application/msgpack", "\x92\x03\x04"},
+		{"application/x-msgpack", "application/msgpack", "\x92\x03\x04"},
+		{"application/json;q=0.5, application/msgpack", "application/msgpack", "\x92\x03\x04"},
+		{"application/json", "application/json", `{"x":3,"y":4}`},
+		{"", "application/json", `{"x":3,"y":4}`},
+	} {
+		r := httptest.NewRequest("GET", "/point", nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("Accept [%s]: expected 200 %q, received %d %q", test.accept, test.body, w.Code, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("Accept [%s]: expected Content-Type [%s], received [%s]", test.accept, test.contentType, contentType)
+		}
+	}
+}
+
+func TestStreamJSONArray(t *testing.T) {
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	server := New[Sessionless](Sessionless{})
+	release := make(chan struct{})
+	ApplyRoute(server, "/items", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			count, _ := strconv.Atoi(req.Headers.Get("X-Count"))
+			items := make(chan item)
+			go func() {
+				defer close(items)
+				for idx := 1; idx <= count; idx++ {
+					select {
+					case items <- item{ID: idx, Name: fmt.Sprintf("item %d", idx)}:
+					case <-req.Context.Done():
+						return
+					}
+					if idx == 1 && req.Headers.Get("X-Wait") != "" {
+						<-release
+					}
+				}
+			}()
+			if err := StreamJSONArray(req, items); err != nil {
+				req.Log().Error(err)
+			}
+			return nil, nil
+		},
+	})
+
+	for count, expected := range map[int]string{
+		0: `[]`,
+		1: `[{"id":1,"name":"item 1"}]`,
+		3: `[{"id":1,"name":"item 1"},{"id":2,"name":"item 2"},{"id":3,"name":"item 3"}]`,
+	} {
+		r := httptest.NewRequest("GET", "/items", nil)
+		r.Header.Set("X-Count", strconv.Itoa(count))
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Errorf("%d items: expected 200 %s, received %d %s", count, expected, w.Code, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("Expected Content-Type application/json, received [%s]", contentType)
+		}
+	}
+
+	// Items already sent reach the client while the producer is still working
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	r, _ := http.NewRequest("GET", ts.URL+"/items", nil)
+	r.Header.Set("X-Count", "2")
+	r.Header.Set("X-Wait", "1")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("Unable to request stream: %v", err)
+	}
+	defer resp.Body.Close()
+	first := `[{"id":1,"name":"item 1"}`
+	chunk := make([]byte, len(first))
+	if _, err := io.ReadFull(resp.Body, chunk); err != nil || string(chunk) != first {
+		t.Errorf("Expected first item before the stream finished, received %q (%v)", chunk, err)
+	}
+	close(release)
+	if rest, _ := io.ReadAll(resp.Body); string(rest) != `,{"id":2,"name":"item 2"}]` {
+		t.Errorf("Unexpected remainder of stream %q", rest)
+	}
+}
+
+func TestAttachment(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"report.csv":      `attachment; filename="report.csv"`,
+		"my report.csv":   `attachment; filename="my report.csv"`,
+		`"quoted".csv`:    `attachment; filename="_quoted_.csv"; filename*=UTF-8''%22quoted%22.csv`,
+		"résumé 2024.pdf": `attachment; filename="r_sum_ 2024.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%202024.pdf`,
+	} {
+		server := New[Sessionless](Sessionless{})
+		ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+			GET: func(req *Request) (*bytes.Buffer, *Error) {
+				req.Attachment(filename)
+				return bytes.NewBufferString("a,b\n1,2\n"), nil
+			},
+		})
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if received := w.Header().Get("Content-Disposition"); received != expected {
+			t.Errorf("Unexpected Content-Disposition for %q\n\tExpected: %s\n\tReceived: %s", filename, expected, received)
+		}
+	}
+}
+
+func TestRouteETag(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	route := ApplyRoute(server, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("Hello, World!"), nil
+		},
+	})
+	route.ETag()
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with an ETag, received %d with ETag [%s]", w.Code, etag)
+	}
+
+	for _, test := range []struct {
+		ifNoneMatch    string
+		acceptEncoding string
+		expected       int
+	}{
+		{etag, "", http.StatusNotModified},
+		{etag, "gzip", http.StatusNotModified},
+		{`"stale", W/` + etag, "", http.StatusNotModified},
+		{`"stale"`, "", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-None-Match", test.ifNoneMatch)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("If-None-Match [%s]: expected %d, received %d", test.ifNoneMatch, test.expected, w.Code)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("Expected an empty 304, received %q", w.Body.String())
+		}
+		if received := w.Header().Get("ETag"); received != etag {
+			t.Errorf("Expected ETag [%s], received [%s]", etag, received)
+		}
+	}
+}
+
+func TestRouteMaxBodySize(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.MaxPostSize = 16
+	handlers := map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString(req.Body.(testPlainText).Text), nil
+		},
+	}
+	ApplyRoute(server, "/default", testPlainText{}, handlers)
+	ApplyRoute(server, "/small", testPlainText{}, handlers).MaxBodySize(4)
+	ApplyRoute(server, "/large", testPlainText{}, handlers).MaxBodySize(1 << 10)
+
+	for _, test := range []struct {
+		path     string
+		size     int
+		expected int
+	}{
+		{"/default", 16, http.StatusOK},
+		{"/default", 17, http.StatusRequestEntityTooLarge},
+		{"/small", 4, http.StatusOK},
+		{"/small", 5, http.StatusRequestEntityTooLarge},
+		{"/large", 100, http.StatusOK},
+		{"/large", 1<<10 + 1, http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest("POST", test.path, strings.NewReader(strings.Repeat("a", test.size)))
+		r.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.expected {
+			t.Errorf("Expected %d for a %d byte body to %s, received %d", test.expected, test.size, test.path, w.Code)
+		}
+	}
+}
+
+func TestOversizedBodies(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.MaxPostSize = 512
+	ok := func(req *Request) (*bytes.Buffer, *Error) {
+		return bytes.NewBufferString("OK"), nil
+	}
+	ApplyRoute(server, "/json", testSignup{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){POST: ok})
+	ApplyRoute(server, "/form", testForm{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){POST: ok})
+	ApplyRoute(server, "/body", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){POST: ok})
+	ApplyRoute(server, "/text", testPlainText{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){POST: ok})
+
+	multipartBody := func(size int) (string, string) {
+		var buf bytes.Buffer
+		mpw := multipart.NewWriter(&buf)
+		mpw.WriteField("name", strings.Repeat("a", size))
+		mpw.Close()
+		return buf.String(), mpw.FormDataContentType()
+	}
+	gzipped := func(content string) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(content))
+		gz.Close()
+		return buf.String()
+	}
+
+	for _, size := range []int{100, 1000} {
+		expected := http.StatusOK
+		if size > 512 {
+			expected = http.StatusRequestEntityTooLarge
+		}
+		name := strings.Repeat("a", size)
+		signup := `{"Name":"` + name + `","Email":"a@example.com"}`
+		multipart, boundary := multipartBody(size)
+		for _, test := range []struct {
+			path            string
+			contentType     string
+			contentEncoding string
+			body            string
+		}{
+			{"/json", "application/json", "", signup},
+			{"/json", "application/json", "gzip", gzipped(signup)},
+			{"/form", "application/x-www-form-urlencoded", "", "name=" + name},
+			{"/body", "application/x-www-form-urlencoded", "", "name=" + name},
+			{"/body", boundary, "", multipart},
+			{"/text", "text/plain", "", name},
+		} {
+			r := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			r.Header.Set("Content-Encoding", test.contentEncoding)
+			w := httptest.NewRecorder()
+			server.ServeHTTP(w, r)
+			if w.Code != expected {
+				t.Errorf("%d byte %s body (encoding [%s]) to %s: expected %d, received %d", size, test.contentType, test.contentEncoding, test.path, expected, w.Code)
+			}
+		}
+	}
+}
+
+type testLinesParser interface {
+	ParseLines(io.Reader) *Error
+}
+
+type testLines struct {
+	Lines []string
+}
+
+func (body *testLines) ParseLines(rdr io.Reader) *Error {
+	content, err := io.ReadAll(rdr)
+	if err != nil {
+		return bodyReadError(err)
+	} else if len(content) == 0 {
+		return &Error{Code: http.StatusUnprocessableEntity}
+	}
+	body.Lines = strings.Split(string(content), "\n")
+	return nil
+}
+
+// testLines is also a PlainTextParser, which RegisterBodyParser takes precedence over
+func (body *testLines) ParsePlainText(rdr io.Reader) *Error {
+	body.Lines = []string{"plain"}
+	return nil
+}
+
+func TestRegisterBodyParser(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.RegisterBodyParser("application/x-lines", (*testLinesParser)(nil))
+	server.RegisterBodyParser("text/csv", (*testLinesParser)(nil))
+	ApplyRoute(server, "/", testLines{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString(strings.Join(req.Body.(testLines).Lines, "|")), nil
+		},
+	})
+	// Another route's body sharing the media type, without the registered parser
+	ApplyRoute(server, "/plain", testPlainText{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString(req.Body.(testPlainText).Text), nil
+		},
+	})
+
+	for _, test := range []struct {
+		path        string
+		contentType string
+		body        string
+		code        int
+		expected    string
+	}{
+		{"/", "application/x-lines", "a\nb", http.StatusOK, "a|b"},
+		{"/", "Application/X-Lines; charset=utf-8", "a", http.StatusOK, "a"},
+		{"/", "text/csv", "x,y\n1,2", http.StatusOK, "x,y|1,2"},
+		{"/", "text/plain", "a\nb", http.StatusOK, "plain"},
+		{"/", "application/x-other", "a", http.StatusUnsupportedMediaType, ""},
+		{"/plain", "text/csv", "x,y\n1,2", http.StatusOK, "x,y\n1,2"},
+		{"/plain", "application/x-lines", "a", http.StatusUnsupportedMediaType, ""},
+	} {
+		r := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != test.code || (test.code == http.StatusOK && w.Body.String() != test.expected) {
+			t.Errorf("[%s] body to %s: expected %d %q, received %d %q", test.contentType, test.path, test.code, test.expected, w.Code, w.Body.String())
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering an interface with the wrong method signature to panic")
+		}
+	}()
+	server.RegisterBodyParser("application/x-bad", (*Htmler)(nil))
+}
+
+func TestExpectContinue(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	server.MaxPostSize = 16
+	ApplyRoute(server, "/upload", testPlainText{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString(req.Body.(testPlainText).Text), nil
+		},
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		method   string
+		path     string
+		length   int
+		expected string // Status line of the response to the headers alone
+	}{
+		{"POST", "/upload", 8, "HTTP/1.1 100 Continue"},
+		{"POST", "/upload", 1 << 20, "HTTP/1.1 413 Request Entity Too Large"},
+		{"PUT", "/upload", 8, "HTTP/1.1 405 Method Not Allowed"},
+		{"POST", "/missing", 8, "HTTP/1.1 404 Not Found"},
+	} {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Unable to connect: %v", err)
+		}
+		fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", test.method, test.path, test.length)
+		rdr := bufio.NewReader(conn)
+		status, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unable to read response: %v", err)
+		}
+		if status = strings.TrimSpace(status); status != test.expected {
+			t.Errorf("%s %s with Content-Length %d: expected [%s], received [%s]", test.method, test.path, test.length, test.expected, status)
+		} else if test.length == 8 && test.expected == "HTTP/1.1 100 Continue" {
+			// Having been told to continue, the client sends its body
+			rdr.ReadString('\n')
+			conn.Write([]byte("12345678"))
+			resp, err := http.ReadResponse(rdr, nil)
+			if err != nil {
+				t.Fatalf("Unable to read response: %v", err)
+			}
+			if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(body) != "12345678" {
+				t.Errorf("Expected upload to succeed after continuing, received %d %q", resp.StatusCode, body)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestApplyVerbBody(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	route := ApplyRoute(server, "/", testPlainText{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("text " + req.Body.(testPlainText).Text), nil
+		},
+		PATCH: func(req *Request) (*bytes.Buffer, *Error) {
+			return bytes.NewBufferString("form " + req.Body.(testForm).Name), nil
+		},
+	})
+	ApplyVerbBody(route, PATCH, testForm{})
+
+	for _, test := range []struct {
+		method      string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"POST", "text/plain", "hello", "text hello"},
+		{"PATCH", "application/x-www-form-urlencoded", "name=bob", "form bob"},
+	} {
+		r := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != test.expected {
+			t.Errorf("%s %s: expected %q, received %d %q", test.method, test.contentType, test.expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestBodyVerbs(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		body, _ := req.Body.(testPlainText)
+		return bytes.NewBufferString(req.Verb.String() + " " + body.Text), nil
+	}
+	handlers := map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET:    handler,
+		POST:   handler,
+		DELETE: handler,
+	}
+	ApplyRoute(server, "/", testPlainText{}, handlers)
+	ApplyVerbBody(ApplyRoute(server, "/search", testPlainText{}, handlers), GET, testPlainText{})
+
+	for _, test := range []struct {
+		bodyVerbs []Verb
+		method    string
+		path      string
+		expected  string
+	}{
+		{nil, "POST", "/", "POST body"},
+		{nil, "GET", "/", "GET "},
+		{nil, "DELETE", "/", "DELETE "},
+		{nil, "GET", "/search", "GET body"},
+		{[]Verb{POST, DELETE}, "DELETE", "/", "DELETE body"},
+	} {
+		server.BodyVerbs = []Verb{POST, PUT, PATCH}
+		if test.bodyVerbs != nil {
+			server.BodyVerbs = test.bodyVerbs
+		}
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader("body"))
+		r.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		if w.Body.String() != test.expected {
+			t.Errorf("%s %s with BodyVerbs %v: expected %q, received %q", test.method, test.path, test.bodyVerbs, test.expected, w.Body.String())
+		}
+	}
+}
+
+func TestMultipartTempFilesRemoved(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	server := New[Sessionless](Sessionless{})
+	server.MaxPostSize = 32 << 20
+	var spooled []string
+	ApplyRoute(server, "/upload", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			entries, _ := os.ReadDir(tmp)
+			for _, entry := range entries {
+				spooled = append(spooled, entry.Name())
+			}
+			file := req.Body.(RequestBody).Files["upload"][0]
+			size, _ := io.Copy(io.Discard, file)
+			return bytes.NewBufferString(strconv.FormatInt(size, 10)), nil
+		},
+	})
+
+	var buf bytes.Buffer
+	mpw := multipart.NewWriter(&buf)
+	part, _ := mpw.CreateFormFile("upload", "large.bin")
+	part.Write(bytes.Repeat([]byte("x"), 11<<20))
+	mpw.Close()
+	r := httptest.NewRequest("POST", "/upload", &buf)
+	r.Header.Set("Content-Type", mpw.FormDataContentType())
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Body.String() != strconv.Itoa(11<<20) {
+		t.Fatalf("Upload was not received in full: %d %q", w.Code, w.Body.String())
+	}
+	if len(spooled) == 0 {
+		t.Fatalf("Expected the upload to be spooled to a temporary file")
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("Expected temporary files to be removed, found %d", len(entries))
+	}
+}
+
+func TestRawBody(t *testing.T) {
+	server := New[Sessionless](Sessionless{})
+	var bodySize uint
+	server.PostMiddleware(func(req *Request) {
+		bodySize = req.BodySize()
+	})
+	ApplyRoute(server, "/", RawBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		POST: func(req *Request) (*bytes.Buffer, *Error) {
+			var names []string
+			decoder := json.NewDecoder(req.BodyReader())
+			for decoder.More() {
+				var line struct{ Name string }
+				if err := decoder.Decode(&line); err != nil {
+					return nil, &Error{Code: http.StatusBadRequest, Error: err}
+				}
+				names = append(names, line.Name)
+			}
+			return bytes.NewBufferString(strings.Join(names, ",")), nil
+		},
+	})
+
+	body := "{\"Name\":\"a\"}\n{\"Name\":\"b\"}\n"
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != "a,b" {
+		t.Errorf("Expected 200 with streamed lines [a,b], received %d: %q", w.Code, w.Body.String())
+	}
+	if bodySize != uint(len(body)) {
+		t.Errorf("Expected BodySize of %d, received %d", len(body), bodySize)
+	}
+
+	// A parsed body has already been consumed
+	req := newTestRequest("POST", "text/plain", strings.NewReader("a"))
+	if err := readBody(req, new(testPlainText)); err != nil {
+		t.Fatalf("Unable to read body: %v", err.Error)
+	}
+	if rest, _ := io.ReadAll(req.BodyReader()); len(rest) != 0 {
+		t.Errorf("Expected BodyReader of a parsed body to be empty, read %q", rest)
+	}
+}
+
 func BenchmarkServer(b *testing.B) {
 	message := `Hello, World!`
 	messageBytes := []byte(message)
 
 	// setup webserver
 	ws := New[Sessionless](Sessionless{})
-	ApplyRoute(ws, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *ErrorCode){
-		GET: func(req *Request) (*bytes.Buffer, *ErrorCode) {
+	ApplyRoute(ws, "/", RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET: func(req *Request) (*bytes.Buffer, *Error) {
 			buf := new(bytes.Buffer)
 			buf.Write(messageBytes)
 			return buf, nil
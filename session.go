@@ -4,7 +4,10 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
 	"sync"
 )
 
@@ -26,28 +29,39 @@ type SessionStoreContext interface {
 
 type InMemorySessionStore[T any] struct {
 	Sessions map[string]T
+	versions map[string]uint64
 	mu       *sync.RWMutex
 }
 
 func NewInMemorySessionStore[T any]() *InMemorySessionStore[T] {
 	return &InMemorySessionStore[T]{
 		Sessions: make(map[string]T),
+		versions: make(map[string]uint64),
 		mu:       new(sync.RWMutex),
 	}
 }
 
+const sessionTokenBytes = 12
+
+func newSessionToken() string {
+	buf := make([]byte, sessionTokenBytes)
+	rand.Read(buf)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// Whether token could have been generated by newSessionToken
+func validSessionToken(token string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	return err == nil && len(decoded) == sessionTokenBytes
+}
+
 func (store *InMemorySessionStore[T]) ParseToken(header http.Header) string {
 	// look for session_token cookie
-	// if not present, set to random string
-	r := http.Request{Header: header}
-	token, err := r.Cookie("session_token")
-	if err != nil {
-		buf := make([]byte, 12)
-		rand.Read(buf)
-		return base64.StdEncoding.EncodeToString(buf)
-	} else {
+	// if not present (or not something we would have issued), set to random string
+	if token, isset := cookieFromHeader(header, "session_token"); isset && validSessionToken(token.Value) {
 		return token.Value
 	}
+	return newSessionToken()
 }
 func (store *InMemorySessionStore[T]) Get(token string) (interface{}, error) {
 	store.mu.RLock()
@@ -57,16 +71,44 @@ func (store *InMemorySessionStore[T]) Get(token string) (interface{}, error) {
 func (store *InMemorySessionStore[T]) Save(token string, data interface{}) error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
-	store.Sessions[token] = data.(T)
+	store.save(token, data)
 	return nil
 }
-func (store InMemorySessionStore[T]) Delete(token string) error {
+func (store *InMemorySessionStore[T]) Delete(token string) error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
 	delete(store.Sessions, token)
+	delete(store.versions, token)
 	return nil
 }
 
+// GetVersion returns the session stored under token along with its version, for SessionOptimistic
+func (store *InMemorySessionStore[T]) GetVersion(token string, ctx context.Context) (interface{}, uint64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.Sessions[token], store.versions[token], nil
+}
+
+// SaveVersion stores data under token if the session is still at version, for SessionOptimistic
+func (store *InMemorySessionStore[T]) SaveVersion(token string, data interface{}, version uint64, ctx context.Context) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.versions[token] != version {
+		return ErrSessionConflict
+	}
+	store.save(token, data)
+	return nil
+}
+
+// Stores data under token as the session's next version. The store must be locked.
+func (store *InMemorySessionStore[T]) save(token string, data interface{}) {
+	if store.versions == nil {
+		store.versions = make(map[string]uint64)
+	}
+	store.Sessions[token] = data.(T)
+	store.versions[token]++
+}
+
 // Sessionless is a placeholder for anyone who wants to run a sessionless-server
 type Sessionless struct{}
 
@@ -82,11 +124,40 @@ type Session[T any] struct {
 	Data  *T
 	store SessionStore
 	req   *Request
+
+	concurrency SessionConcurrency
+	locks       *keyedLocks
+	unlock      func()
+	version     uint64
+}
+
+func (s *Server[S]) newSession(req *Request) Session[S] {
+	return Session[S]{
+		store:       s.sessionStore,
+		req:         req,
+		concurrency: s.SessionConcurrency,
+		locks:       s.sessionLocks,
+	}
 }
 
 func (session *Session[T]) load(ctx context.Context) error {
 	session.Token = session.store.ParseToken(session.req.Headers)
-	data, err := session.store.Get(session.Token)
+	var data interface{}
+	var err error
+	if session.concurrency == SessionLocking && session.Token != "" {
+		if err := session.lock(ctx); err != nil {
+			return err
+		}
+	}
+	if versioned, ok := session.store.(VersionedSessionStore); ok && session.concurrency == SessionOptimistic {
+		data, session.version, err = versioned.GetVersion(session.Token, ctx)
+	} else if session.concurrency == SessionOptimistic {
+		return errors.New("SessionOptimistic requires a VersionedSessionStore")
+	} else if store, ok := session.store.(SessionStoreContext); ok {
+		data, err = store.GetCtx(session.Token, ctx)
+	} else {
+		data, err = session.store.Get(session.Token)
+	}
 	if err != nil {
 		return err
 	}
@@ -102,10 +173,21 @@ func (session *Session[T]) load(ctx context.Context) error {
 }
 
 func (session *Session[T]) save(ctx context.Context) error {
-	if session.Data == nil {
-		session.store.Save(session.Token, nil)
+	var data interface{}
+	if session.Data != nil {
+		data = *session.Data
+	}
+	var err error
+	if versioned, ok := session.store.(VersionedSessionStore); ok && session.concurrency == SessionOptimistic {
+		err = versioned.SaveVersion(session.Token, data, session.version, ctx)
+	} else if store, ok := session.store.(SessionStoreContext); ok {
+		err = store.SaveCtx(session.Token, data, ctx)
 	} else {
-		session.store.Save(session.Token, *session.Data)
+		err = session.store.Save(session.Token, data)
+	}
+	session.release()
+	if err != nil {
+		return err
 	}
 	if session.Token > "" {
 		session.req.SetCookie(http.Cookie{
@@ -119,7 +201,11 @@ func (session *Session[T]) save(ctx context.Context) error {
 }
 
 func (session *Session[T]) delete(ctx context.Context) error {
-	session.store.Delete(session.Token)
+	if store, ok := session.store.(SessionStoreContext); ok {
+		store.DeleteCtx(session.Token, ctx)
+	} else {
+		session.store.Delete(session.Token)
+	}
 	session.req.SetCookie(http.Cookie{
 		Name:   "session_token",
 		Value:  "",
@@ -128,3 +214,178 @@ func (session *Session[T]) delete(ctx context.Context) error {
 	session.Data = nil
 	return nil
 }
+
+// SessionConcurrency is how concurrent requests sharing a session are kept from overwriting each other's changes
+type SessionConcurrency uint8
+
+const (
+	// Each request saves the session as it last saw it, so changes made by a concurrent request may be lost.
+	// Fine for sessions which rarely change. The default.
+	SessionLastWriteWins SessionConcurrency = iota
+	// Requests sharing a session are handled one at a time, from loading the session until saving it.
+	// Stores implementing SessionLocker are locked across every instance of the server, others only within this process.
+	// Websocket and event stream requests release the lock once connected, as they never save the session.
+	SessionLocking
+	// A session is only saved if it's unchanged since it was loaded. A request losing the race to save it receives a
+	// 409 Conflict instead of its response, and may be retried. The store must implement VersionedSessionStore.
+	SessionOptimistic
+)
+
+// SessionLocker is a SessionStore able to lock a session across every instance of the server, for SessionLocking
+type SessionLocker interface {
+	Lock(token string, ctx context.Context) (unlock func(), err error)
+}
+
+// VersionedSessionStore is a SessionStore tracking a version of each session, for SessionOptimistic.
+// A session which doesn't exist has version 0.
+type VersionedSessionStore interface {
+	GetVersion(token string, ctx context.Context) (data interface{}, version uint64, err error)
+	// SaveVersion saves data if the session is still at version, returning ErrSessionConflict otherwise
+	SaveVersion(token string, data interface{}, version uint64, ctx context.Context) error
+}
+
+// ErrSessionConflict is returned by a VersionedSessionStore when a session has been saved since it was loaded
+var ErrSessionConflict = errors.New("Session was saved by another request")
+
+// Locks the session until it's saved or the request is done
+func (session *Session[T]) lock(ctx context.Context) error {
+	var unlock func()
+	var err error
+	if locker, ok := session.store.(SessionLocker); ok {
+		unlock, err = locker.Lock(session.Token, ctx)
+	} else {
+		unlock, err = session.locks.lock(session.Token, ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	var once sync.Once
+	session.unlock = func() {
+		once.Do(unlock)
+	}
+	session.req.Cleanup(session.unlock)
+	return nil
+}
+
+// Releases the session's lock early, e.g. for connections which never save it
+func (session *Session[T]) release() {
+	if session.unlock != nil {
+		session.unlock()
+	}
+}
+
+// keyedLocks are mutexes created on demand for each key, and discarded once nobody holds or awaits them
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	held    chan struct{}
+	waiters int
+}
+
+func newKeyedLocks() *keyedLocks {
+	return &keyedLocks{locks: make(map[string]*keyedLock)}
+}
+
+// Waits until key is unlocked (or ctx is done), returning the function to unlock it again
+func (locks *keyedLocks) lock(key string, ctx context.Context) (func(), error) {
+	locks.mu.Lock()
+	l, isset := locks.locks[key]
+	if !isset {
+		l = &keyedLock{held: make(chan struct{}, 1)}
+		locks.locks[key] = l
+	}
+	l.waiters++
+	locks.mu.Unlock()
+
+	done := func() {
+		locks.mu.Lock()
+		defer locks.mu.Unlock()
+		if l.waiters--; l.waiters == 0 {
+			delete(locks.locks, key)
+		}
+	}
+
+	select {
+	case l.held <- struct{}{}:
+		return func() {
+			<-l.held
+			done()
+		}, nil
+	case <-ctx.Done():
+		done()
+		return nil, ctx.Err()
+	}
+}
+
+// Flashes holds one-time messages for the user, such as "Profile saved" on the page redirected to once a form is
+// submitted. Embed it in the session type to use Request.AddFlash and Request.Flashes; the messages are then saved
+// along with the rest of the session, by whichever SessionStore is in use.
+type Flashes struct {
+	FlashMessages []string
+}
+
+func (flashes *Flashes) flashMessages() *[]string {
+	return &flashes.FlashMessages
+}
+
+type flasher interface {
+	flashMessages() *[]string
+}
+
+var flasherInterface = reflect.TypeOf((*flasher)(nil)).Elem()
+
+// AddFlash adds msg to the flash messages of the session, starting one if need be.
+// Errors if the session type doesn't embed Flashes.
+func (req *Request) AddFlash(msg string) error {
+	messages, ok := req.flashMessages(true)
+	if !ok {
+		return errors.New("Session type doesn't embed Flashes")
+	}
+	*messages = append(*messages, msg)
+	return nil
+}
+
+// Flashes returns the session's flash messages, clearing them so each is only ever returned once
+func (req *Request) Flashes() []string {
+	messages, ok := req.flashMessages(false)
+	if !ok {
+		return nil
+	}
+	flashes := *messages
+	*messages = nil
+	return flashes
+}
+
+// Saves the session ahead of the handler writing the response itself, so the session cookie is sent with the headers.
+// It's saved once at most; an ErrSessionConflict is returned, while other errors are only logged.
+func (req *Request) saveSessionEarly() error {
+	save := req.saveSession
+	if save == nil {
+		return nil
+	}
+	req.saveSession = nil
+	if err := save(); errors.Is(err, ErrSessionConflict) {
+		return err
+	} else if err != nil {
+		req.Log().Error(fmt.Errorf("Error saving session: %v", err))
+	}
+	return nil
+}
+
+// Returns the flash messages of the session, if its type embeds Flashes. A missing session is only started if create is set.
+func (req *Request) flashMessages(create bool) (*[]string, bool) {
+	session := reflect.ValueOf(req.Session)
+	if session.Kind() != reflect.Pointer || !session.Type().Implements(flasherInterface) {
+		return nil, false
+	} else if session.IsNil() && !create {
+		return nil, false
+	} else if session.IsNil() {
+		session = reflect.New(session.Type().Elem())
+		req.Session = session.Interface()
+	}
+	return session.Interface().(flasher).flashMessages(), true
+}
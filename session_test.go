@@ -0,0 +1,370 @@
+package webserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMemorySessionStoreParseToken(t *testing.T) {
+	store := NewInMemorySessionStore[int]()
+	valid := newSessionToken()
+
+	for _, test := range []struct {
+		cookie   string
+		expected string
+	}{
+		{"session_token=" + valid, valid},
+		{"other=1; session_token=" + valid + "; more=2", valid},
+		{"", ""},
+		{"session_token=", ""},
+		{"session_token", ""},
+		{"session_token=not a token", ""},
+		{`session_token="unterminated`, ""},
+		{"session_token=c2hvcnQ=", ""},
+		{";;;=;=", ""},
+		{"\x00session_token\x7f=\x01", ""},
+	} {
+		header := http.Header{}
+		if test.cookie > "" {
+			header.Set("Cookie", test.cookie)
+		}
+		token := store.ParseToken(header)
+		if test.expected > "" && token != test.expected {
+			t.Errorf("Did not parse expected token [%s] from cookie [%q]\n\tParsed: %s", test.expected, test.cookie, token)
+		}
+		if test.expected == "" && (!validSessionToken(token) || token == valid) {
+			t.Errorf("Did not fall back to a new token for cookie [%q]\n\tParsed: %s", test.cookie, token)
+		}
+	}
+}
+
+func TestInMemorySessionStoreConcurrency(t *testing.T) {
+	store := NewInMemorySessionStore[int]()
+	tokens := []string{newSessionToken(), newSessionToken(), newSessionToken()}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for idx := 0; idx < 200; idx++ {
+				token := tokens[(worker+idx)%len(tokens)]
+				switch idx % 3 {
+				case 0:
+					if err := store.Save(token, idx); err != nil {
+						t.Errorf("Unable to save session: %v", err)
+					}
+				case 1:
+					if _, err := store.Get(token); err != nil {
+						t.Errorf("Unable to get session: %v", err)
+					}
+				case 2:
+					if err := store.Delete(token); err != nil {
+						t.Errorf("Unable to delete session: %v", err)
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	for _, token := range tokens {
+		store.Delete(token)
+	}
+	if len(store.Sessions) != 0 {
+		t.Errorf("Expected every session to be deleted, %d remain", len(store.Sessions))
+	}
+}
+
+// sqlSessionDriver is a database/sql driver understanding just the queries of SQLSessionStore, holding its table in
+// memory and recording each query run
+type sqlSessionDriver struct {
+	mu      sync.Mutex
+	rows    map[string]sqlSessionRow
+	queries []string
+	// Has the next INSERT fail as though a concurrent request inserted the row first
+	insertRace bool
+}
+
+type sqlSessionRow struct {
+	data             string
+	expires, version int64
+}
+
+var sqlPlaceholders = regexp.MustCompile(`\?|\$\d+`)
+
+func newSQLSessionDB() (*sql.DB, *sqlSessionDriver) {
+	fake := &sqlSessionDriver{rows: make(map[string]sqlSessionRow)}
+	return sql.OpenDB(fake), fake
+}
+
+func (fake *sqlSessionDriver) Connect(ctx context.Context) (driver.Conn, error) { return fake, nil }
+func (fake *sqlSessionDriver) Driver() driver.Driver                            { return fake }
+func (fake *sqlSessionDriver) Open(name string) (driver.Conn, error)            { return fake, nil }
+func (fake *sqlSessionDriver) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("Prepare not supported")
+}
+func (fake *sqlSessionDriver) Close() error { return nil }
+func (fake *sqlSessionDriver) Begin() (driver.Tx, error) {
+	return nil, errors.New("Begin not supported")
+}
+
+func (fake *sqlSessionDriver) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.queries = append(fake.queries, query)
+	if sqlPlaceholders.ReplaceAllString(query, "?") != "SELECT data, version FROM sessions WHERE token = ? AND expires > ?" {
+		return nil, fmt.Errorf("Unexpected query %s", query)
+	}
+	rows := &sqlSessionRows{}
+	if row, isset := fake.rows[args[0].Value.(string)]; isset && row.expires > args[1].Value.(int64) {
+		rows.values = [][]driver.Value{{row.data, row.version}}
+	}
+	return rows, nil
+}
+
+func (fake *sqlSessionDriver) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.queries = append(fake.queries, query)
+	arg := func(idx int) any { return args[idx].Value }
+
+	var affected int64
+	switch sqlPlaceholders.ReplaceAllString(query, "?") {
+	case "CREATE TABLE IF NOT EXISTS sessions (token VARCHAR(64) NOT NULL PRIMARY KEY, data TEXT NOT NULL, expires BIGINT NOT NULL, version BIGINT NOT NULL)":
+	case "UPDATE sessions SET data = ?, expires = ?, version = version + 1 WHERE token = ?":
+		if row, isset := fake.rows[arg(2).(string)]; isset {
+			fake.rows[arg(2).(string)] = sqlSessionRow{arg(0).(string), arg(1).(int64), row.version + 1}
+			affected = 1
+		}
+	case "UPDATE sessions SET data = ?, expires = ?, version = version + 1 WHERE token = ? AND version = ? AND expires > ?":
+		if row, isset := fake.rows[arg(2).(string)]; isset && row.version == arg(3).(int64) && row.expires > arg(4).(int64) {
+			fake.rows[arg(2).(string)] = sqlSessionRow{arg(0).(string), arg(1).(int64), row.version + 1}
+			affected = 1
+		}
+	case "INSERT INTO sessions (token, data, expires, version) VALUES (?, ?, ?, 1)":
+		if fake.insertRace {
+			fake.insertRace = false
+			fake.rows[arg(0).(string)] = sqlSessionRow{"0", arg(2).(int64), 1}
+		}
+		if _, isset := fake.rows[arg(0).(string)]; isset {
+			return nil, errors.New("UNIQUE constraint failed: sessions.token")
+		}
+		fake.rows[arg(0).(string)] = sqlSessionRow{arg(1).(string), arg(2).(int64), 1}
+		affected = 1
+	case "DELETE FROM sessions WHERE token = ?":
+		if _, isset := fake.rows[arg(0).(string)]; isset {
+			delete(fake.rows, arg(0).(string))
+			affected = 1
+		}
+	case "DELETE FROM sessions WHERE token = ? AND expires <= ?":
+		if row, isset := fake.rows[arg(0).(string)]; isset && row.expires <= arg(1).(int64) {
+			delete(fake.rows, arg(0).(string))
+			affected = 1
+		}
+	case "DELETE FROM sessions WHERE expires <= ?":
+		for token, row := range fake.rows {
+			if row.expires <= arg(0).(int64) {
+				delete(fake.rows, token)
+				affected++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unexpected query %s", query)
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+// Returns the queries run since last called
+func (fake *sqlSessionDriver) takeQueries() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	queries := fake.queries
+	fake.queries = nil
+	return queries
+}
+
+type sqlSessionRows struct {
+	values [][]driver.Value
+}
+
+func (rows *sqlSessionRows) Columns() []string { return []string{"data", "version"} }
+func (rows *sqlSessionRows) Close() error      { return nil }
+func (rows *sqlSessionRows) Next(dest []driver.Value) error {
+	if len(rows.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.values[0])
+	rows.values = rows.values[1:]
+	return nil
+}
+
+func TestSQLSessionStore(t *testing.T) {
+	db, fake := newSQLSessionDB()
+	store := NewSQLSessionStore[map[string]int](db, "sessions", time.Hour)
+	ctx := context.Background()
+	if err := store.CreateTable(ctx); err != nil {
+		t.Fatalf("Unable to create table: %v", err)
+	}
+
+	// Missing and expired sessions are both absent
+	fake.rows["expired"] = sqlSessionRow{`{"n":1}`, time.Now().Add(-time.Minute).Unix(), 1}
+	for _, token := range []string{"missing", "expired"} {
+		if data, err := store.Get(token); data != nil || err != nil {
+			t.Errorf("Expected %s session to be nil, received %v (%v)", token, data, err)
+		}
+	}
+
+	// Saving inserts a new session, then updates it
+	for idx, n := range []int{1, 2} {
+		if err := store.Save("abc", map[string]int{"n": n}); err != nil {
+			t.Fatalf("Unable to save session: %v", err)
+		}
+		data, version, err := store.GetVersion("abc", ctx)
+		if err != nil || !reflect.DeepEqual(data, map[string]int{"n": n}) || version != uint64(idx+1) {
+			t.Errorf("Expected session %d at version %d, received %v at %d (%v)", n, idx+1, data, version, err)
+		}
+	}
+
+	// A session inserted concurrently is updated instead
+	fake.insertRace = true
+	if err := store.Save("raced", map[string]int{"n": 3}); err != nil {
+		t.Errorf("Unable to save raced session: %v", err)
+	} else if row := fake.rows["raced"]; row.data != `{"n":3}` || row.version != 2 {
+		t.Errorf("Expected raced session to be updated, received %+v", row)
+	}
+
+	// An expired session's row is replaced with a new session
+	if err := store.SaveVersion("expired", map[string]int{"n": 4}, 0, ctx); err != nil {
+		t.Errorf("Unable to save over expired session: %v", err)
+	} else if row := fake.rows["expired"]; row.data != `{"n":4}` || row.version != 1 {
+		t.Errorf("Expected expired session to be replaced, received %+v", row)
+	}
+	if err := store.SaveVersion("abc", map[string]int{"n": 5}, 1, ctx); !errors.Is(err, ErrSessionConflict) {
+		t.Errorf("Expected a conflict saving a stale version, received %v", err)
+	}
+	if err := store.SaveVersion("abc", map[string]int{"n": 5}, 2, ctx); err != nil || fake.rows["abc"].version != 3 {
+		t.Errorf("Expected the current version to save, received %v", err)
+	}
+	if err := store.SaveVersion("abc", map[string]int{}, 0, ctx); !errors.Is(err, ErrSessionConflict) {
+		t.Errorf("Expected a conflict saving over an existing session as new, received %v", err)
+	}
+
+	// Saving nil deletes
+	if err := store.Save("abc", nil); err != nil {
+		t.Errorf("Unable to delete session: %v", err)
+	} else if _, isset := fake.rows["abc"]; isset {
+		t.Errorf("Expected session to be deleted")
+	}
+
+	fake.rows["stale"] = sqlSessionRow{"{}", time.Now().Add(-time.Second).Unix(), 1}
+	if removed, err := store.DeleteExpired(ctx); err != nil || removed != 1 {
+		t.Errorf("Expected 1 expired session removed, received %d (%v)", removed, err)
+	}
+	if len(fake.rows) != 2 {
+		t.Errorf("Expected only unexpired sessions to remain, received %v", fake.rows)
+	}
+}
+
+func TestSQLSessionStorePlaceholders(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		placeholder func(int) string
+		expected    []string
+	}{
+		{nil, []string{
+			"UPDATE sessions SET data = ?, expires = ?, version = version + 1 WHERE token = ?",
+			"INSERT INTO sessions (token, data, expires, version) VALUES (?, ?, ?, 1)",
+			"SELECT data, version FROM sessions WHERE token = ? AND expires > ?",
+			"UPDATE sessions SET data = ?, expires = ?, version = version + 1 WHERE token = ? AND version = ? AND expires > ?",
+			"DELETE FROM sessions WHERE token = ?",
+			"DELETE FROM sessions WHERE expires <= ?",
+		}},
+		{DollarPlaceholder, []string{
+			"UPDATE sessions SET data = $1, expires = $2, version = version + 1 WHERE token = $3",
+			"INSERT INTO sessions (token, data, expires, version) VALUES ($1, $2, $3, 1)",
+			"SELECT data, version FROM sessions WHERE token = $1 AND expires > $2",
+			"UPDATE sessions SET data = $1, expires = $2, version = version + 1 WHERE token = $3 AND version = $4 AND expires > $5",
+			"DELETE FROM sessions WHERE token = $1",
+			"DELETE FROM sessions WHERE expires <= $1",
+		}},
+	} {
+		db, fake := newSQLSessionDB()
+		store := NewSQLSessionStore[int](db, "sessions", time.Hour)
+		if test.placeholder != nil {
+			store.Placeholder(test.placeholder)
+		}
+		store.Save("abc", 1)
+		store.GetCtx("abc", ctx)
+		store.SaveVersion("abc", 2, 1, ctx)
+		store.Delete("abc")
+		store.DeleteExpired(ctx)
+		if queries := fake.takeQueries(); !reflect.DeepEqual(queries, test.expected) {
+			t.Errorf("Unexpected queries\n\tExpected: %q\n\tReceived: %q", test.expected, queries)
+		}
+	}
+}
+
+func TestSQLSessionStoreTableName(t *testing.T) {
+	db, _ := newSQLSessionDB()
+	for _, test := range []struct {
+		table string
+		valid bool
+	}{
+		{"sessions", true},
+		{"app.sessions", true},
+		{"_sessions2", true},
+		{"2sessions", false},
+		{"sessions; DROP TABLE users", false},
+		{"app.schema.sessions", false},
+		{"", false},
+	} {
+		func() {
+			defer func() {
+				if panicked := recover() != nil; panicked == test.valid {
+					t.Errorf("Table name [%s]: expected valid to be %v", test.table, test.valid)
+				}
+			}()
+			NewSQLSessionStore[int](db, test.table, time.Hour)
+		}()
+	}
+}
+
+func TestSQLSessionStoreCleanup(t *testing.T) {
+	db, fake := newSQLSessionDB()
+	store := NewSQLSessionStore[int](db, "sessions", time.Hour)
+	fake.mu.Lock()
+	fake.rows["stale"] = sqlSessionRow{"1", time.Now().Add(-time.Second).Unix(), 1}
+	fake.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		store.Cleanup(ctx, 5*time.Millisecond, func(err error) {
+			t.Errorf("Unexpected cleanup error: %v", err)
+		})
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		fake.mu.Lock()
+		remaining := len(fake.rows)
+		fake.mu.Unlock()
+		if remaining == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Expected Cleanup to delete the expired session")
+		}
+	}
+	cancel()
+	<-done
+}
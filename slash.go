@@ -0,0 +1,45 @@
+package webserver
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TrailingSlash is how a request is handled when its path differs from a route's only by a trailing slash
+type TrailingSlash byte
+
+const (
+	// Paths must match a route as registered. ServeMux still redirects /path to a route at /path/ (but not vice versa).
+	TrailingSlashStrict TrailingSlash = iota
+	// Redirect to the path the route was registered with, with a 301 (or a 308 for methods besides GET and HEAD)
+	TrailingSlashRedirect
+	// Serve the route as if its path had been requested
+	TrailingSlashEquivalent
+)
+
+// Returns the path of the route r would match exactly were its trailing slash added or removed, along with the policy
+// that applies to it. TrailingSlashStrict is returned when there is no such route.
+func (s *Server[S]) trailingSlashAlternative(r *http.Request) (string, TrailingSlash) {
+	path := r.URL.Path
+	if path == "/" || path == "" {
+		return "", TrailingSlashStrict
+	}
+	if strings.HasSuffix(path, "/") {
+		path = strings.TrimSuffix(path, "/")
+	} else {
+		path += "/"
+	}
+
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	alternative := *r
+	alternative.URL = &u
+	if _, pattern := s.mux.Handler(&alternative); pattern != path {
+		return "", TrailingSlashStrict
+	}
+
+	if policy, isset := s.trailingSlashes[path]; isset {
+		return path, policy
+	}
+	return path, s.TrailingSlash
+}
@@ -0,0 +1,57 @@
+package webserver
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// SlogLogger is a Logger writing structured records through log/slog, so they can be handled by any slog.Handler
+// (e.g. slog.NewJSONHandler) rather than printed in DefaultLogger's fixed format.
+// Every record carries the request's verb and path, along with any fields attached via Request.Log().With.
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing to logger, or to slog.Default() when logger is nil
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogLogger{logger: logger}
+}
+
+func (logger *SlogLogger) LogRequest(req *Request) {
+	var args []any
+	if err := req.ResponseError(); err != nil {
+		args = []any{"error", err.Error()}
+	}
+	logger.log(req, slog.LevelInfo, "request", append([]any{
+		"status", req.ResponseCode,
+		"bytes_in", req.BodySize(),
+		"bytes_out", req.ResponseSize(),
+		"duration", req.Duration(),
+		"client_ip", req.ClientIP(),
+		"request_id", req.RequestID(),
+		"user_agent", req.UserAgent(),
+		"proto", req.Proto(),
+		"cache_hit", req.CacheHit(),
+	}, args...)...)
+}
+
+func (logger *SlogLogger) LogMessage(req *Request, msg any) {
+	logger.log(req, slog.LevelInfo, fmt.Sprint(msg))
+}
+
+func (logger *SlogLogger) LogPanic(req *Request, p any) {
+	logger.log(req, slog.LevelError, "panic", "panic", fmt.Sprint(p))
+}
+
+func (logger *SlogLogger) LogError(req *Request, err error) {
+	logger.log(req, slog.LevelError, err.Error())
+}
+
+func (logger *SlogLogger) log(req *Request, level slog.Level, msg string, args ...any) {
+	args = append([]any{"verb", req.method(), "path", req.Path, "route", req.routePattern}, args...)
+	args = append(args, req.logFields...)
+	logger.logger.Log(req.Context, level, msg, args...)
+}
@@ -0,0 +1,229 @@
+package webserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// SQLSessionStore keeps sessions in a database/sql table, so they survive restarts and are shared between instances.
+// Each session's data is stored as JSON, alongside when it expires (as a Unix timestamp) and a version counting its
+// saves, for SessionOptimistic. Expired sessions are never returned, but remain in the table until removed by
+// DeleteExpired or Cleanup.
+// Queries use "?" placeholders, as MySQL and SQLite expect; see Placeholder for other databases.
+type SQLSessionStore[T any] struct {
+	db          *sql.DB
+	table       string
+	ttl         time.Duration
+	placeholder func(n int) string
+}
+
+// Table names are written into queries, so are limited to (optionally schema qualified) plain identifiers
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// NewSQLSessionStore returns a SQLSessionStore keeping sessions in table, each expiring ttl after it was last saved.
+// Panics if table isn't a plain identifier.
+func NewSQLSessionStore[T any](db *sql.DB, table string, ttl time.Duration) *SQLSessionStore[T] {
+	if !sqlIdentifier.MatchString(table) {
+		panic(fmt.Sprintf("invalid session table name [%s]", table))
+	}
+	return &SQLSessionStore[T]{
+		db:    db,
+		table: table,
+		ttl:   ttl,
+		placeholder: func(n int) string {
+			return "?"
+		},
+	}
+}
+
+// DollarPlaceholder writes the nth query parameter as $n, as PostgreSQL expects
+func DollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// Placeholder sets how the nth (from 1) parameter of each query is written, e.g. DollarPlaceholder for PostgreSQL
+func (store *SQLSessionStore[T]) Placeholder(placeholder func(n int) string) *SQLSessionStore[T] {
+	store.placeholder = placeholder
+	return store
+}
+
+// CreateTable creates the store's table, unless it already exists
+func (store *SQLSessionStore[T]) CreateTable(ctx context.Context) error {
+	_, err := store.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (token VARCHAR(64) NOT NULL PRIMARY KEY, data TEXT NOT NULL, expires BIGINT NOT NULL, version BIGINT NOT NULL)",
+		store.table,
+	))
+	return err
+}
+
+func (store *SQLSessionStore[T]) ParseToken(header http.Header) string {
+	if token, isset := cookieFromHeader(header, "session_token"); isset && validSessionToken(token.Value) {
+		return token.Value
+	}
+	return newSessionToken()
+}
+
+func (store *SQLSessionStore[T]) Get(token string) (interface{}, error) {
+	return store.GetCtx(token, context.Background())
+}
+
+func (store *SQLSessionStore[T]) Save(token string, data interface{}) error {
+	return store.SaveCtx(token, data, context.Background())
+}
+
+func (store *SQLSessionStore[T]) Delete(token string) error {
+	return store.DeleteCtx(token, context.Background())
+}
+
+// GetCtx returns the session stored under token, or nil if there's no such session or it has expired
+func (store *SQLSessionStore[T]) GetCtx(token string, ctx context.Context) (interface{}, error) {
+	data, _, err := store.GetVersion(token, ctx)
+	return data, err
+}
+
+// GetVersion returns the session stored under token along with its version, or nil and 0 if there's no such session
+// or it has expired
+func (store *SQLSessionStore[T]) GetVersion(token string, ctx context.Context) (interface{}, uint64, error) {
+	var encoded string
+	var version uint64
+	err := store.db.QueryRowContext(ctx, fmt.Sprintf(
+		"SELECT data, version FROM %s WHERE token = %s AND expires > %s",
+		store.table, store.placeholder(1), store.placeholder(2),
+	), token, time.Now().Unix()).Scan(&encoded, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var data T
+	if err := json.Unmarshal([]byte(encoded), &data); err != nil {
+		return nil, 0, err
+	}
+	return data, version, nil
+}
+
+// SaveVersion stores data under token if the session is still at version, returning ErrSessionConflict otherwise
+func (store *SQLSessionStore[T]) SaveVersion(token string, data interface{}, version uint64, ctx context.Context) error {
+	if data == nil {
+		return store.DeleteCtx(token, ctx)
+	}
+	encoded, err := json.Marshal(data.(T))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	if version > 0 {
+		result, err := store.db.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET data = %s, expires = %s, version = version + 1 WHERE token = %s AND version = %s AND expires > %s",
+			store.table, store.placeholder(1), store.placeholder(2), store.placeholder(3), store.placeholder(4), store.placeholder(5),
+		), string(encoded), now.Add(store.ttl).Unix(), token, version, now.Unix())
+		if err != nil {
+			return err
+		}
+		if updated, err := result.RowsAffected(); err != nil {
+			return err
+		} else if updated == 0 {
+			return ErrSessionConflict
+		}
+		return nil
+	}
+
+	// A new session, though an expired one may still hold its row
+	if _, err := store.db.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE token = %s AND expires <= %s",
+		store.table, store.placeholder(1), store.placeholder(2),
+	), token, now.Unix()); err != nil {
+		return err
+	}
+	if _, err := store.db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (token, data, expires, version) VALUES (%s, %s, %s, 1)",
+		store.table, store.placeholder(1), store.placeholder(2), store.placeholder(3),
+	), token, string(encoded), now.Add(store.ttl).Unix()); err != nil {
+		// Most likely inserted by a concurrent request, though the error's form depends on the driver
+		return fmt.Errorf("%w: %v", ErrSessionConflict, err)
+	}
+	return nil
+}
+
+// SaveCtx stores data under token, pushing back when the session expires. Saving nil deletes the session.
+func (store *SQLSessionStore[T]) SaveCtx(token string, data interface{}, ctx context.Context) error {
+	if data == nil {
+		return store.DeleteCtx(token, ctx)
+	}
+	encoded, err := json.Marshal(data.(T))
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(store.ttl).Unix()
+
+	// UPDATE then INSERT, rather than an upsert, as each database has its own syntax for one
+	update := func() (int64, error) {
+		result, err := store.db.ExecContext(ctx, fmt.Sprintf(
+			"UPDATE %s SET data = %s, expires = %s, version = version + 1 WHERE token = %s",
+			store.table, store.placeholder(1), store.placeholder(2), store.placeholder(3),
+		), string(encoded), expires, token)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+	if updated, err := update(); err != nil || updated > 0 {
+		return err
+	}
+
+	_, err = store.db.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (token, data, expires, version) VALUES (%s, %s, %s, 1)",
+		store.table, store.placeholder(1), store.placeholder(2), store.placeholder(3),
+	), token, string(encoded), expires)
+	if err != nil {
+		// The row was inserted concurrently, so it only needs updating
+		_, err = update()
+	}
+	return err
+}
+
+func (store *SQLSessionStore[T]) DeleteCtx(token string, ctx context.Context) error {
+	_, err := store.db.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE token = %s",
+		store.table, store.placeholder(1),
+	), token)
+	return err
+}
+
+// DeleteExpired removes every expired session from the table, returning how many were removed
+func (store *SQLSessionStore[T]) DeleteExpired(ctx context.Context) (int64, error) {
+	result, err := store.db.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM %s WHERE expires <= %s",
+		store.table, store.placeholder(1),
+	), time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Cleanup calls DeleteExpired every interval until ctx is done, passing any errors to onError (if non-nil).
+// It blocks, so is usually run in its own goroutine.
+func (store *SQLSessionStore[T]) Cleanup(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := store.DeleteExpired(ctx); err != nil && onError != nil && ctx.Err() == nil {
+				onError(err)
+			}
+		}
+	}
+}
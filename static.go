@@ -0,0 +1,394 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// PublicRoute serves static files from one or more directories under a single path prefix
+type PublicRoute struct {
+	prefix       string
+	dirs         []string
+	index        string
+	listing      bool
+	fallback     string
+	weakETags    bool
+	immutable    *regexp.Regexp
+	cacheControl CacheControl
+	routes       map[string]bool
+	fileHashes   map[string]fileHash
+	mu           sync.RWMutex
+	// Registers a route serving path from the PublicRoute
+	route func(path string)
+}
+
+// FingerprintPattern matches file names containing a content hash of at least 6 hex digits, as produced by most
+// asset bundlers (e.g. app.3f9a1c2b.js or logo-3f9a1c.png)
+var FingerprintPattern = regexp.MustCompile(`[.-][0-9a-fA-F]{6,}\.[^.]+$`)
+
+// fileHash is the ETag of a file, valid for as long as the file's modification time and size are unchanged
+type fileHash struct {
+	etag    string
+	modTime time.Time
+	size    int64
+}
+
+// Serve the files within dirPath under pathPrefix.
+// Calling PublicRoute multiple times with the same pathPrefix layers the directories, with files found in
+// earlier directories shadowing files of the same name in later ones.
+func (s *Server[S]) PublicRoute(dirPath string, pathPrefix string) *PublicRoute {
+	if !strings.HasSuffix(pathPrefix, "/") {
+		pathPrefix += "/"
+	}
+
+	public, isset := s.publicRoutes[pathPrefix]
+	if !isset {
+		public = &PublicRoute{
+			prefix:       pathPrefix,
+			index:        "index.html",
+			cacheControl: CacheControl{Public: true, NoCache: true},
+			routes:       map[string]bool{},
+			fileHashes:   map[string]fileHash{},
+		}
+		public.route = func(path string) {
+			ApplyRoute(s, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+				GET: func(req *Request) (*bytes.Buffer, *Error) {
+					return public.serve(req, s.Logger)
+				},
+			})
+		}
+		s.publicRoutes[pathPrefix] = public
+	}
+	public.mu.Lock()
+	public.dirs = append(public.dirs, dirPath)
+	public.mu.Unlock()
+
+	// Each top-level entry of dirPath gets its own route, leaving pathPrefix itself free for other routes
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, entry := range entries {
+		path := pathPrefix + entry.Name()
+		if entry.IsDir() {
+			path += "/"
+		}
+		if public.routes[path] {
+			// Already served from a previously registered directory
+			continue
+		}
+		public.routes[path] = true
+		public.route(path)
+	}
+
+	return public
+}
+
+// PublicRouteSPA serves a single-page app from dirPath under pathPrefix. Files are served as with PublicRoute, while
+// any other path without an extension (e.g. /app/settings) is answered with indexFile, leaving it to the app's
+// client-side routing. Missing assets (paths with an extension) still respond with a 404.
+// pathPrefix itself is routed, so no other route may use it.
+func (s *Server[S]) PublicRouteSPA(dirPath string, pathPrefix string, indexFile string) *PublicRoute {
+	public := s.PublicRoute(dirPath, pathPrefix)
+	public.mu.Lock()
+	public.index = indexFile
+	public.fallback = indexFile
+	public.mu.Unlock()
+
+	public.routePrefix()
+	return public
+}
+
+// Routes the prefix itself, and so every path under it not matching a more specific route
+func (public *PublicRoute) routePrefix() {
+	if !public.routes[public.prefix] {
+		public.routes[public.prefix] = true
+		public.route(public.prefix)
+	}
+}
+
+// Index sets the default document served for requests to a directory (a path ending in "/").
+// Defaults to index.html; an empty name responds to directory requests with a 404.
+func (public *PublicRoute) Index(name string) *PublicRoute {
+	public.mu.Lock()
+	defer public.mu.Unlock()
+	public.index = name
+	return public
+}
+
+// DirectoryListing toggles responding to requests for a directory without an index document with an HTML page
+// linking to the directory's entries. Off by default, as it reveals every file served.
+// Enabling it also routes pathPrefix itself, to list the top-level directory, so no other route may use pathPrefix.
+func (public *PublicRoute) DirectoryListing(enabled bool) *PublicRoute {
+	public.mu.Lock()
+	public.listing = enabled
+	public.mu.Unlock()
+
+	if enabled {
+		public.routePrefix()
+	}
+	return public
+}
+
+// CacheControl sets the Cache-Control header sent with each file.
+// Defaults to "public, no-cache": files may change at any time, so caches revalidate them against their ETag before use.
+func (public *PublicRoute) CacheControl(cc CacheControl) *PublicRoute {
+	public.mu.Lock()
+	defer public.mu.Unlock()
+	public.cacheControl = cc
+	return public
+}
+
+// ImmutableFiles sends files whose names match pattern with "Cache-Control: public, max-age=31536000, immutable" in
+// place of the route's CacheControl, so browsers stop revalidating them. Only suitable for files whose name changes
+// whenever their content does - a nil pattern uses FingerprintPattern.
+func (public *PublicRoute) ImmutableFiles(pattern *regexp.Regexp) *PublicRoute {
+	if pattern == nil {
+		pattern = FingerprintPattern
+	}
+	public.mu.Lock()
+	defer public.mu.Unlock()
+	public.immutable = pattern
+	return public
+}
+
+// WeakETags toggles sending each file's ETag as weak (W/"..."), for when the bytes sent may differ from the file's,
+// e.g. once compressed by a proxy. Off by default. If-None-Match is compared weakly either way.
+func (public *PublicRoute) WeakETags(enabled bool) *PublicRoute {
+	public.mu.Lock()
+	defer public.mu.Unlock()
+	public.weakETags = enabled
+	return public
+}
+
+// Whether err is due to there being no file at a path, including when part of the path is a file rather than a directory
+func notExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// Returns the path and details of the file at name, from the first directory containing it
+func (public *PublicRoute) findFile(name string) (string, fs.FileInfo, error) {
+	public.mu.RLock()
+	defer public.mu.RUnlock()
+
+	for _, dir := range public.dirs {
+		info, err := fs.Stat(os.DirFS(dir), name)
+		if notExist(err) || (err == nil && info.IsDir()) {
+			continue
+		} else if err != nil {
+			return "", nil, err
+		}
+		return filepath.Join(dir, filepath.FromSlash(name)), info, nil
+	}
+	return "", nil, fs.ErrNotExist
+}
+
+func (public *PublicRoute) serve(req *Request, logger Logger) (*bytes.Buffer, *Error) {
+	public.mu.RLock()
+	req.SetCacheControl(public.cacheControl)
+	index := public.index
+	listing := public.listing
+	fallback := public.fallback
+	weak := public.weakETags
+	immutable := public.immutable
+	public.mu.RUnlock()
+
+	dir := strings.TrimPrefix(req.Path, public.prefix)
+	isDir := dir == "" || strings.HasSuffix(dir, "/")
+	name := dir
+	if isDir {
+		name += index
+	}
+
+	var path string
+	var info fs.FileInfo
+	err := fs.ErrNotExist
+	if (!isDir || index != "") && fs.ValidPath(name) {
+		path, info, err = public.findFile(name)
+	}
+	if errors.Is(err, fs.ErrNotExist) && isDir && listing {
+		// No index document, so the directory's entries are listed instead
+		return public.serveListing(req, dir)
+	} else if errors.Is(err, fs.ErrNotExist) && fallback != "" && filepath.Ext(dir) == "" {
+		// Not a file, so presumably a path for the single-page app to route
+		path, info, err = public.findFile(fallback)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.LogError(req, fmt.Errorf("FILE NOT FOUND!!"))
+		return nil, &Error{Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Error: err}
+	}
+	if immutable != nil && immutable.MatchString(info.Name()) {
+		req.SetCacheControl(CacheControl{Public: true, MaxAge: 365 * 24 * time.Hour, Immutable: true})
+	}
+
+	// A file unchanged since it was last hashed can be validated without reading it
+	hashCheck := req.Headers.Get("If-None-Match")
+	public.mu.RLock()
+	known, isset := public.fileHashes[path]
+	public.mu.RUnlock()
+	if isset && known.modTime.Equal(info.ModTime()) && known.size == info.Size() && etagMatch(hashCheck, known.etag) {
+		req.ResponseHeaders.Set("ETag", weakenETag(known.etag, weak))
+		req.ResponseCode = http.StatusNotModified
+		return new(bytes.Buffer), nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &Error{Code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &Error{Code: http.StatusInternalServerError, Error: err}
+	}
+
+	etag := contentETag(b)
+	public.mu.Lock()
+	public.fileHashes[path] = fileHash{etag: etag, modTime: info.ModTime(), size: info.Size()}
+	public.mu.Unlock()
+
+	req.ResponseHeaders.Set("ETag", weakenETag(etag, weak))
+	if etagMatch(hashCheck, etag) {
+		req.ResponseCode = http.StatusNotModified
+		return new(bytes.Buffer), nil
+	}
+	return bytes.NewBuffer(b), nil
+}
+
+// Responds with an HTML page linking to the entries of dir (a path relative to the route's prefix ending in "/"),
+// combined across all the route's directories
+func (public *PublicRoute) serveListing(req *Request, dir string) (*bytes.Buffer, *Error) {
+	name := strings.TrimSuffix(dir, "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return nil, &Error{Code: http.StatusNotFound}
+	}
+
+	public.mu.RLock()
+	dirs := public.dirs
+	weak := public.weakETags
+	public.mu.RUnlock()
+
+	found := false
+	entries := map[string]bool{}
+	for _, root := range dirs {
+		dirEntries, err := fs.ReadDir(os.DirFS(root), name)
+		if notExist(err) {
+			continue
+		} else if err != nil {
+			return nil, &Error{Code: http.StatusInternalServerError, Error: err}
+		}
+		found = true
+		for _, entry := range dirEntries {
+			entryName := entry.Name()
+			if entry.IsDir() {
+				entryName += "/"
+			}
+			entries[entryName] = true
+		}
+	}
+	if !found {
+		return nil, &Error{Code: http.StatusNotFound}
+	}
+
+	names := make([]string, 0, len(entries))
+	for entryName := range entries {
+		names = append(names, entryName)
+	}
+	sort.Strings(names)
+
+	title := html.EscapeString(req.Path)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "<!DOCTYPE html>\n<title>Index of %s</title>\n<h1>Index of %s</h1>\n<ul>\n", title, title)
+	if dir != "" {
+		buf.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entryName := range names {
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		if strings.Contains(strings.SplitN(entryName, "/", 2)[0], ":") {
+			// Would otherwise be taken for a URL scheme
+			href = "./" + href
+		}
+		fmt.Fprintf(buf, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(entryName))
+	}
+	buf.WriteString("</ul>\n")
+
+	req.ResponseHeaders.Set("Content-Type", "text/html; charset=utf-8")
+	etag := weakenETag(contentETag(buf.Bytes()), weak)
+	req.ResponseHeaders.Set("ETag", etag)
+	if etagMatch(req.Headers.Get("If-None-Match"), etag) {
+		req.ResponseCode = http.StatusNotModified
+		return new(bytes.Buffer), nil
+	}
+	return buf, nil
+}
+
+// Favicon serves the file at filePath as /favicon.ico, cacheable for a day.
+// While the file is missing, requests receive an empty 204 rather than a 404, sparing browser consoles and error logs.
+func (s *Server[S]) Favicon(filePath string) *Route[RequestBody, *bytes.Buffer] {
+	return singleFileRoute(s, "/favicon.ico", mime.TypeByExtension(filepath.Ext(filePath)), http.StatusNoContent, func() ([]byte, error) {
+		return os.ReadFile(filePath)
+	})
+}
+
+// Robots serves /robots.txt, cacheable for a day. contentOrPath is the path of the file to serve if one exists,
+// and otherwise the content itself.
+func (s *Server[S]) Robots(contentOrPath string) *Route[RequestBody, *bytes.Buffer] {
+	read := func() ([]byte, error) {
+		return []byte(contentOrPath), nil
+	}
+	if info, err := os.Stat(contentOrPath); err == nil && info.Mode().IsRegular() {
+		read = func() ([]byte, error) {
+			return os.ReadFile(contentOrPath)
+		}
+	}
+	return singleFileRoute(s, "/robots.txt", "text/plain; charset=utf-8", http.StatusNotFound, read)
+}
+
+// Registers a route at path serving the content returned by read, responding with missingCode while it returns fs.ErrNotExist.
+// An empty contentType is detected from the content.
+func singleFileRoute[S any](s *Server[S], path string, contentType string, missingCode int, read func() ([]byte, error)) *Route[RequestBody, *bytes.Buffer] {
+	handler := func(req *Request) (*bytes.Buffer, *Error) {
+		b, err := read()
+		if errors.Is(err, fs.ErrNotExist) {
+			req.ResponseCode = missingCode
+			return new(bytes.Buffer), nil
+		} else if err != nil {
+			return nil, &Error{Code: http.StatusInternalServerError, Error: err}
+		}
+
+		req.SetCacheControl(CacheControl{Public: true, MaxAge: 24 * time.Hour})
+		if contentType != "" {
+			req.ResponseHeaders.Set("Content-Type", contentType)
+		} else {
+			req.ResponseHeaders.Set("Content-Type", http.DetectContentType(b))
+		}
+		etag := contentETag(b)
+		req.ResponseHeaders.Set("ETag", etag)
+		if etagMatch(req.Headers.Get("If-None-Match"), etag) {
+			req.ResponseCode = http.StatusNotModified
+			return new(bytes.Buffer), nil
+		}
+		return bytes.NewBuffer(b), nil
+	}
+	return ApplyRoute(s, path, RequestBody{}, map[Verb]func(req *Request) (*bytes.Buffer, *Error){
+		GET:  handler,
+		HEAD: handler,
+	})
+}
@@ -0,0 +1,151 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// StreamWriter writes a response body as it's produced, compressed according to the request's Accept-Encoding header
+type StreamWriter struct {
+	w       http.ResponseWriter
+	encoder io.Writer
+	size    uint
+}
+
+func (sw *StreamWriter) Write(p []byte) (int, error) {
+	n, err := sw.encoder.Write(p)
+	sw.size += uint(n)
+	return n, err
+}
+
+// Flush sends everything written so far on to the client
+func (sw *StreamWriter) Flush() error {
+	if flusher, ok := sw.encoder.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(sw.w).Flush()
+}
+
+// Stream responds to req with the body written by write, which is sent as it's written (whenever the StreamWriter is
+// flushed) rather than once the handler returns. It's for long or slowly produced bodies, such as exports and progress
+// reports. The response's headers, including any cookies, the ResponseCode and the negotiated Content-Type, are sent
+// before write is called. The session is saved beforehand too, so changes to it after Stream is called are lost; if
+// another request saved it first (see SessionOptimistic), Stream returns ErrSessionConflict without responding.
+// The handler should return once Stream does; its response is discarded, and any error it returns is only logged.
+func (req *Request) Stream(write func(w *StreamWriter) error) error {
+	if req.written {
+		return errors.New("Response has already been written")
+	}
+	if err := req.saveSessionEarly(); err != nil {
+		return err
+	}
+	req.written = true
+	if req.ResponseCode == 0 {
+		req.ResponseCode = http.StatusOK
+	}
+	if req.responseType != nil {
+		addVary(req.ResponseHeaders, "Accept")
+		setContentType(req.ResponseHeaders, req.interfaceContentTypes, req.responseType)
+	}
+
+	if !bodyAllowed(req.Verb, req.ResponseCode) {
+		req.w.WriteHeader(req.ResponseCode)
+		return nil
+	}
+	encoder, release := contentEncoder(req, req.w)
+	req.w.WriteHeader(req.ResponseCode)
+
+	sw := &StreamWriter{w: req.w, encoder: encoder}
+	err := write(sw)
+	if release != nil {
+		if closeErr := release(); err == nil {
+			err = closeErr
+		}
+	}
+	req.responseSize = sw.size
+	return err
+}
+
+// StreamJSONArray responds to req with a JSON array of the items received from items, each written as it arrives
+// rather than building the whole array in memory. Everything written is flushed whenever the next item isn't ready yet.
+// The array is closed once items is closed. If req's context is done first (the client has gone away), streaming stops
+// with the context's error, so producers should stop sending on its cancellation too.
+// Like Stream, the handler should return once StreamJSONArray does. An item failing to marshal leaves the array
+// unterminated, as the response is already underway.
+func StreamJSONArray[T any](req *Request, items <-chan T) error {
+	// Always JSON, whatever was negotiated for the route
+	req.responseType = nil
+	req.ResponseHeaders.Set("Content-Type", "application/json")
+
+	return req.Stream(func(w *StreamWriter) error {
+		if _, err := w.Write([]byte{'['}); err != nil {
+			return err
+		}
+		for idx := 0; ; idx++ {
+			item, open, err := nextItem(req, w, items)
+			if err != nil {
+				return err
+			} else if !open {
+				break
+			}
+
+			b, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if idx > 0 {
+				if _, err := w.Write([]byte{','}); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write([]byte{']'})
+		return err
+	})
+}
+
+// Streams each value received from items as a line of JSON
+func streamNDJson(req *Request, items <-chan any) error {
+	return req.Stream(func(w *StreamWriter) error {
+		for {
+			item, open, err := nextItem(req, w, items)
+			if err != nil || !open {
+				return err
+			}
+
+			b, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(append(b, '\n')); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// Receives the next item from items. If it isn't ready yet, everything written so far is flushed while waiting.
+func nextItem[T any](req *Request, w *StreamWriter, items <-chan T) (item T, open bool, err error) {
+	select {
+	case item, open = <-items:
+		return item, open, nil
+	default:
+	}
+
+	if err = w.Flush(); err != nil {
+		return item, false, err
+	}
+	select {
+	case item, open = <-items:
+		return item, open, nil
+	case <-req.Context.Done():
+		return item, false, req.Context.Err()
+	}
+}
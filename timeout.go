@@ -0,0 +1,20 @@
+package webserver
+
+import (
+	"context"
+	"time"
+)
+
+// Timeout returns a middleware giving each request d to be handled, after which its Context is cancelled.
+// A handler still running at the deadline has its response discarded for a 503 once it returns, so only handlers
+// which observe req.Context (as database drivers and HTTP clients do) are cut short.
+// Responses the handler has already written itself, e.g. with Stream, are left as they are.
+// Not suited to websocket or event stream routes, which would be closed at the deadline.
+func Timeout(d time.Duration) Middleware {
+	return func(req *Request) *Error {
+		ctx, cancel := context.WithTimeout(req.Context, d)
+		req.Context = ctx
+		req.Cleanup(cancel)
+		return nil
+	}
+}
@@ -0,0 +1,37 @@
+package webserver
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Starts a span for req to the route at pattern, continuing any trace propagated by the client (W3C traceparent).
+// The span is made available to the handler via req.Context, e.g. trace.SpanFromContext(req.Context).
+// Returns the function ending the span, which records the response status; a no-op when Server.Tracer isn't set.
+func (s *Server[S]) startSpan(req *Request, pattern string) func() {
+	if s.Tracer == nil {
+		return func() {}
+	}
+
+	ctx := propagation.TraceContext{}.Extract(req.Context, propagation.HeaderCarrier(req.Headers))
+	ctx, span := s.Tracer.Start(ctx, req.req.Method+" "+pattern,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.req.Method),
+			attribute.String("http.route", pattern),
+			attribute.String("url.path", req.Path),
+		),
+	)
+	req.Context = ctx
+	req.req = req.req.WithContext(ctx)
+
+	return func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", req.ResponseCode))
+		if req.ResponseCode >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		span.End()
+	}
+}
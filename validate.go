@@ -0,0 +1,162 @@
+package webserver
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// validateTags checks the fields of a JSON request body against their `validate` struct tags, such as
+// `validate:"required,email"`. Supported rules are:
+//   - required: the field may not be its zero value
+//   - email: a non-empty string must be an email address
+//   - min=N, max=N: bounds on the length of strings, slices and maps, or on the value of numbers
+//
+// Failing fields are keyed by their JSON name. Nested structs are checked too, their fields keyed as "parent.child".
+// A non-nil error is only returned for a malformed tag.
+func validateTags(body any) (ValidationError, error) {
+	v := reflect.ValueOf(body)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	failures := ValidationError{}
+	if err := validateStruct(v, "", failures); err != nil {
+		return nil, err
+	}
+	if len(failures) == 0 {
+		return nil, nil
+	}
+	return failures, nil
+}
+
+func validateStruct(v reflect.Value, prefix string, failures ValidationError) error {
+	t := v.Type()
+	for idx := 0; idx < t.NumField(); idx++ {
+		field := t.Field(idx)
+		if !field.IsExported() {
+			continue
+		}
+		name := jsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+		name = prefix + name
+
+		value := v.Field(idx)
+		if rules, ok := field.Tag.Lookup("validate"); ok {
+			msg, err := validateField(value, rules)
+			if err != nil {
+				return fmt.Errorf("Field %s of %s: %w", field.Name, t, err)
+			}
+			if msg != "" {
+				failures[name] = msg
+				continue
+			}
+		}
+
+		for value.Kind() == reflect.Pointer && !value.IsNil() {
+			value = value.Elem()
+		}
+		if value.Kind() == reflect.Struct {
+			nestedPrefix := name + "."
+			if field.Anonymous && field.Tag.Get("json") == "" {
+				// encoding/json promotes the fields of embedded structs
+				nestedPrefix = prefix
+			}
+			if err := validateStruct(value, nestedPrefix, failures); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a description of the first rule value fails, or "" if it passes them all
+func validateField(value reflect.Value, rules string) (string, error) {
+	for _, rule := range strings.Split(rules, ",") {
+		rule, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch rule {
+		case "":
+		case "required":
+			if value.IsZero() {
+				return "is required", nil
+			}
+		case "email":
+			if value.Kind() != reflect.String {
+				return "", fmt.Errorf("email rule on non-string kind %s", value.Kind())
+			}
+			if s := value.String(); s != "" {
+				if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+					return "must be a valid email address", nil
+				}
+			}
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid %s bound %q", rule, arg)
+			}
+			size, isLength, err := fieldSize(value)
+			if err != nil {
+				return "", err
+			}
+			if (rule == "min" && size < bound) || (rule == "max" && size > bound) {
+				return boundMessage(rule, arg, isLength), nil
+			}
+		default:
+			return "", fmt.Errorf("unknown validation rule %q", rule)
+		}
+	}
+	return "", nil
+}
+
+// Returns the length of value (for strings, slices and maps) or the value itself (for numbers)
+func fieldSize(value reflect.Value) (float64, bool, error) {
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return 0, true, nil
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.String:
+		return float64(len([]rune(value.String()))), true, nil
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), false, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), false, nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), false, nil
+	}
+	return 0, false, fmt.Errorf("min/max rule on unsupported kind %s", value.Kind())
+}
+
+func boundMessage(rule string, arg string, isLength bool) string {
+	bound := "at least"
+	if rule == "max" {
+		bound = "at most"
+	}
+	if isLength {
+		return fmt.Sprintf("must have a length of %s %s", bound, arg)
+	}
+	return fmt.Sprintf("must be %s %s", bound, arg)
+}
+
+// Returns the name field is (un)marshaled as by encoding/json
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
@@ -1,8 +1,15 @@
 package webserver
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"sync"
 )
 
 type Verb byte
@@ -19,8 +26,60 @@ const (
 	PATCH
 )
 
+// Method names registered with RegisterVerb, the first being the Verb after PATCH
+var customVerbs struct {
+	sync.RWMutex
+	names []string
+}
+
+// RegisterVerb makes ParseVerb recognize an extension method, e.g. "PROPFIND" for WebDAV, returning the Verb to use as
+// its key in a route's handlers. Registering a name again returns the same Verb.
+// Its request bodies are only parsed once it's in the server's BodyVerbs, or a route's via ApplyVerbBody.
+// Panics if name isn't a valid method name, or too many have been registered.
+func RegisterVerb(name string) Verb {
+	name = strings.ToUpper(name)
+	if name == "" || strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r))
+	}) >= 0 {
+		panic(fmt.Sprintf("Invalid method name %q", name))
+	}
+	if verb, err := ParseVerb(name); err == nil {
+		return verb
+	}
+
+	customVerbs.Lock()
+	defer customVerbs.Unlock()
+	if idx := slices.Index(customVerbs.names, name); idx >= 0 {
+		// Registered concurrently
+		return PATCH + 1 + Verb(idx)
+	} else if int(PATCH)+len(customVerbs.names) >= 254 {
+		// Leaving room for loops over every Verb to end
+		panic("Too many verbs registered")
+	}
+	customVerbs.names = append(customVerbs.names, name)
+	return PATCH + Verb(len(customVerbs.names))
+}
+
+// Returns the name of a verb registered with RegisterVerb, or "" if v wasn't
+func customVerbName(v Verb) string {
+	customVerbs.RLock()
+	defer customVerbs.RUnlock()
+	if v <= PATCH || int(v-PATCH) > len(customVerbs.names) {
+		return ""
+	}
+	return customVerbs.names[v-PATCH-1]
+}
+
+// Returns the last Verb, including those registered with RegisterVerb
+func lastVerb() Verb {
+	customVerbs.RLock()
+	defer customVerbs.RUnlock()
+	return PATCH + Verb(len(customVerbs.names))
+}
+
 func ParseVerb(in string) (Verb, error) {
-	switch strings.ToUpper(in) {
+	in = strings.ToUpper(in)
+	switch in {
 	case "GET":
 		return GET, nil
 	case "POST":
@@ -40,6 +99,11 @@ func ParseVerb(in string) (Verb, error) {
 	case "PATCH":
 		return PATCH, nil
 	default:
+		customVerbs.RLock()
+		defer customVerbs.RUnlock()
+		if idx := slices.Index(customVerbs.names, in); idx >= 0 {
+			return PATCH + 1 + Verb(idx), nil
+		}
 		return 0, fmt.Errorf("Invalid Verb")
 	}
 
@@ -66,7 +130,48 @@ func (v Verb) String() string {
 	case PATCH:
 		return "PATCH"
 	default:
+		if name := customVerbName(v); name != "" {
+			return name
+		}
 		panic("Invalid verb")
 	}
 
 }
+
+// Returns the value of the Allow header for a route with the given handlers. OPTIONS is always allowed.
+func allowHeader[T any](handlers map[Verb]T) string {
+	allowed := []string{}
+	for verb, last := GET, lastVerb(); verb <= last; verb++ {
+		if _, isset := handlers[verb]; isset || verb == OPTIONS {
+			allowed = append(allowed, verb.String())
+		}
+	}
+	return strings.Join(allowed, ", ")
+}
+
+// Returns the verb a POST request asks to be treated as, via an X-HTTP-Method-Override header or a _method field in
+// its urlencoded form body, or 0 if it doesn't ask. Overriding to a verb not in allowed is an error.
+// The body is read to find the form field, so is replaced with a copy for the route's parser.
+func methodOverride(r *http.Request, allowed []Verb) (Verb, *Error) {
+	override := r.Header.Get("X-HTTP-Method-Override")
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); override == "" &&
+		mediaType == "application/x-www-form-urlencoded" && r.Header.Get("Content-Encoding") == "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return 0, bodyReadError(err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			override = values.Get("_method")
+		}
+	}
+	if override == "" {
+		return 0, nil
+	}
+
+	verb, err := ParseVerb(override)
+	if err != nil || !slices.Contains(allowed, verb) {
+		return 0, &Error{Code: http.StatusBadRequest, Error: fmt.Errorf("Method override to %q is not allowed", override)}
+	}
+	return verb, nil
+}
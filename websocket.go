@@ -0,0 +1,241 @@
+package webserver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// WebsocketMessage is a message for the client, sent as a binary frame if Binary is set and a text frame otherwise
+type WebsocketMessage struct {
+	Binary  bool
+	Payload []byte
+}
+
+// WebsocketMessageHandler is a WebsocketHandler which chooses the frame type of each message it sends
+type WebsocketMessageHandler func(req *Request, inFeed <-chan []byte) <-chan WebsocketMessage
+
+// Adapts handler to send each of its messages as a text frame
+func textMessages(handler WebsocketHandler) WebsocketMessageHandler {
+	return func(req *Request, inFeed <-chan []byte) <-chan WebsocketMessage {
+		messages := make(chan WebsocketMessage)
+		out := handler(req, inFeed)
+		go func() {
+			defer close(messages)
+			for payload := range out {
+				messages <- WebsocketMessage{Payload: payload}
+			}
+		}()
+		return messages
+	}
+}
+
+// WebsocketCloseCode is the status code sent to the client in the websocket close frame
+type WebsocketCloseCode uint16
+
+const (
+	WebsocketNormalClosure   WebsocketCloseCode = 1000
+	WebsocketGoingAway       WebsocketCloseCode = 1001
+	WebsocketPolicyViolation WebsocketCloseCode = 1008
+	WebsocketInternalError   WebsocketCloseCode = 1011
+)
+
+// CloseWebsocket sets the code and reason sent in the close frame once the handler's outbound channel is closed.
+// If never called, the connection is closed with WebsocketNormalClosure.
+func (req *Request) CloseWebsocket(code WebsocketCloseCode, reason string) {
+	req.wsCloseCode = code
+	req.wsCloseReason = reason
+}
+
+func (s *Server[S]) serveWebsocket(req *Request, w http.ResponseWriter, r *http.Request, handler WebsocketMessageHandler) {
+	var closedConnectionError = &wsutil.ClosedError{}
+	in := make(chan []byte)
+
+	netConn, _, _, upgradeErr := ws.UpgradeHTTP(r, w)
+
+	if upgradeErr != nil {
+		// handle error
+		s.Logger.LogError(req, fmt.Errorf("Error upgrading websocket connection! %v", upgradeErr))
+		s.applyError(req, Error{Code: http.StatusInternalServerError, Error: upgradeErr}, w)
+		return
+	}
+	defer netConn.Close()
+	conn := &websocketConn{
+		conn:         netConn,
+		readTimeout:  s.WebsocketReadTimeout,
+		writeTimeout: s.WebsocketWriteTimeout,
+	}
+
+	ctx, cancel := context.WithCancel(req.Context)
+	req.Context = ctx
+	out := handler(req, in)
+
+	// closed once the client has sent its own close frame, which has already been answered
+	clientClosed := make(chan struct{})
+
+	go func() {
+		defer func() {
+			close(in)
+			cancel()
+		}()
+
+		for {
+			payload, err := conn.readText()
+			if err != nil {
+				// Only really care if it's not a closed connection error...
+				if errors.As(err, closedConnectionError) {
+					close(clientClosed)
+				} else if errors.Is(err, os.ErrDeadlineExceeded) {
+					s.Logger.LogMessage(req, "Websocket client timed out")
+				} else if !errors.Is(err, net.ErrClosed) {
+					s.Logger.LogError(req, fmt.Errorf("Error reading websocket payload! %v", err))
+				}
+				return
+			}
+			in <- payload
+		}
+	}()
+
+	if conn.readTimeout > 0 {
+		// Pings an otherwise idle client, whose pongs keep its connection from timing out
+		go func() {
+			ticker := time.NewTicker(conn.readTimeout / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := conn.writeFrame(ws.NewPingFrame(nil)); err != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for msg := range out {
+		op := ws.OpText
+		if msg.Binary {
+			op = ws.OpBinary
+		}
+		wsErr := conn.writeFrame(ws.NewFrame(op, true, msg.Payload))
+		if wsErr != nil {
+			s.Logger.LogError(req, fmt.Errorf("Error writing message: %v", wsErr))
+			// The connection is broken, so the handler is told to stop and anything else it sends is discarded
+			cancel()
+			go func() {
+				for range out {
+				}
+			}()
+			return
+		}
+	}
+
+	select {
+	case <-clientClosed:
+		return
+	default:
+	}
+
+	code := req.wsCloseCode
+	if code == 0 {
+		code = WebsocketNormalClosure
+	}
+	closeFrame := ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusCode(code), req.wsCloseReason))
+	if err := conn.writeFrame(closeFrame); err != nil {
+		s.Logger.LogError(req, fmt.Errorf("Error sending websocket close frame: %v", err))
+	}
+}
+
+// websocketConn applies the server's websocket timeouts to a connection. Each read pushes back the read deadline,
+// and frames are written whole, one at a time, as messages, pings and replies to the client's control frames are
+// written from different goroutines.
+type websocketConn struct {
+	conn         net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	mu           sync.Mutex
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.conn.Read(p)
+}
+
+func (c *websocketConn) writeFrame(frame ws.Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return ws.WriteFrame(c.conn, frame)
+}
+
+func (c *websocketConn) write(p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.conn.Write(p)
+	return err
+}
+
+// Reads the client's next text message, answering any control frames received in the meantime
+func (c *websocketConn) readText() ([]byte, error) {
+	rd := wsutil.Reader{
+		Source:         c,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		OnIntermediate: c.handleControl,
+	}
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := c.handleControl(hdr, &rd); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if hdr.OpCode&ws.OpText == 0 {
+			if err := rd.Discard(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return io.ReadAll(&rd)
+	}
+}
+
+// Answers a control frame from the client (a pong for a ping, a close frame for a close frame)
+func (c *websocketConn) handleControl(hdr ws.Header, r io.Reader) error {
+	var reply bytes.Buffer
+	err := wsutil.ControlHandler{
+		Src:                 r,
+		Dst:                 &reply,
+		State:               ws.StateServerSide,
+		DisableSrcCiphering: true,
+	}.Handle(hdr)
+	if reply.Len() > 0 {
+		if writeErr := c.write(reply.Bytes()); err == nil {
+			err = writeErr
+		}
+	}
+	return err
+}